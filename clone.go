@@ -0,0 +1,243 @@
+package pgtestdb
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/peterldowns/pgtestdb/internal/once"
+)
+
+const (
+	// StrategyWALLog is the `STRATEGY` that copies a template block by block
+	// through the write-ahead log. It is efficient for small templates.
+	StrategyWALLog = "WAL_LOG"
+	// StrategyFileCopy is the `STRATEGY` that copies a template's files
+	// directly, and forces two checkpoints. It is efficient for large
+	// templates.
+	StrategyFileCopy = "FILE_COPY"
+	// FileCopyThreshold is the size of a template, in bytes, above which
+	// [TemplateCopy] uses [StrategyFileCopy] instead of [StrategyWALLog] if
+	// no Strategy is set.
+	FileCopyThreshold = 64 << 20
+)
+
+// A CloneStrategy creates each test database. The default is chosen by
+// detecting what the server supports: [TemplateCopy] for Postgres, and
+// [MigrateReplay] for servers that claim to be compatible with Postgres but
+// don't support templates.
+type CloneStrategy interface {
+	// UsesTemplate reports whether Clone copies the template database, so
+	// that pgtestdb only builds templates for strategies that need them.
+	UsesTemplate() bool
+	// Clone creates the database described by instance, owned by its User,
+	// as a copy of the template described by template. If UsesTemplate is
+	// false, the template database does not exist, and Clone should use the
+	// migrator instead.
+	Clone(ctx context.Context, baseDB *sql.DB, template Config, instance Config, migrator Migrator) error
+}
+
+// TemplateCopy clones the template with `CREATE DATABASE ... WITH TEMPLATE`.
+type TemplateCopy struct {
+	// Strategy is the `STRATEGY` used to copy the template on Postgres 15
+	// and later, [StrategyWALLog] or [StrategyFileCopy]. If it is not set,
+	// TemplateCopy uses [StrategyFileCopy] for templates larger than
+	// [FileCopyThreshold] and [StrategyWALLog] otherwise. It is ignored by
+	// older servers.
+	Strategy string
+}
+
+func (TemplateCopy) UsesTemplate() bool {
+	return true
+}
+
+func (c TemplateCopy) Clone(ctx context.Context, baseDB *sql.DB, template Config, instance Config, _ Migrator) error {
+	defaultStrategy, err := defaultCopyStrategy(ctx, baseDB, template.Database)
+	if err != nil {
+		return err
+	}
+	return c.clone(ctx, baseDB, template, instance, defaultStrategy)
+}
+
+// clone is Clone, given the result of [defaultCopyStrategy] for the template,
+// which pgtestdb looks up once per template rather than once per clone.
+func (c TemplateCopy) clone(ctx context.Context, baseDB *sql.DB, template Config, instance Config, defaultStrategy string) error {
+	strategy := defaultStrategy
+	if strategy != "" && c.Strategy != "" {
+		strategy = c.Strategy
+	}
+	query := fmt.Sprintf(
+		`CREATE DATABASE "%s" WITH TEMPLATE "%s" OWNER "%s"`,
+		instance.Database,
+		template.Database,
+		instance.User,
+	)
+	if strategy != "" {
+		query += " STRATEGY " + strategy
+	}
+	if _, err := baseDB.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to create instance from template %s: %w", template.Database, err)
+	}
+	return nil
+}
+
+// defaultCopyStrategy returns the `STRATEGY` that [TemplateCopy] uses for a
+// template if none is set, based on the size of the template, or an empty
+// string if the server is older than Postgres 15 and doesn't support
+// `STRATEGY`.
+func defaultCopyStrategy(ctx context.Context, db queryer, template string) (string, error) {
+	var supported bool
+	var size int64
+	query := "SELECT current_setting('server_version_num')::int >= 150000, pg_database_size($1)"
+	if err := db.QueryRowContext(ctx, query, template).Scan(&supported, &size); err != nil {
+		return "", fmt.Errorf("failed to check size of template %s: %w", template, err)
+	}
+	switch {
+	case !supported:
+		return "", nil
+	case size > FileCopyThreshold:
+		return StrategyFileCopy, nil
+	default:
+		return StrategyWALLog, nil
+	}
+}
+
+// DumpRestore clones the template by piping `pg_dump` of the template into
+// `pg_restore` of an empty database. It is much slower than [TemplateCopy],
+// but works on servers that can't copy databases that are in use or that
+// restrict `CREATE DATABASE ... WITH TEMPLATE`.
+type DumpRestore struct {
+	// BinDir is the directory containing `pg_dump` and `pg_restore`. If it
+	// is not set, they are found on the PATH. Their major version should be
+	// at least that of the server.
+	BinDir string
+}
+
+func (DumpRestore) UsesTemplate() bool {
+	return true
+}
+
+func (c DumpRestore) Clone(ctx context.Context, baseDB *sql.DB, template Config, instance Config, _ Migrator) (final error) {
+	dumpPath, err := c.lookPath("pg_dump")
+	if err != nil {
+		return err
+	}
+	restorePath, err := c.lookPath("pg_restore")
+	if err != nil {
+		return err
+	}
+	if err := createEmpty(ctx, baseDB, instance); err != nil {
+		return err
+	}
+	defer dropIfFailed(ctx, baseDB, instance, &final)
+	var dumpErr, restoreErr bytes.Buffer
+	dump := exec.CommandContext(ctx, dumpPath, "--format=custom", "--no-owner", "--dbname="+template.URL())
+	dump.Stderr = &dumpErr
+	restore := exec.CommandContext(ctx, restorePath, "--no-owner", "--exit-on-error", "--dbname="+instance.URL())
+	restore.Stderr = &restoreErr
+	restore.Stdin, err = dump.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to pipe pg_dump to pg_restore: %w", err)
+	}
+	if err := restore.Start(); err != nil {
+		return fmt.Errorf("failed to start pg_restore: %w", err)
+	}
+	if err := dump.Run(); err != nil {
+		_ = restore.Wait()
+		return fmt.Errorf("failed to pg_dump template %s: %w: %s", template.Database, err, strings.TrimSpace(dumpErr.String()))
+	}
+	if err := restore.Wait(); err != nil {
+		return fmt.Errorf("failed to pg_restore instance %s: %w: %s", instance.Database, err, strings.TrimSpace(restoreErr.String()))
+	}
+	return nil
+}
+
+// lookPath finds one of the postgres client programs.
+func (c DumpRestore) lookPath(name string) (string, error) {
+	if c.BinDir != "" {
+		name = filepath.Join(c.BinDir, name)
+	}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", fmt.Errorf("failed to find %s: %w", name, err)
+	}
+	return path, nil
+}
+
+// MigrateReplay creates each test database empty and runs the migrator on it,
+// instead of copying a template. It is the slowest strategy, since Migrate is
+// called once per test, but it works on servers without template support.
+type MigrateReplay struct{}
+
+func (MigrateReplay) UsesTemplate() bool {
+	return false
+}
+
+func (MigrateReplay) Clone(ctx context.Context, baseDB *sql.DB, _ Config, instance Config, migrator Migrator) (final error) {
+	if err := createEmpty(ctx, baseDB, instance); err != nil {
+		return err
+	}
+	defer dropIfFailed(ctx, baseDB, instance, &final)
+	db, err := instance.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to instance %s: %w", instance.Database, err)
+	}
+	defer db.Close()
+	if err := migrator.Migrate(ctx, db, instance); err != nil {
+		return fmt.Errorf("failed to migrator.Migrate instance %s: %w", instance.Database, err)
+	}
+	return nil
+}
+
+// createEmpty creates an empty database owned by the test role.
+func createEmpty(ctx context.Context, baseDB *sql.DB, instance Config) error {
+	query := fmt.Sprintf(`CREATE DATABASE "%s" OWNER "%s"`, instance.Database, instance.User)
+	if _, err := baseDB.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to create instance %s: %w", instance.Database, err)
+	}
+	return nil
+}
+
+// dropIfFailed drops a database created by createEmpty if filling it in
+// failed, so that a failed clone doesn't leave an empty database behind. An
+// error dropping it is added to the original error.
+func dropIfFailed(ctx context.Context, baseDB *sql.DB, instance Config, final *error) {
+	if *final == nil {
+		return
+	}
+	query := fmt.Sprintf(`DROP DATABASE IF EXISTS "%s"`, instance.Database)
+	if _, err := baseDB.ExecContext(ctx, query); err != nil {
+		*final = fmt.Errorf("%w (and failed to drop instance %s: %s)", *final, instance.Database, err)
+	}
+}
+
+// cloneStrategies caches the default clone strategy of each server. Transient
+// errors are forgotten, so that the next test tries to detect it again.
+var cloneStrategies once.Map[string, CloneStrategy] = once.NewMapWithOptions[string, CloneStrategy](forgetRetryable) //nolint:gochecknoglobals
+
+// cloneStrategy returns the clone strategy from the config, or else detects
+// the default strategy for the server once per program.
+func cloneStrategy(ctx context.Context, baseDB *sql.DB, conf Config) (CloneStrategy, error) {
+	if conf.CloneStrategy != nil {
+		return conf.CloneStrategy, nil
+	}
+	strategy, err := cloneStrategies.Set(conf.serverKey(), func() (*CloneStrategy, error) {
+		var version string
+		if err := baseDB.QueryRowContext(ctx, "SELECT version()").Scan(&version); err != nil {
+			return nil, conf.retryable(fmt.Errorf("failed to detect server version: %w", err))
+		}
+		var strategy CloneStrategy = TemplateCopy{}
+		if !strings.HasPrefix(version, "PostgreSQL ") {
+			strategy = MigrateReplay{}
+		}
+		return &strategy, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return *strategy, nil
+}
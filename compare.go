@@ -0,0 +1,60 @@
+package pgtestdb
+
+import (
+	"context"
+)
+
+// CompareMigrators checks that two migrators produce the same schema. It
+// get-or-creates the template for each migrator, and fails the test with a
+// line-by-line diff of the two schemas if they are different. This is useful
+// when switching from one migration framework to another, or for checking that
+// a declarative schema matches a directory of migrations.
+//
+// The tables listed in [DefaultBookkeepingTables], along with any
+// `ignoreTables`, are left out of the comparison, since each framework keeps
+// track of which migrations it has applied in a different way.
+//
+// If [Config.Shards] is set, both templates are built on the shard chosen by
+// the [Config.ShardStrategy]. [Config.IsolateSchemas] is not supported.
+func CompareMigrators(t TB, conf Config, a, b Migrator, ignoreTables ...string) {
+	t.Helper()
+	ctx := context.Background()
+	// Both templates are built on the same shard, so that they can be
+	// described over the same connection.
+	conf, err := conf.chooseShard(ctx, t)
+	if err != nil {
+		t.Fatalf("%s", err)
+		return // unreachable
+	}
+	releaseBaseConn, err := conf.acquireBaseConn(ctx)
+	if err != nil {
+		t.Fatalf("%s", err)
+		return // unreachable
+	}
+	defer releaseBaseConn()
+	baseDB, err := conf.Connect()
+	if err != nil {
+		t.Fatalf("could not connect to database: %s", err)
+		return // unreachable
+	}
+	defer baseDB.Close()
+
+	opts := bookkeepingOptions(ignoreTables)
+	var descs [2]string
+	for i, migrator := range []Migrator{a, b} {
+		template, err := prepareTemplate(ctx, baseDB, conf, migrator)
+		if err != nil {
+			t.Fatalf("%s", err)
+			return // unreachable
+		}
+		descs[i], err = describeTemplate(ctx, baseDB, *template, opts)
+		if err != nil {
+			t.Fatalf("%s", err)
+			return // unreachable
+		}
+	}
+	if diff := schemaDiff(descs[0], descs[1]); diff != "" {
+		t.Fatalf("migrators produced different schemas (-a +b):\n%s", diff)
+		return // unreachable
+	}
+}
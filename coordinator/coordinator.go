@@ -0,0 +1,216 @@
+// coordinator package limits how many test databases exist at once across
+// every test process on a machine, such as the test binaries that
+// `go test ./...` runs for each package in parallel.
+//
+// Without a limit, each process creates as many test databases, and opens as
+// many connections, as it has parallel tests, and together they can exhaust
+// the server's max_connections. Set a [Local] coordinator as the
+// [pgtestdb.Config.Coordinator] to cap the total instead. Set
+// [Options.MaxBaseConns] to also cap the number of connections that tests
+// have open to the base database at once, to create and drop their test
+// databases.
+//
+// The limit is enforced with a directory of lock files, one per slot, rather
+// than with a daemon: a test holds the lock on a slot from the moment it asks
+// for a database until the database has been dropped. Locks are released by
+// the operating system when a process exits, so a crashed test run never
+// leaves slots behind.
+package coordinator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/peterldowns/pgtestdb"
+	"github.com/peterldowns/pgtestdb/internal/flock"
+	"github.com/peterldowns/pgtestdb/internal/multierr"
+)
+
+// DefaultPollInterval is how often a waiting test checks for a free slot,
+// unless [Options.PollInterval] is set.
+const DefaultPollInterval = 25 * time.Millisecond
+
+// Options configures a [Local] coordinator.
+type Options struct {
+	// Dir is the directory that holds the slot lock files. Every process
+	// using the same Dir shares the same limit. If empty, a directory named
+	// after the current user is created in the system's temporary
+	// directory.
+	Dir string
+	// MaxInstances is the number of test databases that may exist at once,
+	// across all processes. Required.
+	MaxInstances int
+	// If greater than zero, MaxBaseConns is the number of tests that may be
+	// connected to the base database at once, across all processes. See
+	// [pgtestdb.BaseConnCoordinator] for when tests connect to it.
+	MaxBaseConns int
+	// Timeout is how long a test waits for a free slot, of either kind,
+	// before failing. If zero, tests wait for as long as it takes. Note that a single test that
+	// creates more databases than MaxInstances will wait forever, since it
+	// only releases its slots when it finishes.
+	Timeout time.Duration
+	// PollInterval is how often a waiting test checks for a free slot.
+	// Defaults to [DefaultPollInterval].
+	PollInterval time.Duration
+}
+
+// Local is a [pgtestdb.Coordinator] that enforces a limit on the number of test
+// databases shared by every process on the machine. Create one with [New].
+type Local struct {
+	opts      Options
+	instances *slots
+	baseConns *slots // nil unless MaxBaseConns is set
+}
+
+// slots is a set of lock files, each of which can be held by one test at a
+// time.
+type slots struct {
+	name  string // what the slots are for, for errors
+	mu    sync.Mutex
+	files []*flock.File
+	held  []bool // slots held by this process, which flock would let it lock again
+}
+
+// openSlots opens the lock files of `n` slots, named with the given prefix.
+func openSlots(dir, prefix, name string, n int) (*slots, error) {
+	s := &slots{name: name, held: make([]bool, n)}
+	for i := 0; i < n; i++ {
+		file, err := flock.Open(filepath.Join(dir, fmt.Sprintf("%s-%d", prefix, i)))
+		if err != nil {
+			_ = s.close()
+			return nil, fmt.Errorf("coordinator: %w", err)
+		}
+		s.files = append(s.files, file)
+	}
+	return s, nil
+}
+
+// New creates a [Local] coordinator, creating its directory if necessary.
+func New(opts Options) (*Local, error) {
+	if opts.MaxInstances <= 0 {
+		return nil, errors.New("coordinator: MaxInstances must be greater than zero")
+	}
+	if opts.Dir == "" {
+		opts.Dir = filepath.Join(os.TempDir(), fmt.Sprintf("pgtestdb-coordinator-%d", os.Getuid()))
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = DefaultPollInterval
+	}
+	if err := os.MkdirAll(opts.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("coordinator: failed to create %s: %w", opts.Dir, err)
+	}
+	instances, err := openSlots(opts.Dir, "slot", "slots", opts.MaxInstances)
+	if err != nil {
+		return nil, err
+	}
+	c := &Local{opts: opts, instances: instances}
+	if opts.MaxBaseConns > 0 {
+		c.baseConns, err = openSlots(opts.Dir, "base-conn-slot", "base connection slots", opts.MaxBaseConns)
+		if err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Acquire implements [pgtestdb.Coordinator]. It waits until one of the slots
+// is free, or until the context is done or the timeout has passed.
+func (c *Local) Acquire(ctx context.Context) (func(), error) {
+	return c.acquire(ctx, c.instances)
+}
+
+// AcquireBaseConn implements [pgtestdb.BaseConnCoordinator]. It waits until
+// one of the base connection slots is free, or until the context is done or
+// the timeout has passed. If [Options.MaxBaseConns] is not set, it returns
+// right away.
+func (c *Local) AcquireBaseConn(ctx context.Context) (func(), error) {
+	if c.baseConns == nil {
+		return func() {}, nil
+	}
+	return c.acquire(ctx, c.baseConns)
+}
+
+func (c *Local) acquire(ctx context.Context, s *slots) (func(), error) {
+	if c.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.Timeout)
+		defer cancel()
+	}
+	ticker := time.NewTicker(c.opts.PollInterval)
+	defer ticker.Stop()
+	for {
+		release, err := s.tryAcquire()
+		if release != nil || err != nil {
+			return release, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf(
+				"coordinator: all %d %s in %s are in use: %w",
+				len(s.files), s.name, c.opts.Dir, context.Cause(ctx),
+			)
+		case <-ticker.C:
+		}
+	}
+}
+
+// tryAcquire returns a function that releases a slot if one was free, or nil.
+func (s *slots) tryAcquire() (func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, slot := range s.files {
+		if s.held[i] {
+			continue
+		}
+		ok, err := slot.TryLock()
+		if err != nil {
+			return nil, fmt.Errorf("coordinator: %w", err)
+		}
+		if !ok {
+			continue
+		}
+		s.held[i] = true
+		var once sync.Once
+		return func() {
+			once.Do(func() { s.release(i) })
+		}, nil
+	}
+	return nil, nil
+}
+
+func (s *slots) release(i int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// If unlocking fails the slot stays locked until the process exits,
+	// which only makes the limit stricter.
+	_ = s.files[i].Unlock()
+	s.held[i] = false
+}
+
+func (s *slots) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for _, file := range s.files {
+		err = multierr.Join(err, file.Close())
+	}
+	return err
+}
+
+// Close closes the slot lock files, releasing any slots still held by this
+// process.
+func (c *Local) Close() error {
+	err := c.instances.close()
+	if c.baseConns != nil {
+		err = multierr.Join(err, c.baseConns.close())
+	}
+	return err
+}
+
+var _ pgtestdb.BaseConnCoordinator = (*Local)(nil)
@@ -0,0 +1,177 @@
+package coordinator_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib" // "pgx" driver
+	"github.com/peterldowns/testy/assert"
+	"github.com/peterldowns/testy/check"
+
+	"github.com/peterldowns/pgtestdb"
+	"github.com/peterldowns/pgtestdb/coordinator"
+)
+
+func newCoordinator(t *testing.T, opts coordinator.Options) *coordinator.Local {
+	t.Helper()
+	c, err := coordinator.New(opts)
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func TestLimitsSlots(t *testing.T) {
+	t.Parallel()
+	c := newCoordinator(t, coordinator.Options{
+		Dir:          t.TempDir(),
+		MaxInstances: 2,
+		Timeout:      50 * time.Millisecond,
+	})
+	ctx := context.Background()
+	release1, err := c.Acquire(ctx)
+	assert.Nil(t, err)
+	_, err = c.Acquire(ctx)
+	assert.Nil(t, err)
+
+	_, err = c.Acquire(ctx)
+	check.NotEqual(t, nil, err)
+
+	release1()
+	release1() // releasing twice is harmless
+	_, err = c.Acquire(ctx)
+	check.Nil(t, err)
+	_, err = c.Acquire(ctx)
+	check.NotEqual(t, nil, err)
+}
+
+// Two coordinators with the same directory share slots, just like two
+// processes would.
+func TestSharesSlotsThroughDir(t *testing.T) {
+	t.Parallel()
+	opts := coordinator.Options{
+		Dir:          t.TempDir(),
+		MaxInstances: 1,
+		Timeout:      50 * time.Millisecond,
+	}
+	a := newCoordinator(t, opts)
+	b := newCoordinator(t, opts)
+	ctx := context.Background()
+
+	release, err := a.Acquire(ctx)
+	assert.Nil(t, err)
+	_, err = b.Acquire(ctx)
+	check.NotEqual(t, nil, err)
+
+	// A waiting test gets the slot as soon as it is released.
+	opts.Timeout = 0
+	c := newCoordinator(t, opts)
+	acquired := make(chan error)
+	go func() {
+		_, err := c.Acquire(ctx)
+		acquired <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	release()
+	check.Nil(t, <-acquired)
+}
+
+func TestLimitsBaseConnSlots(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	c := newCoordinator(t, coordinator.Options{
+		Dir:          t.TempDir(),
+		MaxInstances: 1,
+		MaxBaseConns: 1,
+		Timeout:      50 * time.Millisecond,
+	})
+	release, err := c.AcquireBaseConn(ctx)
+	assert.Nil(t, err)
+	_, err = c.AcquireBaseConn(ctx)
+	check.NotEqual(t, nil, err)
+
+	// Base connection slots are separate from instance slots.
+	_, err = c.Acquire(ctx)
+	check.Nil(t, err)
+
+	release()
+	_, err = c.AcquireBaseConn(ctx)
+	check.Nil(t, err)
+
+	// Without MaxBaseConns, base connections aren't limited.
+	unlimited := newCoordinator(t, coordinator.Options{
+		Dir:          t.TempDir(),
+		MaxInstances: 1,
+		Timeout:      50 * time.Millisecond,
+	})
+	for i := 0; i < 3; i++ {
+		_, err := unlimited.AcquireBaseConn(ctx)
+		check.Nil(t, err)
+	}
+}
+
+func TestRequiresMaxInstances(t *testing.T) {
+	t.Parallel()
+	_, err := coordinator.New(coordinator.Options{Dir: t.TempDir()})
+	check.NotEqual(t, nil, err)
+}
+
+func TestReleasesSlotAfterDatabaseIsDropped(t *testing.T) {
+	t.Parallel()
+	c := newCoordinator(t, coordinator.Options{
+		Dir:          t.TempDir(),
+		MaxInstances: 1,
+		Timeout:      50 * time.Millisecond,
+	})
+	conf := pgtestdb.Config{
+		DriverName:  "pgx",
+		User:        "postgres",
+		Password:    "password",
+		Host:        "localhost",
+		Port:        "5433",
+		Options:     "sslmode=disable",
+		Coordinator: c,
+	}
+	t.Run("holds the slot", func(t *testing.T) {
+		db := pgtestdb.New(t, conf, pgtestdb.NoopMigrator{})
+		assert.Nil(t, db.Ping())
+		_, err := c.Acquire(context.Background())
+		check.NotEqual(t, nil, err)
+	})
+	release, err := c.Acquire(context.Background())
+	assert.Nil(t, err)
+	release()
+}
+
+// A single base connection slot is enough for a test, since it only holds
+// one at a time, and it is released as soon as the test database has been
+// created.
+func TestReleasesBaseConnSlotAfterCreatingDatabase(t *testing.T) {
+	t.Parallel()
+	c := newCoordinator(t, coordinator.Options{
+		Dir:          t.TempDir(),
+		MaxInstances: 2,
+		MaxBaseConns: 1,
+		Timeout:      5 * time.Second,
+	})
+	conf := pgtestdb.Config{
+		DriverName:   "pgx",
+		User:         "postgres",
+		Password:     "password",
+		Host:         "localhost",
+		Port:         "5433",
+		Options:      "sslmode=disable",
+		Coordinator:  c,
+		MaxInstances: 2,
+	}
+	t.Run("creates the database", func(t *testing.T) {
+		db := pgtestdb.New(t, conf, pgtestdb.NoopMigrator{})
+		assert.Nil(t, db.Ping())
+		release, err := c.AcquireBaseConn(context.Background())
+		assert.Nil(t, err)
+		release()
+	})
+	release, err := c.AcquireBaseConn(context.Background())
+	assert.Nil(t, err)
+	release()
+}
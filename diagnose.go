@@ -0,0 +1,305 @@
+package pgtestdb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// maxServerLogBytes is the most that will be read from the end of the
+	// server log when diagnosing a failed test.
+	maxServerLogBytes = 1 << 20
+	// maxServerLogLines is the most lines from the server log that will be
+	// logged when diagnosing a failed test.
+	maxServerLogLines = 200
+)
+
+// testName returns the name of the test, if the TB implementation provides
+// one. `*testing.T`, `*testing.B`, and `*testing.F` all do.
+func testName(t TB) string {
+	if named, ok := t.(interface{ Name() string }); ok {
+		return named.Name()
+	}
+	return ""
+}
+
+// truncateIdentifier truncates a name to the 63 bytes that postgres keeps,
+// without splitting a multi-byte character.
+func truncateIdentifier(name string) string {
+	const maxIdentifierLength = 63
+	if len(name) <= maxIdentifierLength {
+		return name
+	}
+	for i := maxIdentifierLength; i > 0; i-- {
+		if utf8.RuneStart(name[i]) {
+			return name[:i]
+		}
+	}
+	return ""
+}
+
+// withApplicationName adds the application_name parameter to URL-formatted
+// connection options, replacing any that was already there.
+func withApplicationName(options, name string) string {
+	values, err := url.ParseQuery(options)
+	if err != nil {
+		values = url.Values{}
+	}
+	values.Set("application_name", name)
+	return values.Encode()
+}
+
+// backend describes a single connection to the server, from pg_stat_activity.
+type backend struct {
+	PID             int
+	ApplicationName string
+	State           string
+	BackendStart    time.Time
+	XactStart       sql.NullTime
+	WaitEvent       string
+	Query           string
+}
+
+// IdleInTransaction returns true if the connection has begun a transaction
+// but isn't running a query, which usually means a transaction was leaked.
+func (b backend) IdleInTransaction() bool {
+	return strings.HasPrefix(b.State, "idle in transaction")
+}
+
+func (b backend) String() string {
+	var parts []string
+	parts = append(parts, fmt.Sprintf("pid=%d", b.PID))
+	if b.ApplicationName != "" {
+		parts = append(parts, fmt.Sprintf("application_name=%q", b.ApplicationName))
+	}
+	parts = append(parts, fmt.Sprintf("state=%q", b.State))
+	parts = append(parts, fmt.Sprintf("backend_start=%s", b.BackendStart.Format(time.RFC3339)))
+	if b.XactStart.Valid {
+		parts = append(parts, fmt.Sprintf("xact_start=%s", b.XactStart.Time.Format(time.RFC3339)))
+	}
+	if b.WaitEvent != "" {
+		parts = append(parts, fmt.Sprintf("wait_event=%s", b.WaitEvent))
+	}
+	if b.IdleInTransaction() {
+		parts = append(parts, "(idle in transaction)")
+	}
+	parts = append(parts, fmt.Sprintf("last query: %s", strings.Join(strings.Fields(b.Query), " ")))
+	return strings.Join(parts, " ")
+}
+
+// listBackends returns every connection to a database, other than the
+// connection running the query.
+func listBackends(ctx context.Context, db *sql.DB, database string) ([]backend, error) {
+	query := `SELECT pid, application_name, coalesce(state, ''), backend_start, xact_start,
+			coalesce(wait_event_type || ':' || wait_event, ''), coalesce(query, '')
+		FROM pg_stat_activity
+		WHERE datname = $1
+		AND pid <> pg_backend_pid()
+		ORDER BY backend_start, pid`
+	rows, err := db.QueryContext(ctx, query, database)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list connections to %s: %w", database, err)
+	}
+	defer rows.Close()
+	var backends []backend
+	for rows.Next() {
+		var b backend
+		if err := rows.Scan(&b.PID, &b.ApplicationName, &b.State, &b.BackendStart, &b.XactStart, &b.WaitEvent, &b.Query); err != nil {
+			return nil, fmt.Errorf("failed to list connections to %s: %w", database, err)
+		}
+		backends = append(backends, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list connections to %s: %w", database, err)
+	}
+	return backends, nil
+}
+
+// listLocks returns a description of every lock held or awaited by a
+// connection to a database.
+func listLocks(ctx context.Context, db *sql.DB, database string) ([]string, error) {
+	query := `SELECT format('pid=%s %s %s on %s%s', l.pid, CASE WHEN l.granted THEN 'holds' ELSE 'waits for' END,
+			l.mode, l.locktype,
+			CASE
+				WHEN l.relation IS NOT NULL THEN ' ' || l.relation::regclass::text
+				WHEN l.transactionid IS NOT NULL THEN ' ' || l.transactionid::text
+				WHEN l.locktype = 'advisory' THEN ' ' || l.classid::text || ':' || l.objid::text
+				ELSE '' END)
+		FROM pg_locks l
+		JOIN pg_stat_activity a ON a.pid = l.pid
+		WHERE a.datname = $1
+		AND l.pid <> pg_backend_pid()
+		AND NOT (l.locktype = 'virtualxid' AND l.granted)
+		ORDER BY l.pid, l.granted DESC, l.locktype`
+	rows, err := db.QueryContext(ctx, query, database)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list locks in %s: %w", database, err)
+	}
+	defer rows.Close()
+	var locks []string
+	for rows.Next() {
+		var lock string
+		if err := rows.Scan(&lock); err != nil {
+			return nil, fmt.Errorf("failed to list locks in %s: %w", database, err)
+		}
+		locks = append(locks, lock)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list locks in %s: %w", database, err)
+	}
+	return locks, nil
+}
+
+// readServerLog returns the end of the server's log. If `path` is set, it is
+// read from the local file system; otherwise, it is read through the server
+// with pg_read_binary_file(), which requires the logging collector to be
+// enabled and the connecting user to be a superuser or a member of
+// pg_read_server_files.
+func readServerLog(ctx context.Context, db *sql.DB, path string) (string, error) {
+	if path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to open server log %s: %w", path, err)
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			return "", fmt.Errorf("failed to open server log %s: %w", path, err)
+		}
+		offset := info.Size() - maxServerLogBytes
+		if offset < 0 {
+			offset = 0
+		}
+		contents := make([]byte, info.Size()-offset)
+		if _, err := file.ReadAt(contents, offset); err != nil {
+			return "", fmt.Errorf("failed to read server log %s: %w", path, err)
+		}
+		return completeLines(contents, offset > 0), nil
+	}
+
+	var current sql.NullString
+	if err := db.QueryRowContext(ctx, "SELECT pg_current_logfile()").Scan(&current); err != nil {
+		return "", fmt.Errorf("failed to find the server log: %w", err)
+	}
+	if !current.Valid {
+		return "", errors.New("the server is not writing its log to a file (logging_collector is off), set ServerLogPath to read it from a local path instead")
+	}
+	// pg_read_file() fails if the offset falls in the middle of a multi-byte
+	// character, so the log is read as bytes instead.
+	var contents []byte
+	var truncated bool
+	query := `SELECT pg_read_binary_file($1, greatest(0, size - $2), $2), size > $2 FROM pg_stat_file($1)`
+	if err := db.QueryRowContext(ctx, query, current.String, maxServerLogBytes).Scan(&contents, &truncated); err != nil {
+		return "", fmt.Errorf("failed to read server log %s: %w", current.String, err)
+	}
+	return completeLines(contents, truncated), nil
+}
+
+// completeLines returns the contents of the end of a log file. If the start of
+// the file was left out, the first line is dropped, since it is probably only
+// part of a line and may start in the middle of a multi-byte character.
+func completeLines(contents []byte, truncated bool) string {
+	if truncated {
+		if i := bytes.IndexByte(contents, '\n'); i >= 0 {
+			contents = contents[i+1:]
+		} else {
+			contents = nil
+		}
+	}
+	return string(contents)
+}
+
+// matchServerLog returns the lines of the log that contain any of the
+// needles, along with any continuation lines (DETAIL, STATEMENT, etc.) that
+// follow them. At most `limit` lines are returned, preferring the most recent.
+func matchServerLog(contents string, needles []string, limit int) []string {
+	var matched []string
+	including := false
+	scanner := bufio.NewScanner(strings.NewReader(contents))
+	scanner.Buffer(make([]byte, 0, 64*1024), maxServerLogBytes)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "\t") {
+			if including {
+				matched = append(matched, line)
+			}
+			continue
+		}
+		including = false
+		for _, needle := range needles {
+			if needle != "" && strings.Contains(line, needle) {
+				including = true
+				matched = append(matched, line)
+				break
+			}
+		}
+	}
+	if len(matched) > limit {
+		matched = matched[len(matched)-limit:]
+	}
+	return matched
+}
+
+// logServerState logs the connections to an instance, the locks that they
+// hold, and the lines of the server log that mention them, to help explain
+// why a test failed. Errors are logged rather than failing the test, since the
+// test has already failed.
+func logServerState(t TB, conf Config, instance Config, applicationName string) {
+	ctx := context.Background()
+	releaseBaseConn, err := conf.acquireBaseConn(ctx)
+	if err != nil {
+		t.Logf("pgtestdb: could not diagnose the failure: %s", err)
+		return
+	}
+	defer releaseBaseConn()
+	db, err := conf.Connect()
+	if err != nil {
+		t.Logf("pgtestdb: could not connect to the server to diagnose the failure: %s", err)
+		return
+	}
+	defer db.Close()
+
+	backends, err := listBackends(ctx, db, instance.Database)
+	if err != nil {
+		t.Logf("pgtestdb: %s", err)
+	}
+	t.Logf("pgtestdb: %d connection(s) to %s:", len(backends), instance.Database)
+	for _, b := range backends {
+		t.Logf("  %s", b)
+	}
+
+	locks, err := listLocks(ctx, db, instance.Database)
+	if err != nil {
+		t.Logf("pgtestdb: %s", err)
+	}
+	if len(locks) > 0 {
+		t.Logf("pgtestdb: locks held or awaited by connections to %s:", instance.Database)
+		for _, lock := range locks {
+			t.Logf("  %s", lock)
+		}
+	}
+
+	contents, err := readServerLog(ctx, db, conf.ServerLogPath)
+	if err != nil {
+		t.Logf("pgtestdb: could not read the server log: %s", err)
+		return
+	}
+	needles := []string{instance.Database, applicationName}
+	for _, b := range backends {
+		needles = append(needles, fmt.Sprintf("[%d]", b.PID))
+	}
+	lines := matchServerLog(contents, needles, maxServerLogLines)
+	t.Logf("pgtestdb: %d line(s) from the server log mention %s:", len(lines), instance.Database)
+	for _, line := range lines {
+		t.Logf("  %s", line)
+	}
+}
@@ -0,0 +1,156 @@
+package pgtestdb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/peterldowns/pgtestdb/migrators/common"
+)
+
+// templateMetadata is stored as the comment on each template database, so that
+// other programs can find out how the template was created.
+type templateMetadata struct {
+	// Manifest records every input to the hash that identifies the template.
+	Manifest common.Manifest `json:"manifest"`
+	// Settings records the settings of the server when the template was
+	// created, if [Config.IncludeServerSettings] was set.
+	Settings *ServerSettings `json:"settings,omitempty"`
+	// RunID identifies the test run that created the template, see
+	// [RunIDEnvVar].
+	RunID string `json:"run_id,omitempty"`
+}
+
+// migratorHashField is the field of the template hash that holds the hash of
+// the migrator.
+const migratorHashField = "MigratorHash"
+
+// writeTemplateMetadata stores the metadata for a template as the comment on
+// the template database.
+func writeTemplateMetadata(
+	ctx context.Context,
+	conn *sql.Conn,
+	migrator Migrator,
+	state templateState,
+) error {
+	manifest, err := templateManifest(migrator, state)
+	if err != nil {
+		return err
+	}
+	metadata := templateMetadata{Manifest: manifest, Settings: state.settings, RunID: runID()}
+	encoded, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata for template %s: %w", state.conf.Database, err)
+	}
+	query := fmt.Sprintf(`COMMENT ON DATABASE "%s" IS %s`, state.conf.Database, quoteLiteral(string(encoded)))
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to store metadata for template %s: %w", state.conf.Database, err)
+	}
+	return nil
+}
+
+// templateManifest returns the manifest of the template's hash. If the
+// migrator is a [ManifestMigrator], its manifest is nested under the
+// migrator's hash. It is only calculated when a template is created, rather
+// than along with the hash, since it reads the migrator's inputs again.
+func templateManifest(migrator Migrator, state templateState) (common.Manifest, error) {
+	described, ok := migrator.(ManifestMigrator)
+	if !ok {
+		return state.manifest, nil
+	}
+	children, err := described.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate manifest for template %s: %w", state.conf.Database, err)
+	}
+	manifest := append(common.Manifest{}, state.manifest...)
+	for i, entry := range manifest {
+		if entry.Kind == "field" && entry.Name == migratorHashField {
+			manifest[i].Children = children
+		}
+	}
+	return manifest, nil
+}
+
+// errNoMetadata is returned by readTemplateMetadata for templates that were
+// created without recording any metadata.
+var errNoMetadata = errors.New("it may have been created by an older version of pgtestdb")
+
+// readTemplateMetadata loads the metadata that was stored when a template was
+// created.
+func readTemplateMetadata(
+	ctx context.Context,
+	db queryer,
+	templateName string,
+) (*templateMetadata, error) {
+	var comment sql.NullString
+	query := "SELECT shobj_description(oid, 'pg_database') FROM pg_database WHERE datname = $1"
+	if err := db.QueryRowContext(ctx, query, templateName).Scan(&comment); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("template %s does not exist", templateName)
+		}
+		return nil, fmt.Errorf("failed to read metadata for template %s: %w", templateName, err)
+	}
+	if !comment.Valid {
+		return nil, fmt.Errorf("template %s has no metadata, %w", templateName, errNoMetadata)
+	}
+	var metadata templateMetadata
+	if err := json.Unmarshal([]byte(comment.String), &metadata); err != nil {
+		return nil, fmt.Errorf("failed to decode metadata for template %s: %w", templateName, err)
+	}
+	return &metadata, nil
+}
+
+// TemplateManifest connects to the server described by `conf` and returns the
+// manifest of the inputs that were hashed to identify a template, as recorded
+// when the template was created. `hash` may be the hash of the template or the
+// full name of the template database ("testdb_tpl_<hash>").
+func TemplateManifest(ctx context.Context, conf Config, hash string) (common.Manifest, error) {
+	db, err := conf.Connect()
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to database: %w", err)
+	}
+	defer db.Close()
+	metadata, err := readTemplateMetadata(ctx, db, templateName(hash))
+	if err != nil {
+		return nil, err
+	}
+	return metadata.Manifest, nil
+}
+
+// DiffTemplates explains why two templates have different hashes by comparing
+// the manifests that were recorded when they were created, and returns a line
+// for every input that was added, removed, or changed. `before` and `after`
+// may be hashes or full template database names.
+//
+// Example output:
+//
+//	changed: MigratorHash/dirs[0]/migrations/0002_cats.sql
+//	added:   MigratorHash/dirs[0]/migrations/0003_dogs.sql
+func DiffTemplates(ctx context.Context, conf Config, before, after string) ([]string, error) {
+	beforeManifest, err := TemplateManifest(ctx, conf, before)
+	if err != nil {
+		return nil, err
+	}
+	afterManifest, err := TemplateManifest(ctx, conf, after)
+	if err != nil {
+		return nil, err
+	}
+	return beforeManifest.Diff(afterManifest), nil
+}
+
+// templateName returns the name of the template database for a given hash.
+func templateName(hash string) string {
+	if strings.HasPrefix(hash, templatePrefix) {
+		return hash
+	}
+	return templatePrefix + hash
+}
+
+// quoteLiteral quotes a string so that it can be safely used as a literal in
+// a query that does not support placeholders, like COMMENT ON.
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
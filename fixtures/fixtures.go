@@ -0,0 +1,587 @@
+// fixtures loads declarative seed data from YAML, JSON, and CSV files into a
+// database, either once per template with [NewMigrator] or once per test with
+// [Load].
+package fixtures
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jackc/pgx/v5/stdlib"
+	"gopkg.in/yaml.v3"
+
+	"github.com/peterldowns/pgtestdb"
+	"github.com/peterldowns/pgtestdb/migrators/common"
+)
+
+// RefKey is the key that gives a row in a YAML or JSON fixture a symbolic name,
+// so that rows loaded after it can refer to it with `{ref: name}` or
+// `{ref: name.column}`.
+const RefKey = "_ref"
+
+// Load inserts the rows from each of the fixture files into the database, and
+// fails the test with `t.Fatalf()` if there is an error. Use it to load
+// fixtures that only a single test needs; to load fixtures that many tests
+// share, use [NewMigrator] to bake them into the template instead.
+//
+// If `fsys` is nil, the paths are read from the real file system.
+func Load(t pgtestdb.TB, db *sql.DB, fsys fs.FS, paths ...string) {
+	t.Helper()
+	if err := Insert(context.Background(), db, fsys, paths...); err != nil {
+		t.Fatalf("failed to load fixtures: %s", err)
+		return // unreachable
+	}
+}
+
+// Insert inserts the rows from each of the fixture files into the database,
+// in order, in a single transaction. If `fsys` is nil, the paths are read from
+// the real file system. The format of each file is determined by its
+// extension:
+//
+//   - ".yaml", ".yml", and ".json" files contain a mapping of table names to
+//     lists of rows. Tables are loaded in the order they appear in the file.
+//   - ".csv" files contain the rows of a single table, named after the file
+//     ("users.csv" or "public.users.csv"), with a header row naming the
+//     columns. They are loaded with COPY.
+//
+// Afterwards, every sequence owned by a column of a table that was loaded is
+// advanced past the largest value in that column, so that rows inserted later
+// by the test don't collide with the fixtures.
+func Insert(ctx context.Context, db *sql.DB, fsys fs.FS, paths ...string) (final error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close()
+	// The transaction is managed by hand, rather than with conn.BeginTx, so
+	// that the underlying driver connection is available for COPY.
+	if _, err := conn.ExecContext(ctx, "BEGIN"); err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if final != nil {
+			_, _ = conn.ExecContext(ctx, "ROLLBACK")
+		}
+	}()
+
+	l := &loader{conn: conn, refs: map[string]record{}}
+	for _, path := range paths {
+		contents, err := readFile(fsys, path)
+		if err != nil {
+			return err
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		switch ext {
+		case ".yaml", ".yml", ".json":
+			tables, err := parseDocument(contents)
+			if err != nil {
+				return fmt.Errorf("failed to parse %s: %w", path, err)
+			}
+			for _, t := range tables {
+				if err := l.insert(ctx, t); err != nil {
+					return fmt.Errorf("failed to load %s: %w", path, err)
+				}
+			}
+		case ".csv":
+			name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+			if err := l.copyCSV(ctx, name, contents); err != nil {
+				return fmt.Errorf("failed to load %s: %w", path, err)
+			}
+		default:
+			return fmt.Errorf("failed to load %s: unsupported fixture file extension %q", path, ext)
+		}
+	}
+	if err := l.resetSequences(ctx); err != nil {
+		return err
+	}
+	if _, err := conn.ExecContext(ctx, "COMMIT"); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// NewMigrator returns a [Migrator], which is a pgtestdb.Migrator that runs
+// another migrator and then loads fixtures into the template, so that every
+// test database starts out with the same data. The hash of the template
+// includes the contents of each fixture file, so changing a fixture results in
+// a new template.
+//
+// If `fsys` is nil, the paths are read from the real file system.
+func NewMigrator(migrator pgtestdb.Migrator, fsys fs.FS, paths ...string) *Migrator {
+	return &Migrator{migrator: migrator, fsys: fsys, paths: paths}
+}
+
+// Migrator is a pgtestdb.Migrator that runs another migrator and then loads
+// fixtures into the template.
+type Migrator struct {
+	migrator pgtestdb.Migrator
+	fsys     fs.FS
+	paths    []string
+}
+
+func (m *Migrator) Hash() (string, error) {
+	hash, err := m.recursiveHash(false)
+	if err != nil {
+		return "", err
+	}
+	return hash.String(), nil
+}
+
+// Manifest returns a record of the inputs to Hash, including the manifest of
+// the wrapped migrator if it is a [pgtestdb.ManifestMigrator].
+func (m *Migrator) Manifest() (common.Manifest, error) {
+	hash, err := m.recursiveHash(true)
+	if err != nil {
+		return nil, err
+	}
+	return hash.Manifest(), nil
+}
+
+func (m *Migrator) recursiveHash(describe bool) (common.RecursiveHash, error) {
+	mhash, err := m.migrator.Hash()
+	if err != nil {
+		return common.RecursiveHash{}, err
+	}
+	var manifest common.Manifest
+	if described, ok := m.migrator.(pgtestdb.ManifestMigrator); ok && describe {
+		manifest, err = described.Manifest()
+		if err != nil {
+			return common.RecursiveHash{}, err
+		}
+	}
+	hash := common.NewRecursiveHashWithManifest()
+	hash.AddNestedField("MigratorHash", mhash, manifest)
+	// The paths are included because the name of a CSV file determines the
+	// table that it is loaded into.
+	hash.AddField("Paths", strings.Join(m.paths, ","))
+	err = hash.AddFiles(m.fsys, m.paths...)
+	return hash, err
+}
+
+func (m *Migrator) Migrate(
+	ctx context.Context,
+	db *sql.DB,
+	conf pgtestdb.Config,
+) error {
+	if err := m.migrator.Migrate(ctx, db, conf); err != nil {
+		return err
+	}
+	return Insert(ctx, db, m.fsys, m.paths...)
+}
+
+// table contains the rows that a fixture file inserts into a single table.
+type table struct {
+	name string
+	rows []row
+}
+
+// row contains the columns and values of a single row, in the order that
+// they appear in the fixture file, and its symbolic name, if it has one.
+type row struct {
+	ref     string
+	columns []string
+	values  []any
+}
+
+// reference is a value that refers to a column of a row that was loaded
+// earlier. If column is empty, it refers to the row's primary key.
+type reference struct {
+	name   string
+	column string
+}
+
+// record is a row that was given a symbolic name, as it was returned by the
+// database after being inserted.
+type record struct {
+	table  string
+	values map[string]any
+}
+
+// parseDocument parses a YAML or JSON fixture file. The file is decoded into a
+// yaml.Node, rather than a map, so that the order of the tables and columns is
+// preserved.
+func parseDocument(contents []byte) ([]table, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(contents, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: expected a mapping of table names to lists of rows", root.Line)
+	}
+	var tables []table
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		t := table{name: root.Content[i].Value}
+		list := root.Content[i+1]
+		if list.Kind != yaml.SequenceNode {
+			return nil, fmt.Errorf("line %d: expected a list of rows for table %s", list.Line, t.name)
+		}
+		for _, item := range list.Content {
+			if item.Kind != yaml.MappingNode {
+				return nil, fmt.Errorf("line %d: expected a mapping of column names to values", item.Line)
+			}
+			var r row
+			for j := 0; j+1 < len(item.Content); j += 2 {
+				key, node := item.Content[j].Value, item.Content[j+1]
+				if key == RefKey {
+					r.ref = node.Value
+					continue
+				}
+				value, err := decodeValue(node)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: column %s: %w", node.Line, key, err)
+				}
+				r.columns = append(r.columns, key)
+				r.values = append(r.values, value)
+			}
+			t.rows = append(t.rows, r)
+		}
+		tables = append(tables, t)
+	}
+	return tables, nil
+}
+
+// decodeValue decodes the value of a single column. `{ref: name}` and
+// `{ref: name.column}` are decoded as references, and any other mappings or
+// lists are encoded as JSON so that they can be inserted into json and jsonb
+// columns.
+func decodeValue(node *yaml.Node) (any, error) {
+	if node.Kind == yaml.MappingNode && len(node.Content) == 2 && node.Content[0].Value == "ref" {
+		name, column, _ := strings.Cut(node.Content[1].Value, ".")
+		return reference{name: name, column: column}, nil
+	}
+	var value any
+	if err := node.Decode(&value); err != nil {
+		return nil, err
+	}
+	switch value.(type) {
+	case map[string]any, []any:
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		return string(encoded), nil
+	}
+	return value, nil
+}
+
+// loader inserts fixtures over a single connection, keeping track of the
+// named rows and the tables that have been loaded so far.
+type loader struct {
+	conn   *sql.Conn
+	refs   map[string]record
+	tables []string
+}
+
+func (l *loader) insert(ctx context.Context, t table) error {
+	for i, r := range t.rows {
+		values := make([]any, len(r.values))
+		for j, value := range r.values {
+			ref, ok := value.(reference)
+			if !ok {
+				values[j] = value
+				continue
+			}
+			resolved, err := l.resolve(ctx, ref)
+			if err != nil {
+				return fmt.Errorf("row %d of %s: column %s: %w", i, t.name, r.columns[j], err)
+			}
+			values[j] = resolved
+		}
+
+		var query string
+		if len(r.columns) == 0 {
+			query = fmt.Sprintf("INSERT INTO %s DEFAULT VALUES", quoteTable(t.name))
+		} else {
+			columns := make([]string, len(r.columns))
+			placeholders := make([]string, len(r.columns))
+			for j, column := range r.columns {
+				columns[j] = quoteIdent(column)
+				placeholders[j] = fmt.Sprintf("$%d", j+1)
+			}
+			// Fixtures usually set the values of identity columns explicitly,
+			// so that other fixtures and tests can refer to them.
+			query = fmt.Sprintf(
+				"INSERT INTO %s (%s) OVERRIDING SYSTEM VALUE VALUES (%s)",
+				quoteTable(t.name), strings.Join(columns, ", "), strings.Join(placeholders, ", "),
+			)
+		}
+
+		if r.ref == "" {
+			if _, err := l.conn.ExecContext(ctx, query, values...); err != nil {
+				return fmt.Errorf("failed to insert row %d into %s: %w", i, t.name, err)
+			}
+			continue
+		}
+		if _, exists := l.refs[r.ref]; exists {
+			return fmt.Errorf("row %d of %s: duplicate %s %q", i, t.name, RefKey, r.ref)
+		}
+		inserted, err := l.insertReturning(ctx, query, values)
+		if err != nil {
+			return fmt.Errorf("failed to insert row %d into %s: %w", i, t.name, err)
+		}
+		l.refs[r.ref] = record{table: t.name, values: inserted}
+	}
+	l.loaded(t.name)
+	return nil
+}
+
+// insertReturning runs an INSERT statement and returns every column of the
+// inserted row, including any defaults that were filled in by the database.
+func (l *loader) insertReturning(ctx context.Context, query string, values []any) (map[string]any, error) {
+	rows, err := l.conn.QueryContext(ctx, query+" RETURNING *", values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	inserted := make(map[string]any, len(columns))
+	for rows.Next() {
+		dest := make([]any, len(columns))
+		for i := range dest {
+			dest[i] = new(any)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		for i, column := range columns {
+			inserted[column] = *(dest[i].(*any))
+		}
+	}
+	return inserted, rows.Err()
+}
+
+// resolve returns the value of the column that a reference refers to.
+func (l *loader) resolve(ctx context.Context, ref reference) (any, error) {
+	target, ok := l.refs[ref.name]
+	if !ok {
+		return nil, fmt.Errorf("unknown reference %q, rows can only refer to rows that were loaded before them", ref.name)
+	}
+	column := ref.column
+	if column == "" {
+		var err error
+		column, err = l.primaryKey(ctx, target.table)
+		if err != nil {
+			return nil, err
+		}
+	}
+	value, ok := target.values[column]
+	if !ok {
+		return nil, fmt.Errorf("reference %q: table %s has no column %s", ref.name, target.table, column)
+	}
+	return value, nil
+}
+
+// primaryKey returns the name of the single column that makes up the primary
+// key of a table.
+func (l *loader) primaryKey(ctx context.Context, tableName string) (string, error) {
+	query := `SELECT a.attname
+		FROM pg_index i
+		JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+		WHERE i.indrelid = $1::text::regclass
+		AND i.indisprimary`
+	rows, err := l.conn.QueryContext(ctx, query, quoteTable(tableName))
+	if err != nil {
+		return "", fmt.Errorf("failed to find primary key of %s: %w", tableName, err)
+	}
+	defer rows.Close()
+	var columns []string
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return "", fmt.Errorf("failed to find primary key of %s: %w", tableName, err)
+		}
+		columns = append(columns, column)
+	}
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("failed to find primary key of %s: %w", tableName, err)
+	}
+	if len(columns) != 1 {
+		return "", fmt.Errorf("table %s does not have a single-column primary key, refer to a specific column with {ref: name.column}", tableName)
+	}
+	return columns[0], nil
+}
+
+// errNotPgx is returned from inside of conn.Raw when the connection was not
+// opened with the pgx driver.
+var errNotPgx = errors.New("not a pgx connection")
+
+// copyCSV loads the contents of a CSV file into a table with COPY. Empty,
+// unquoted, values are loaded as NULL, and empty quoted values ("") are loaded
+// as empty strings, whichever driver the connection uses.
+func (l *loader) copyCSV(ctx context.Context, tableName string, contents []byte) error {
+	reader := csv.NewReader(bytes.NewReader(contents))
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("failed to read header: %w", err)
+	}
+	columns := make([]string, len(header))
+	for i, column := range header {
+		columns[i] = quoteIdent(strings.TrimSpace(column))
+	}
+	query := fmt.Sprintf(
+		"COPY %s (%s) FROM STDIN WITH (FORMAT csv, HEADER true)",
+		quoteTable(tableName), strings.Join(columns, ", "),
+	)
+	err = l.conn.Raw(func(driverConn any) error {
+		// Connections returned by pgtestdb.New with CaptureQueries enabled
+		// wrap the driver's connection.
+		if wrapper, ok := driverConn.(interface{ Unwrap() driver.Conn }); ok {
+			driverConn = wrapper.Unwrap()
+		}
+		conn, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return errNotPgx
+		}
+		_, err := conn.Conn().PgConn().CopyFrom(ctx, bytes.NewReader(contents), query)
+		return err
+	})
+	if errors.Is(err, errNotPgx) {
+		err = l.copyStatement(ctx, tableName, columns, reader, contents)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to copy into %s: %w", tableName, err)
+	}
+	l.loaded(tableName)
+	return nil
+}
+
+// copyStatement loads CSV records into a table using the prepared-statement
+// form of COPY supported by lib/pq, for connections that weren't opened with
+// the pgx driver. encoding/csv doesn't say whether a field was quoted, so the
+// start of each empty field is looked up in `contents` to tell NULL apart from
+// an empty string the same way that Postgres does.
+func (l *loader) copyStatement(
+	ctx context.Context,
+	tableName string,
+	columns []string,
+	reader *csv.Reader,
+	contents []byte,
+) error {
+	lines := bytes.Split(contents, []byte("\n"))
+	query := fmt.Sprintf("COPY %s (%s) FROM STDIN", quoteTable(tableName), strings.Join(columns, ", "))
+	stmt, err := l.conn.PrepareContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for {
+		fields, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		values := make([]any, len(fields))
+		for i, field := range fields {
+			if field != "" || quoted(reader, lines, i) {
+				values[i] = field
+			}
+		}
+		if _, err := stmt.ExecContext(ctx, values...); err != nil {
+			return err
+		}
+	}
+	_, err = stmt.ExecContext(ctx)
+	return err
+}
+
+// quoted returns true if the i'th field of the record that was just read from
+// `reader` starts with a quote in `lines`, the lines of the CSV file.
+func quoted(reader *csv.Reader, lines [][]byte, i int) bool {
+	line, column := reader.FieldPos(i)
+	if line < 1 || line > len(lines) || column < 1 || column > len(lines[line-1]) {
+		return false
+	}
+	return lines[line-1][column-1] == '"'
+}
+
+// loaded records that rows were loaded into a table, so that its sequences
+// can be reset afterwards.
+func (l *loader) loaded(tableName string) {
+	for _, existing := range l.tables {
+		if existing == tableName {
+			return
+		}
+	}
+	l.tables = append(l.tables, tableName)
+}
+
+// resetSequences advances every sequence owned by a column of a loaded table
+// past the largest value in that column.
+func (l *loader) resetSequences(ctx context.Context) error {
+	for _, tableName := range l.tables {
+		query := `SELECT a.attname, pg_get_serial_sequence($1::text, a.attname)
+			FROM pg_attribute a
+			WHERE a.attrelid = $1::text::regclass
+			AND a.attnum > 0
+			AND NOT a.attisdropped
+			AND pg_get_serial_sequence($1::text, a.attname) IS NOT NULL`
+		rows, err := l.conn.QueryContext(ctx, query, quoteTable(tableName))
+		if err != nil {
+			return fmt.Errorf("failed to find sequences of %s: %w", tableName, err)
+		}
+		sequences := map[string]string{}
+		for rows.Next() {
+			var column, sequence string
+			if err := rows.Scan(&column, &sequence); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to find sequences of %s: %w", tableName, err)
+			}
+			sequences[column] = sequence
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to find sequences of %s: %w", tableName, err)
+		}
+		for column, sequence := range sequences {
+			query := fmt.Sprintf(
+				"SELECT setval($1, coalesce(max(%s), 0) + 1, false) FROM %s",
+				quoteIdent(column), quoteTable(tableName),
+			)
+			if _, err := l.conn.ExecContext(ctx, query, sequence); err != nil {
+				return fmt.Errorf("failed to reset sequence %s: %w", sequence, err)
+			}
+		}
+	}
+	return nil
+}
+
+func readFile(fsys fs.FS, path string) ([]byte, error) {
+	if fsys == nil {
+		return os.ReadFile(path)
+	}
+	return fs.ReadFile(fsys, path)
+}
+
+// quoteTable quotes a table name, which may be qualified with the name of its
+// schema ("public.users").
+func quoteTable(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = quoteIdent(part)
+	}
+	return strings.Join(parts, ".")
+}
+
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
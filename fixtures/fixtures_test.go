@@ -0,0 +1,179 @@
+package fixtures_test
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+	"testing/fstest"
+
+	_ "github.com/jackc/pgx/v5/stdlib" // "pgx" driver
+	_ "github.com/lib/pq"              // "postgres" driver
+	"github.com/peterldowns/testy/assert"
+	"github.com/peterldowns/testy/check"
+
+	"github.com/peterldowns/pgtestdb"
+	"github.com/peterldowns/pgtestdb/fixtures"
+	"github.com/peterldowns/pgtestdb/migrators/common"
+)
+
+func TestLoadResolvesReferences(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	db := pgtestdb.New(t, conf(), schemaMigrator{})
+	fixtures.Load(t, db, os.DirFS("testdata"), "users.yaml", "posts.json")
+
+	var aliceID int64
+	err := db.QueryRowContext(ctx, "SELECT id FROM users WHERE email = 'alice@example.com'").Scan(&aliceID)
+	assert.Nil(t, err)
+
+	var author string
+	err = db.QueryRowContext(ctx, `
+		SELECT users.email FROM posts JOIN users ON users.id = posts.author_id
+		WHERE posts.title = 'Hello from Alice'
+	`).Scan(&author)
+	assert.Nil(t, err)
+	check.Equal(t, "alice@example.com", author)
+
+	err = db.QueryRowContext(ctx, `
+		SELECT users.email FROM posts JOIN users ON users.id = posts.author_id
+		WHERE posts.title = 'Hello from Bob'
+	`).Scan(&author)
+	assert.Nil(t, err)
+	check.Equal(t, "bob@example.com", author)
+
+	var theme string
+	err = db.QueryRowContext(ctx, "SELECT settings->>'theme' FROM users WHERE id = $1", aliceID).Scan(&theme)
+	assert.Nil(t, err)
+	check.Equal(t, "dark", theme)
+}
+
+func TestLoadResetsSequences(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	db := pgtestdb.New(t, conf(), schemaMigrator{})
+	fixtures.Load(t, db, os.DirFS("testdata"), "users.yaml")
+
+	// bob was inserted with an explicit id of 10, so the next generated id
+	// must be larger.
+	var id int64
+	err := db.QueryRowContext(ctx, "INSERT INTO users (email) VALUES ('carol@example.com') RETURNING id").Scan(&id)
+	assert.Nil(t, err)
+	check.Equal(t, int64(11), id)
+}
+
+func TestLoadCSV(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	db := pgtestdb.New(t, conf(), schemaMigrator{})
+	fixtures.Load(t, db, os.DirFS("testdata"), "tags.csv")
+
+	var count int
+	err := db.QueryRowContext(ctx, "SELECT count(*) FROM tags").Scan(&count)
+	assert.Nil(t, err)
+	check.Equal(t, 2, count)
+
+	var description sql.NullString
+	err = db.QueryRowContext(ctx, "SELECT description FROM tags WHERE name = 'postgres'").Scan(&description)
+	assert.Nil(t, err)
+	check.False(t, description.Valid)
+}
+
+func TestLoadCSVNulls(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{"tags.csv": {Data: []byte("name,description\nnull,\nempty,\"\"\n")}}
+	// pgx loads CSV files with CopyFrom, and lib/pq with a prepared COPY
+	// statement, so check that both load NULLs and empty strings the same way.
+	for _, driverName := range []string{"pgx", "postgres"} {
+		driverName := driverName
+		t.Run(driverName, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			dbconf := conf()
+			dbconf.DriverName = driverName
+			db := pgtestdb.New(t, dbconf, schemaMigrator{})
+			fixtures.Load(t, db, fsys, "tags.csv")
+
+			var description sql.NullString
+			err := db.QueryRowContext(ctx, "SELECT description FROM tags WHERE name = 'null'").Scan(&description)
+			assert.Nil(t, err)
+			check.False(t, description.Valid)
+
+			err = db.QueryRowContext(ctx, "SELECT description FROM tags WHERE name = 'empty'").Scan(&description)
+			assert.Nil(t, err)
+			check.True(t, description.Valid)
+			check.Equal(t, "", description.String)
+		})
+	}
+}
+
+func TestLoadFailsOnUnknownReference(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	db := pgtestdb.New(t, conf(), schemaMigrator{})
+	// posts.json refers to users that haven't been loaded.
+	err := fixtures.Insert(ctx, db, os.DirFS("testdata"), "posts.json")
+	assert.Error(t, err)
+
+	// Nothing is left behind from a failed load.
+	var count int
+	err = db.QueryRowContext(ctx, "SELECT count(*) FROM posts").Scan(&count)
+	assert.Nil(t, err)
+	check.Equal(t, 0, count)
+}
+
+func TestMigratorBakesFixturesIntoTemplate(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	m := fixtures.NewMigrator(schemaMigrator{}, os.DirFS("testdata"), "users.yaml", "posts.json", "tags.csv")
+	db := pgtestdb.New(t, conf(), m)
+
+	var count int
+	err := db.QueryRowContext(ctx, "SELECT (SELECT count(*) FROM users) + (SELECT count(*) FROM posts) + (SELECT count(*) FROM tags)").Scan(&count)
+	assert.Nil(t, err)
+	check.Equal(t, 6, count)
+}
+
+func TestMigratorHashDependsOnFixtures(t *testing.T) {
+	t.Parallel()
+	before := fstest.MapFS{"users.yaml": {Data: []byte("users:\n  - email: alice@example.com\n")}}
+	after := fstest.MapFS{"users.yaml": {Data: []byte("users:\n  - email: bob@example.com\n")}}
+
+	beforeHash, err := fixtures.NewMigrator(schemaMigrator{}, before, "users.yaml").Hash()
+	assert.Nil(t, err)
+	afterHash, err := fixtures.NewMigrator(schemaMigrator{}, after, "users.yaml").Hash()
+	assert.Nil(t, err)
+	check.NotEqual(t, beforeHash, afterHash)
+
+	again, err := fixtures.NewMigrator(schemaMigrator{}, before, "users.yaml").Hash()
+	assert.Nil(t, err)
+	check.Equal(t, beforeHash, again)
+}
+
+func conf() pgtestdb.Config {
+	return pgtestdb.Config{
+		DriverName: "pgx",
+		User:       "postgres",
+		Password:   "password",
+		Host:       "localhost",
+		Port:       "5433",
+		Options:    "sslmode=disable",
+	}
+}
+
+// schemaMigrator creates the tables that the fixtures in testdata are loaded
+// into.
+type schemaMigrator struct{}
+
+func (schemaMigrator) Hash() (string, error) {
+	return common.HashFile("testdata/schema.sql")
+}
+
+func (schemaMigrator) Migrate(ctx context.Context, db *sql.DB, _ pgtestdb.Config) error {
+	schema, err := os.ReadFile("testdata/schema.sql")
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, string(schema))
+	return err
+}
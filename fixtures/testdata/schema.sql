@@ -0,0 +1,16 @@
+CREATE TABLE users (
+	id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+	email TEXT NOT NULL UNIQUE,
+	settings JSONB
+);
+
+CREATE TABLE posts (
+	id SERIAL PRIMARY KEY,
+	author_id BIGINT NOT NULL REFERENCES users (id),
+	title TEXT NOT NULL
+);
+
+CREATE TABLE tags (
+	name TEXT PRIMARY KEY,
+	description TEXT
+);
@@ -0,0 +1,137 @@
+package pgtestdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+
+	"github.com/peterldowns/pgtestdb/internal/catalog"
+	"github.com/peterldowns/pgtestdb/internal/once"
+)
+
+// UpdateEnvVar is the name of an environment variable that, if set to "1" or
+// "true", causes [AssertGolden] and [AssertSchemaGolden] to rewrite golden
+// files instead of comparing against them. Passing `-update` to `go test` has
+// the same effect, as long as the test binary defines an `-update` flag.
+const UpdateEnvVar = "PGTESTDB_UPDATE"
+
+// schemas caches the description of each template on each server, so that
+// each template is only described at most once per program.
+var schemas once.Map[string, string] = once.NewMap[string, string]() //nolint:gochecknoglobals
+
+// DescribeSchema returns a deterministic, normalized, description of the
+// schema of a database: its schemas, tables, columns, constraints, indexes,
+// sequences, views, types, functions, triggers, grants, row level security
+// policies, and extensions. Each object is described on its own line, and the lines are
+// sorted, so two databases with the same schema always have the same
+// description.
+func DescribeSchema(ctx context.Context, db *sql.DB) (string, error) {
+	return catalog.Describe(ctx, db, catalog.Options{})
+}
+
+// AssertSchemaGolden compares the schema of the template that `migrator`
+// produces to the contents of the golden file at `path`, and fails the test if
+// they are different. The golden file contains the output of [DescribeSchema]
+// followed by a newline. The template is described at most once per program, no
+// matter how many tests call AssertSchemaGolden. If the `-update` flag or
+// [UpdateEnvVar] is set, the golden file is rewritten instead.
+//
+// If [Config.Shards] is set, the template is built on the shard chosen by the
+// [Config.ShardStrategy]. [Config.IsolateSchemas] is not supported.
+func AssertSchemaGolden(t TB, conf Config, migrator Migrator, path string) {
+	t.Helper()
+	ctx := context.Background()
+	conf, err := conf.chooseShard(ctx, t)
+	if err != nil {
+		t.Fatalf("%s", err)
+		return // unreachable
+	}
+	releaseBaseConn, err := conf.acquireBaseConn(ctx)
+	if err != nil {
+		t.Fatalf("%s", err)
+		return // unreachable
+	}
+	defer releaseBaseConn()
+	baseDB, err := conf.Connect()
+	if err != nil {
+		t.Fatalf("could not connect to database: %s", err)
+		return // unreachable
+	}
+	defer baseDB.Close()
+
+	template, err := prepareTemplate(ctx, baseDB, conf, migrator)
+	if err != nil {
+		t.Fatalf("%s", err)
+		return // unreachable
+	}
+	desc, err := schemas.Set(conf.serverKey()+"/"+template.hash, func() (*string, error) {
+		desc, err := describeTemplate(ctx, baseDB, *template, catalog.Options{})
+		if err != nil {
+			return nil, err
+		}
+		return &desc, nil
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+		return // unreachable
+	}
+	AssertGolden(t, path, *desc+"\n")
+}
+
+// AssertGolden compares `got` to the contents of the golden file at `path`,
+// and fails the test with a line-by-line diff if they are different. If the
+// `-update` flag or [UpdateEnvVar] is set, the golden file is rewritten
+// instead. Use it with [DescribeSchema] to check the schema of a test
+// database after your test has modified it.
+func AssertGolden(t TB, path string, got string) {
+	t.Helper()
+	if updateGolden() {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("failed to create directory for golden file %s: %s", path, err)
+			return // unreachable
+		}
+		if err := os.WriteFile(path, []byte(got), 0o644); err != nil { //nolint:gosec
+			t.Fatalf("failed to write golden file %s: %s", path, err)
+			return // unreachable
+		}
+		t.Logf("pgtestdb: updated golden file %s", path)
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("golden file %s does not exist, run the tests with -update or %s=1 to create it", path, UpdateEnvVar)
+			return // unreachable
+		}
+		t.Fatalf("failed to read golden file %s: %s", path, err)
+		return // unreachable
+	}
+	if diff := schemaDiff(string(want), got); diff != "" {
+		t.Fatalf(
+			"golden file %s is out of date, run the tests with -update or %s=1 to update it (-golden +got):\n%s",
+			path, UpdateEnvVar, diff,
+		)
+		return // unreachable
+	}
+}
+
+// updateGolden returns true if golden files should be rewritten. pgtestdb does
+// not define the `-update` flag itself, because many test suites already
+// define one and defining it twice would panic; instead it respects the flag
+// if it has been defined by the test binary.
+func updateGolden() bool {
+	if envEnabled(UpdateEnvVar) {
+		return true
+	}
+	if f := flag.Lookup("update"); f != nil {
+		if getter, ok := f.Value.(flag.Getter); ok {
+			if update, ok := getter.Get().(bool); ok {
+				return update
+			}
+		}
+	}
+	return false
+}
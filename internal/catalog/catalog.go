@@ -0,0 +1,352 @@
+// catalog introspects the postgres system catalogs to produce a deterministic,
+// normalized, text description of the schema of a database, so that two
+// databases can be compared to each other.
+package catalog
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// userSchemas is a condition that excludes the schemas that postgres manages
+// itself. It expects the pg_namespace table to be aliased as "n".
+const userSchemas = `n.nspname NOT IN ('pg_catalog', 'information_schema')
+	AND n.nspname NOT LIKE 'pg\_toast%'
+	AND n.nspname NOT LIKE 'pg\_temp\_%'`
+
+// Options control which objects are included in a description.
+type Options struct {
+	// ExcludeTables contains the names of tables to leave out of the
+	// description, along with their columns, constraints, indexes, and
+	// sequences. Names may be schema-qualified ("public.cats") or not
+	// ("cats"), in which case tables with that name in any schema are left
+	// out.
+	ExcludeTables []string
+	// ExcludeSchemas contains the names of schemas to leave out of the
+	// description, along with everything inside of them.
+	ExcludeSchemas []string
+}
+
+// excludes returns true if an object in the given schema that belongs to the
+// given table should be left out of the description.
+func (o Options) excludes(schema, table string) bool {
+	for _, excluded := range o.ExcludeSchemas {
+		if schema == excluded {
+			return true
+		}
+	}
+	if table == "" {
+		return false
+	}
+	for _, excluded := range o.ExcludeTables {
+		if table == excluded || schema+"."+table == excluded {
+			return true
+		}
+	}
+	return false
+}
+
+// Describe returns a description of every schema, table, column, constraint,
+// index, sequence, view, type, function, trigger, grant, row level security
+// policy, and extension in the database. Each object is described on its
+// own line, and the lines are sorted, so two databases with the same schema
+// will always have the same description regardless of the order in which the
+// objects were created.
+func Describe(ctx context.Context, db *sql.DB, opts Options) (string, error) {
+	var lines []string
+	for _, section := range []struct {
+		name  string
+		query string
+	}{
+		{"schemas", schemasQuery},
+		{"relations", relationsQuery},
+		{"columns", columnsQuery},
+		{"constraints", constraintsQuery},
+		{"indexes", indexesQuery},
+		{"sequences", sequencesQuery},
+		{"views", viewsQuery},
+		{"types", typesQuery},
+		{"domain constraints", domainConstraintsQuery},
+		{"functions", functionsQuery},
+		{"triggers", triggersQuery},
+		{"row level security", rowSecurityQuery},
+		{"policies", policiesQuery},
+		{"table grants", tableGrantsQuery},
+		{"function grants", functionGrantsQuery},
+		{"schema grants", schemaGrantsQuery},
+		{"extensions", extensionsQuery},
+	} {
+		found, err := queryLines(ctx, db, section.query, opts)
+		if err != nil {
+			return "", fmt.Errorf("failed to describe %s: %w", section.name, err)
+		}
+		lines = append(lines, found...)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n"), nil
+}
+
+// queryLines runs a query that returns the schema and table that each object
+// belongs to, along with the line describing that object, and returns every
+// line that isn't excluded.
+func queryLines(ctx context.Context, db *sql.DB, query string, opts Options) ([]string, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var lines []string
+	for rows.Next() {
+		var schema, table, line string
+		if err := rows.Scan(&schema, &table, &line); err != nil {
+			return nil, err
+		}
+		if opts.excludes(schema, table) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, rows.Err()
+}
+
+// Each of the following queries returns three columns: the schema that an
+// object belongs to, the table that it belongs to (or an empty string if it
+// does not belong to a table), and the line describing it.
+
+const schemasQuery = `
+SELECT n.nspname, '', format('schema %I', n.nspname)
+FROM pg_namespace n
+WHERE ` + userSchemas
+
+const relationsQuery = `
+SELECT n.nspname, c.relname, format('%s %I.%I', CASE c.relkind
+		WHEN 'r' THEN 'table'
+		WHEN 'p' THEN 'table'
+		WHEN 'v' THEN 'view'
+		WHEN 'm' THEN 'materialized view'
+		WHEN 'f' THEN 'foreign table'
+	END, n.nspname, c.relname)
+	|| CASE WHEN c.relkind = 'p' THEN ' partitioned' ELSE '' END
+FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind IN ('r', 'p', 'v', 'm', 'f')
+AND ` + userSchemas
+
+// Columns are described with their position, so that a difference in column
+// order is detected even though the lines are sorted.
+const columnsQuery = `
+SELECT n.nspname, c.relname, format('column %I.%I %s: %I %s', n.nspname, c.relname,
+		lpad(a.attnum::text, 4, '0'), a.attname, format_type(a.atttypid, a.atttypmod))
+	|| CASE WHEN a.attnotnull THEN ' not null' ELSE '' END
+	|| CASE a.attidentity
+		WHEN 'a' THEN ' generated always as identity'
+		WHEN 'd' THEN ' generated by default as identity'
+		ELSE '' END
+	|| CASE
+		WHEN a.attgenerated = 's' THEN ' generated always as (' || pg_get_expr(d.adbin, d.adrelid) || ') stored'
+		WHEN d.adbin IS NOT NULL THEN ' default ' || pg_get_expr(d.adbin, d.adrelid)
+		ELSE '' END
+	|| CASE WHEN a.attcollation <> t.typcollation THEN format(' collate %I', co.collname) ELSE '' END
+FROM pg_attribute a
+JOIN pg_class c ON c.oid = a.attrelid
+JOIN pg_namespace n ON n.oid = c.relnamespace
+JOIN pg_type t ON t.oid = a.atttypid
+LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+LEFT JOIN pg_collation co ON co.oid = a.attcollation
+WHERE a.attnum > 0
+AND NOT a.attisdropped
+AND c.relkind IN ('r', 'p', 'v', 'm', 'f')
+AND ` + userSchemas
+
+const constraintsQuery = `
+SELECT n.nspname, c.relname, format('constraint %I.%I %I: %s', n.nspname, c.relname, con.conname,
+		pg_get_constraintdef(con.oid, true))
+FROM pg_constraint con
+JOIN pg_class c ON c.oid = con.conrelid
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE ` + userSchemas
+
+const indexesQuery = `
+SELECT n.nspname, t.relname, format('index %I.%I: %s', n.nspname, i.relname, pg_get_indexdef(i.oid))
+FROM pg_index x
+JOIN pg_class i ON i.oid = x.indexrelid
+JOIN pg_class t ON t.oid = x.indrelid
+JOIN pg_namespace n ON n.oid = i.relnamespace
+WHERE ` + userSchemas
+
+const sequencesQuery = `
+SELECT n.nspname, coalesce(owner.relname, ''),
+	format('sequence %I.%I: %s increment %s minvalue %s maxvalue %s start %s cache %s%s',
+		n.nspname, c.relname, format_type(s.seqtypid, NULL), s.seqincrement,
+		s.seqmin, s.seqmax, s.seqstart, s.seqcache,
+		CASE WHEN s.seqcycle THEN ' cycle' ELSE '' END)
+FROM pg_sequence s
+JOIN pg_class c ON c.oid = s.seqrelid
+JOIN pg_namespace n ON n.oid = c.relnamespace
+LEFT JOIN pg_depend d ON d.classid = 'pg_class'::regclass
+	AND d.objid = c.oid
+	AND d.refclassid = 'pg_class'::regclass
+	AND d.deptype IN ('a', 'i')
+LEFT JOIN pg_class owner ON owner.oid = d.refobjid
+WHERE ` + userSchemas
+
+const viewsQuery = `
+SELECT n.nspname, c.relname, format('view definition %I.%I: %s', n.nspname, c.relname,
+		regexp_replace(pg_get_viewdef(c.oid, true), '\s+', ' ', 'g'))
+FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind IN ('v', 'm')
+AND ` + userSchemas
+
+// Types are enums, domains, and composite types. Enum labels are described in
+// their sort order, and the attributes of composite types in their position.
+// Types that belong to an extension are left out, like functions, and so are
+// the row types that postgres creates for every table.
+const typesQuery = `
+SELECT n.nspname, '', format('type %I.%I: ', n.nspname, t.typname) || CASE t.typtype
+		WHEN 'e' THEN format('enum (%s)', (
+			SELECT string_agg(quote_literal(e.enumlabel), ', ' ORDER BY e.enumsortorder)
+			FROM pg_enum e
+			WHERE e.enumtypid = t.oid))
+		WHEN 'd' THEN format('domain %s', format_type(t.typbasetype, t.typtypmod))
+			|| CASE WHEN t.typnotnull THEN ' not null' ELSE '' END
+			|| coalesce(' default ' || t.typdefault, '')
+		ELSE format('composite (%s)', (
+			SELECT string_agg(format('%I %s', a.attname, format_type(a.atttypid, a.atttypmod)), ', ' ORDER BY a.attnum)
+			FROM pg_attribute a
+			WHERE a.attrelid = t.typrelid
+			AND a.attnum > 0
+			AND NOT a.attisdropped))
+	END
+FROM pg_type t
+JOIN pg_namespace n ON n.oid = t.typnamespace
+WHERE (t.typtype IN ('e', 'd') OR (t.typtype = 'c' AND EXISTS (
+	SELECT FROM pg_class c
+	WHERE c.oid = t.typrelid
+	AND c.relkind = 'c'
+)))
+AND NOT EXISTS (
+	SELECT FROM pg_depend d
+	WHERE d.classid = 'pg_type'::regclass
+	AND d.objid = t.oid
+	AND d.deptype = 'e'
+)
+AND ` + userSchemas
+
+const domainConstraintsQuery = `
+SELECT n.nspname, '', format('domain constraint %I.%I %I: %s', n.nspname, t.typname, con.conname,
+		pg_get_constraintdef(con.oid, true))
+FROM pg_constraint con
+JOIN pg_type t ON t.oid = con.contypid
+JOIN pg_namespace n ON n.oid = t.typnamespace
+WHERE ` + userSchemas + `
+AND NOT EXISTS (
+	SELECT FROM pg_depend d
+	WHERE d.classid = 'pg_type'::regclass
+	AND d.objid = t.oid
+	AND d.deptype = 'e'
+)`
+
+// Functions and procedures that belong to an extension are left out, since
+// they are described by the extension's version rather than by the schema.
+// Definitions are collapsed onto a single line.
+const functionsQuery = `
+SELECT n.nspname, '', format('%s %I.%I(%s): %s',
+		CASE p.prokind WHEN 'p' THEN 'procedure' ELSE 'function' END,
+		n.nspname, p.proname, pg_get_function_identity_arguments(p.oid),
+		regexp_replace(trim(pg_get_functiondef(p.oid)), '\s+', ' ', 'g'))
+FROM pg_proc p
+JOIN pg_namespace n ON n.oid = p.pronamespace
+WHERE p.prokind IN ('f', 'p')
+AND NOT EXISTS (
+	SELECT FROM pg_depend d
+	WHERE d.classid = 'pg_proc'::regclass
+	AND d.objid = p.oid
+	AND d.deptype = 'e'
+)
+AND ` + userSchemas
+
+const triggersQuery = `
+SELECT n.nspname, c.relname, format('trigger %I.%I %I: %s', n.nspname, c.relname, tg.tgname,
+		pg_get_triggerdef(tg.oid, true))
+	|| CASE tg.tgenabled
+		WHEN 'D' THEN ' disabled'
+		WHEN 'R' THEN ' enabled replica'
+		WHEN 'A' THEN ' enabled always'
+		ELSE '' END
+FROM pg_trigger tg
+JOIN pg_class c ON c.oid = tg.tgrelid
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE NOT tg.tgisinternal
+AND ` + userSchemas
+
+const rowSecurityQuery = `
+SELECT n.nspname, c.relname, format('row level security %I.%I: enabled', n.nspname, c.relname)
+	|| CASE WHEN c.relforcerowsecurity THEN ' forced' ELSE '' END
+FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relrowsecurity
+AND ` + userSchemas
+
+const policiesQuery = `
+SELECT n.nspname, c.relname, format('policy %I.%I %I: as %s for %s to %s', n.nspname, c.relname, pol.polname,
+		CASE WHEN pol.polpermissive THEN 'permissive' ELSE 'restrictive' END,
+		CASE pol.polcmd
+			WHEN 'r' THEN 'select'
+			WHEN 'a' THEN 'insert'
+			WHEN 'w' THEN 'update'
+			WHEN 'd' THEN 'delete'
+			ELSE 'all' END,
+		(SELECT string_agg(CASE WHEN r.role = 0 THEN 'public' ELSE quote_ident(pg_get_userbyid(r.role)) END, ', ' ORDER BY 1)
+			FROM unnest(pol.polroles) AS r(role)))
+	|| coalesce(' using (' || pg_get_expr(pol.polqual, pol.polrelid) || ')', '')
+	|| coalesce(' with check (' || pg_get_expr(pol.polwithcheck, pol.polrelid) || ')', '')
+FROM pg_policy pol
+JOIN pg_class c ON c.oid = pol.polrelid
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE ` + userSchemas
+
+// Grants are described one privilege at a time. Privileges that the owner of
+// an object holds on it implicitly are left out, since they are the same for
+// every object and only appear in the catalog once another grant is made.
+const tableGrantsQuery = `
+SELECT n.nspname, c.relname, format('grant %s on %I.%I to %s%s', lower(acl.privilege_type), n.nspname, c.relname,
+		CASE WHEN acl.grantee = 0 THEN 'public' ELSE quote_ident(pg_get_userbyid(acl.grantee)) END,
+		CASE WHEN acl.is_grantable THEN ' with grant option' ELSE '' END)
+FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+CROSS JOIN LATERAL aclexplode(c.relacl) acl
+WHERE c.relkind IN ('r', 'p', 'v', 'm', 'f', 'S')
+AND acl.grantee <> c.relowner
+AND ` + userSchemas
+
+const functionGrantsQuery = `
+SELECT n.nspname, '', format('grant %s on function %I.%I(%s) to %s%s', lower(acl.privilege_type), n.nspname, p.proname,
+		pg_get_function_identity_arguments(p.oid),
+		CASE WHEN acl.grantee = 0 THEN 'public' ELSE quote_ident(pg_get_userbyid(acl.grantee)) END,
+		CASE WHEN acl.is_grantable THEN ' with grant option' ELSE '' END)
+FROM pg_proc p
+JOIN pg_namespace n ON n.oid = p.pronamespace
+CROSS JOIN LATERAL aclexplode(p.proacl) acl
+WHERE acl.grantee <> p.proowner
+AND ` + userSchemas
+
+const schemaGrantsQuery = `
+SELECT n.nspname, '', format('grant %s on schema %I to %s%s', lower(acl.privilege_type), n.nspname,
+		CASE WHEN acl.grantee = 0 THEN 'public' ELSE quote_ident(pg_get_userbyid(acl.grantee)) END,
+		CASE WHEN acl.is_grantable THEN ' with grant option' ELSE '' END)
+FROM pg_namespace n
+CROSS JOIN LATERAL aclexplode(n.nspacl) acl
+WHERE acl.grantee <> n.nspowner
+AND ` + userSchemas
+
+// Extensions are described with their version and the schema they are
+// installed into. They aren't limited to user schemas, since extensions like
+// plpgsql are installed into pg_catalog.
+const extensionsQuery = `
+SELECT n.nspname, '', format('extension %I %s: schema %I', x.extname, x.extversion, n.nspname)
+FROM pg_extension x
+JOIN pg_namespace n ON n.oid = x.extnamespace`
@@ -0,0 +1,147 @@
+package catalog_test
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+
+	_ "github.com/jackc/pgx/v5/stdlib" // pgx driver for postgres
+	"github.com/peterldowns/testy/assert"
+	"github.com/peterldowns/testy/check"
+
+	"github.com/peterldowns/pgtestdb/internal/catalog"
+	"github.com/peterldowns/pgtestdb/internal/withdb"
+)
+
+// describe creates a new database, runs the given statements against it, and
+// returns its description.
+func describe(t *testing.T, statements ...string) string {
+	t.Helper()
+	ctx := context.Background()
+	var desc string
+	assert.Nil(t, withdb.WithDB(ctx, "pgx", func(db *sql.DB) error {
+		for _, statement := range statements {
+			if _, err := db.ExecContext(ctx, statement); err != nil {
+				return err
+			}
+		}
+		var err error
+		desc, err = catalog.Describe(ctx, db, catalog.Options{})
+		return err
+	}))
+	return desc
+}
+
+func TestDescribeIgnoresCreationOrder(t *testing.T) {
+	t.Parallel()
+	cats := "CREATE TABLE cats (id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY, name TEXT NOT NULL)"
+	dogs := "CREATE TABLE dogs (id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY, name TEXT NOT NULL)"
+	index := "CREATE INDEX cats_name_idx ON cats (name)"
+	first := describe(t, cats, dogs, index)
+	second := describe(t, dogs, cats, index)
+	check.Equal(t, first, second)
+	check.True(t, strings.Contains(first, "table public.cats"))
+	check.True(t, strings.Contains(first, "index public.cats_name_idx: CREATE INDEX cats_name_idx ON public.cats USING btree (name)"))
+}
+
+func TestDescribeDetectsDifferences(t *testing.T) {
+	t.Parallel()
+	base := describe(t, "CREATE TABLE cats (id BIGINT PRIMARY KEY, name TEXT)")
+	for _, statements := range [][]string{
+		{"CREATE TABLE cats (id BIGINT PRIMARY KEY, name VARCHAR(10))"},
+		{"CREATE TABLE cats (id BIGINT PRIMARY KEY, name TEXT NOT NULL)"},
+		{"CREATE TABLE cats (name TEXT, id BIGINT PRIMARY KEY)"},
+		{"CREATE TABLE cats (id BIGINT PRIMARY KEY, name TEXT DEFAULT 'daisy')"},
+		{"CREATE TABLE cats (id BIGINT PRIMARY KEY, name TEXT UNIQUE)"},
+		{"CREATE TABLE cats (id BIGINT PRIMARY KEY, name TEXT)", "CREATE VIEW cat_names AS SELECT name FROM cats"},
+		{"CREATE TABLE cats (id BIGINT PRIMARY KEY, name TEXT)", "CREATE FUNCTION meow() RETURNS TEXT LANGUAGE sql AS 'SELECT 1::text'"},
+		{"CREATE TABLE cats (id BIGINT PRIMARY KEY, name TEXT)", "ALTER TABLE cats ENABLE ROW LEVEL SECURITY"},
+		{"CREATE TABLE cats (id BIGINT PRIMARY KEY, name TEXT)", "GRANT SELECT ON cats TO PUBLIC"},
+		{"CREATE TABLE cats (id BIGINT PRIMARY KEY, name TEXT)", "CREATE TYPE mood AS ENUM ('happy', 'sad')"},
+		{"CREATE TABLE cats (id BIGINT PRIMARY KEY, name TEXT)", "CREATE TYPE meal AS (food TEXT, grams INT)"},
+		{"CREATE TABLE cats (id BIGINT PRIMARY KEY, name TEXT)", "CREATE EXTENSION pg_stat_statements"},
+	} {
+		check.NotEqual(t, base, describe(t, statements...))
+	}
+}
+
+func TestDescribeExcludes(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	assert.Nil(t, withdb.WithDB(ctx, "pgx", func(db *sql.DB) error {
+		statements := []string{
+			"CREATE TABLE cats (id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY)",
+			"CREATE TABLE schema_migrations (version BIGINT PRIMARY KEY, dirty BOOLEAN NOT NULL)",
+			"CREATE SCHEMA atlas_schema_revisions",
+			"CREATE TABLE atlas_schema_revisions.revisions (version TEXT PRIMARY KEY)",
+		}
+		for _, statement := range statements {
+			if _, err := db.ExecContext(ctx, statement); err != nil {
+				return err
+			}
+		}
+		desc, err := catalog.Describe(ctx, db, catalog.Options{
+			ExcludeTables:  []string{"public.schema_migrations"},
+			ExcludeSchemas: []string{"atlas_schema_revisions"},
+		})
+		if err != nil {
+			return err
+		}
+		check.True(t, strings.Contains(desc, "cats"))
+		check.False(t, strings.Contains(desc, "schema_migrations"))
+		check.False(t, strings.Contains(desc, "atlas_schema_revisions"))
+		return nil
+	}))
+}
+
+func TestDescribeFunctionsTriggersGrantsAndPolicies(t *testing.T) {
+	t.Parallel()
+	desc := describe(t,
+		"CREATE TABLE cats (id BIGINT PRIMARY KEY, name TEXT, owner TEXT)",
+		`CREATE FUNCTION touch() RETURNS trigger LANGUAGE plpgsql AS $$
+		BEGIN
+			NEW.name := lower(NEW.name);
+			RETURN NEW;
+		END
+		$$`,
+		"CREATE TRIGGER cats_touch BEFORE INSERT ON cats FOR EACH ROW EXECUTE FUNCTION touch()",
+		"ALTER TABLE cats ENABLE ROW LEVEL SECURITY",
+		"CREATE POLICY cats_owner ON cats FOR SELECT TO PUBLIC USING (owner = current_user)",
+		"GRANT SELECT, INSERT ON cats TO PUBLIC",
+	)
+	for _, want := range []string{
+		"function public.touch(): CREATE OR REPLACE FUNCTION public.touch() RETURNS trigger LANGUAGE plpgsql AS $function$ BEGIN NEW.name := lower(NEW.name); RETURN NEW; END $function$",
+		"trigger public.cats cats_touch: CREATE TRIGGER cats_touch BEFORE INSERT ON cats FOR EACH ROW EXECUTE FUNCTION touch()",
+		"row level security public.cats: enabled",
+		"policy public.cats cats_owner: as permissive for select to public using ((owner = CURRENT_USER))",
+		"grant select on public.cats to public",
+		"grant insert on public.cats to public",
+	} {
+		check.True(t, strings.Contains(desc, want))
+	}
+}
+
+func TestDescribeTypes(t *testing.T) {
+	t.Parallel()
+	mood := "CREATE TYPE mood AS ENUM ('happy', 'sad')"
+	name := "CREATE DOMAIN cat_name AS TEXT NOT NULL CHECK (length(VALUE) < 10)"
+	base := describe(t, mood, name)
+	for _, want := range []string{
+		"type public.mood: enum ('happy', 'sad')",
+		"type public.cat_name: domain text not null",
+		"domain constraint public.cat_name cat_name_check: CHECK (length(VALUE) < 10)",
+	} {
+		check.True(t, strings.Contains(base, want))
+	}
+	for _, statements := range [][]string{
+		{mood, name, "ALTER TYPE mood RENAME VALUE 'sad' TO 'grumpy'"},
+		{mood, name, "ALTER TYPE mood ADD VALUE 'sleepy'"},
+		{mood, name, "ALTER TYPE mood ADD VALUE 'sleepy' BEFORE 'sad'"},
+		{mood, name, "ALTER DOMAIN cat_name DROP NOT NULL"},
+		{mood, name, "ALTER DOMAIN cat_name SET DEFAULT 'daisy'"},
+		{mood, "CREATE DOMAIN cat_name AS TEXT NOT NULL CHECK (length(VALUE) < 20)"},
+	} {
+		check.NotEqual(t, base, describe(t, statements...))
+	}
+}
@@ -0,0 +1,79 @@
+// flock package provides advisory locks on files, for synchronizing separate
+// processes on the same machine, such as the test binaries that `go test ./...`
+// runs for each package.
+//
+// Locks are held by an open file, and are released when the file is closed or
+// the process exits, so a crashed process never leaves a lock behind.
+package flock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// File is an open lock file.
+type File struct {
+	path string
+	file *os.File
+}
+
+// Open opens the lock file at `path`, creating it if it doesn't exist. The
+// file is not locked until one of the locking methods is called.
+func Open(path string) (*File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("flock(%s) failed to open: %w", path, err)
+	}
+	return &File{path: path, file: file}, nil
+}
+
+// Path returns the path of the lock file.
+func (f *File) Path() string {
+	return f.path
+}
+
+// Lock acquires an exclusive lock on the file, waiting until no other process
+// holds a lock on it.
+func (f *File) Lock() error {
+	if err := lock(f.file, true, true); err != nil {
+		return fmt.Errorf("flock(%s) failed to lock: %w", f.path, err)
+	}
+	return nil
+}
+
+// RLock acquires a shared lock on the file, waiting until no other process
+// holds an exclusive lock on it. Any number of processes may hold a shared
+// lock at once.
+func (f *File) RLock() error {
+	if err := lock(f.file, false, true); err != nil {
+		return fmt.Errorf("flock(%s) failed to lock: %w", f.path, err)
+	}
+	return nil
+}
+
+// TryLock attempts to acquire an exclusive lock on the file without waiting.
+// It returns false if another process holds a lock on the file.
+func (f *File) TryLock() (bool, error) {
+	err := lock(f.file, true, false)
+	if errors.Is(err, errWouldBlock) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("flock(%s) failed to lock: %w", f.path, err)
+	}
+	return true, nil
+}
+
+// Unlock releases any lock held on the file.
+func (f *File) Unlock() error {
+	if err := unlock(f.file); err != nil {
+		return fmt.Errorf("flock(%s) failed to unlock: %w", f.path, err)
+	}
+	return nil
+}
+
+// Close closes the file, releasing any lock held on it.
+func (f *File) Close() error {
+	return f.file.Close()
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+package flock
+
+import (
+	"errors"
+	"os"
+)
+
+var errWouldBlock = errors.New("flock: lock is held by another process")
+
+func lock(*os.File, bool, bool) error {
+	return errors.ErrUnsupported
+}
+
+func unlock(*os.File) error {
+	return errors.ErrUnsupported
+}
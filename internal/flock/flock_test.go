@@ -0,0 +1,62 @@
+//go:build unix
+
+package flock_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/peterldowns/testy/assert"
+	"github.com/peterldowns/testy/check"
+
+	"github.com/peterldowns/pgtestdb/internal/flock"
+)
+
+// Locks belong to the open file, so two opens of the same path in a single
+// process contend with each other just like two processes would.
+func open(t *testing.T, path string) *flock.File {
+	t.Helper()
+	f, err := flock.Open(path)
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = f.Close() })
+	return f
+}
+
+func TestExclusiveLockExcludesOthers(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "lock")
+	a, b := open(t, path), open(t, path)
+
+	assert.Nil(t, a.Lock())
+	ok, err := b.TryLock()
+	assert.Nil(t, err)
+	check.False(t, ok)
+
+	assert.Nil(t, a.Unlock())
+	ok, err = b.TryLock()
+	assert.Nil(t, err)
+	check.True(t, ok)
+}
+
+func TestSharedLocksExcludeExclusiveLocks(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "lock")
+	a, b, c := open(t, path), open(t, path), open(t, path)
+
+	assert.Nil(t, a.RLock())
+	assert.Nil(t, b.RLock())
+	ok, err := c.TryLock()
+	assert.Nil(t, err)
+	check.False(t, ok)
+
+	assert.Nil(t, a.Unlock())
+	ok, err = c.TryLock()
+	assert.Nil(t, err)
+	check.False(t, ok)
+
+	// Closing the file releases its lock, as exiting the process would.
+	assert.Nil(t, b.Close())
+	ok, err = c.TryLock()
+	assert.Nil(t, err)
+	check.True(t, ok)
+}
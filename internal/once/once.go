@@ -2,7 +2,11 @@
 // that are only ever initialized once, and can potentially return an error.
 package once
 
-import "sync"
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 // Map is a type-safe and concurrency-safe implementation of a map where each
 // entry is initialized a single time.
@@ -20,33 +24,85 @@ func NewMap[K comparable, V any]() Map[K, V] {
 	return &smap[K, V]{}
 }
 
+// MapOptions configures a [Map] returned by [NewMapWithOptions].
+type MapOptions struct {
+	// Forget is called with each error returned by an initialization
+	// function. If it returns true, the error is forgotten after the TTL, and
+	// the next call to Set initializes the entry again. Results, and errors for
+	// which Forget returns false or which is nil, are kept forever.
+	Forget func(error) bool
+	// TTL is how long a forgotten error is still returned by Set before the
+	// entry is initialized again. If it is zero, the error is returned only to
+	// the callers that were waiting for the initialization that failed.
+	TTL time.Duration
+}
+
+// NewMapWithOptions returns a [Map] like [NewMap], except that some errors
+// can be forgotten so that the entry is initialized again.
+func NewMapWithOptions[K comparable, V any](opts MapOptions) Map[K, V] {
+	return &smap[K, V]{opts: opts}
+}
+
 type entry[V any] struct {
 	data *V
 	err  error
+	at   time.Time
+}
+
+// slot holds a single initialization of a key. When an error is forgotten, the
+// slot is replaced, so that callers waiting on the old slot still see its
+// result.
+type slot[V any] struct {
+	once  sync.Once
+	done  atomic.Bool
+	entry entry[V]
 }
 
 type smap[K comparable, V any] struct {
-	onces sync.Map // map[K]*sync.Once
-	data  sync.Map // map[K]safemapEntry
+	opts  MapOptions
+	slots sync.Map // map[K]*slot[V]
 }
 
 func (sm *smap[K, V]) Set(key K, f func() (*V, error)) (*V, error) {
-	onceRaw, _ := sm.onces.LoadOrStore(key, &sync.Once{})
-	once := onceRaw.(*sync.Once)
-	once.Do(func() {
-		res, err := f()
-		sm.data.Store(key, entry[V]{
-			data: res,
-			err:  err,
+	for {
+		raw, loaded := sm.slots.LoadOrStore(key, &slot[V]{})
+		s := raw.(*slot[V])
+		if loaded && sm.expired(s) {
+			sm.slots.CompareAndDelete(key, s)
+			continue
+		}
+		s.once.Do(func() {
+			res, err := f()
+			s.entry = entry[V]{
+				data: res,
+				err:  err,
+				at:   time.Now(),
+			}
+			s.done.Store(true)
 		})
-	})
-	return sm.Get(key)
+		return s.entry.data, s.entry.err
+	}
+}
+
+// expired returns true if the slot was initialized with an error that should
+// be forgotten now.
+func (sm *smap[K, V]) expired(s *slot[V]) bool {
+	if sm.opts.Forget == nil || !s.done.Load() || s.entry.err == nil {
+		return false
+	}
+	return sm.opts.Forget(s.entry.err) && time.Since(s.entry.at) >= sm.opts.TTL
 }
 
 func (sm *smap[K, V]) Get(key K) (*V, error) {
-	rawState, _ := sm.data.Load(key)
-	state, _ := rawState.(entry[V])
-	return state.data, state.err
+	raw, ok := sm.slots.Load(key)
+	if !ok {
+		return nil, nil
+	}
+	s := raw.(*slot[V])
+	if !s.done.Load() {
+		return nil, nil
+	}
+	return s.entry.data, s.entry.err
 }
 
 // Var is a type-safe and concurrency-safe wrapper for a value that is
@@ -1,9 +1,11 @@
 package once_test
 
 import (
+	"errors"
 	"fmt"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/peterldowns/testy/assert"
 	"github.com/peterldowns/testy/check"
@@ -73,6 +75,74 @@ func TestMap(t *testing.T) {
 	check.Equal(t, 1, x.Read())
 }
 
+func TestMapForgetsErrors(t *testing.T) {
+	t.Parallel()
+	errTransient := errors.New("transient")
+	onceMap := once.NewMapWithOptions[string, string](once.MapOptions{
+		Forget: func(err error) bool { return errors.Is(err, errTransient) },
+	})
+
+	calls := 0
+	init := func(err error) func() (*string, error) {
+		return func() (*string, error) {
+			calls++
+			if err != nil {
+				return nil, err
+			}
+			val := "world"
+			return &val, nil
+		}
+	}
+
+	// A forgotten error is initialized again by the next call to Set.
+	_, err := onceMap.Set("transient", init(errTransient))
+	check.Error(t, err)
+	val, err := onceMap.Set("transient", init(nil))
+	check.Nil(t, err)
+	if check.NotEqual(t, nil, val) {
+		check.Equal(t, "world", *val)
+	}
+	check.Equal(t, 2, calls)
+
+	// Other errors are kept.
+	_, err = onceMap.Set("permanent", init(errors.New("permanent")))
+	check.Error(t, err)
+	_, err = onceMap.Set("permanent", init(nil))
+	check.Error(t, err)
+	check.Equal(t, 3, calls)
+}
+
+func TestMapKeepsErrorsUntilTTL(t *testing.T) {
+	t.Parallel()
+	x := newMutexCounter()
+	ttl := 50 * time.Millisecond
+	onceMap := once.NewMapWithOptions[string, string](once.MapOptions{
+		Forget: func(error) bool { return true },
+		TTL:    ttl,
+	})
+	fail := func() (*string, error) {
+		x.Add(1)
+		return nil, fmt.Errorf("problem initializing")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := onceMap.Set("hello", fail)
+			check.Error(t, err)
+		}()
+	}
+	wg.Wait()
+	check.Equal(t, 1, x.Read())
+
+	time.Sleep(ttl)
+	_, err := onceMap.Set("hello", fail)
+	check.Error(t, err)
+	check.Equal(t, 2, x.Read())
+}
+
 // mutexCounter is a concurrency-safe counter needed for testing that the other
 // "concurrency-safe" code is actually, well, concurrency-safe.
 type mutexCounter struct {
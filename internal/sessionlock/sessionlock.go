@@ -7,9 +7,14 @@ package sessionlock
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash/crc32"
+	"strings"
+	"time"
 
 	"github.com/peterldowns/pgtestdb/internal/multierr"
 )
@@ -19,19 +24,69 @@ import (
 // own locks.
 const IDPrefix string = "sessionlock-"
 
-// ID consistently hashes a string to unique integer that can be used with
-// pg_advisory_lock() and pg_advisory_unlock().
-func ID(name string) uint32 {
+const (
+	// minPollInterval and maxPollInterval bound how long to wait between
+	// attempts to acquire a lock that is held by another session.
+	minPollInterval = 5 * time.Millisecond
+	maxPollInterval = 200 * time.Millisecond
+	// holdersTimeout bounds the query that finds the holders of a lock after
+	// giving up on it, since the context may already be done.
+	holdersTimeout = 5 * time.Second
+)
+
+// ErrTimeout is returned, wrapped, by [WithOptions] when the lock could not be
+// acquired in time.
+var ErrTimeout = errors.New("timed out waiting for lock")
+
+// ID consistently hashes a string to a 64-bit integer that can be used with
+// pg_advisory_lock() and pg_advisory_unlock(). It is the first 8 bytes of the
+// SHA-256 of the name, so collisions with other lock names, and with the locks
+// of other clients, are very unlikely.
+func ID(name string) int64 {
+	sum := sha256.Sum256([]byte(IDPrefix + name))
+	return int64(binary.BigEndian.Uint64(sum[:8]))
+}
+
+// LegacyID is the 32-bit CRC32 of the name that versions of pgtestdb up to and
+// including v0.1.1 used as the lock ID. Because the space is so small, it
+// often collides with other locks.
+func LegacyID(name string) uint32 {
 	return crc32.ChecksumIEEE([]byte(IDPrefix + name))
 }
 
+// Options configures [WithOptions].
+type Options struct {
+	// Timeout, if greater than zero, is how long to wait for the lock before
+	// giving up with an error wrapping [ErrTimeout].
+	Timeout time.Duration
+	// If true, Legacy takes the lock with the [LegacyID] before taking it
+	// with the [ID], so that callers are also mutually exclusive with older
+	// versions of pgtestdb, which only use the LegacyID. Because every caller
+	// takes the LegacyID first, or only, they can't deadlock.
+	Legacy bool
+}
+
 // With will open a connection to the `db`, acquire an advisory lock, use that
 // connection to acquire an advisory lock, then call your `cb`, then release the
 // advisory lock.
-func With(ctx context.Context, db *sql.DB, lockName string, cb func(*sql.Conn) error) (final error) {
-	id := ID(lockName)
-	lockQuery := fmt.Sprintf("SELECT pg_advisory_lock(%d)", id)
-	unlockQuery := fmt.Sprintf("SELECT pg_advisory_unlock(%d)", id)
+//
+// While another session holds the lock, With polls `pg_try_advisory_lock()`
+// until it is released or the context is done. If the context is done first,
+// the returned error wraps the context's error and names the sessions that
+// hold the lock.
+func With(ctx context.Context, db *sql.DB, lockName string, cb func(*sql.Conn) error) error {
+	return WithOptions(ctx, db, lockName, Options{}, cb)
+}
+
+// WithOptions is like [With], but can give up after a timeout and take the
+// lock that older versions of pgtestdb use as well. If the lock can't be
+// acquired within the timeout, it returns an error wrapping [ErrTimeout] that
+// names the sessions that hold the lock.
+func WithOptions(ctx context.Context, db *sql.DB, lockName string, opts Options, cb func(*sql.Conn) error) (final error) {
+	ids := []int64{ID(lockName)}
+	if opts.Legacy {
+		ids = []int64{int64(LegacyID(lockName)), ID(lockName)}
+	}
 
 	// Uses a *sql.Conn here to guarantee that lock() and unlock() happen in the
 	// same session.
@@ -45,13 +100,99 @@ func With(ctx context.Context, db *sql.DB, lockName string, cb func(*sql.Conn) e
 		}
 	}()
 
-	if _, err := conn.ExecContext(ctx, lockQuery); err != nil {
-		return err
+	waitCtx := ctx
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
 	}
-	defer func() {
-		if _, err := conn.ExecContext(ctx, unlockQuery); err != nil {
-			final = multierr.Join(final, fmt.Errorf("sessionlock(%s) failed to unlock: %w", lockName, err))
+	start := time.Now()
+	for _, id := range ids {
+		id := id
+		if err := lock(ctx, waitCtx, start, db, conn, lockName, id); err != nil {
+			return err
 		}
-	}()
+		// Locks are released in the reverse of the order they were taken,
+		// and released even if the context was cancelled while the callback
+		// ran, since the pool keeps the session open.
+		defer func() {
+			unlockQuery := fmt.Sprintf("SELECT pg_advisory_unlock(%d)", id)
+			if _, err := conn.ExecContext(context.WithoutCancel(ctx), unlockQuery); err != nil {
+				final = multierr.Join(final, fmt.Errorf("sessionlock(%s) failed to unlock: %w", lockName, err))
+			}
+		}()
+	}
 	return cb(conn)
 }
+
+// lock polls `pg_try_advisory_lock()` until it acquires the lock or waitCtx is
+// done, which happens when the timeout passes or ctx is done. Cancelling the
+// context also cancels the query in progress on the server.
+func lock(ctx, waitCtx context.Context, start time.Time, db *sql.DB, conn *sql.Conn, lockName string, id int64) error {
+	wait := minPollInterval
+	for {
+		var locked bool
+		err := conn.QueryRowContext(waitCtx, "SELECT pg_try_advisory_lock($1)", id).Scan(&locked)
+		if err == nil && locked {
+			return nil
+		}
+		if err == nil {
+			select {
+			case <-waitCtx.Done():
+			case <-time.After(wait):
+				wait = min(2*wait, maxPollInterval)
+				continue
+			}
+		}
+		if waitCtx.Err() == nil {
+			return fmt.Errorf("sessionlock(%s) failed to lock: %w", lockName, err)
+		}
+		cause := ctx.Err()
+		if cause == nil {
+			cause = ErrTimeout
+		}
+		return fmt.Errorf(
+			"sessionlock(%s) gave up after %s; the lock is held by %s: %w",
+			lockName, time.Since(start).Round(time.Millisecond), describeHolders(ctx, db, id), cause,
+		)
+	}
+}
+
+// describeHolders describes the sessions that hold an advisory lock, for use
+// in error messages. It uses a different connection than the one that was
+// waiting, which may have been closed when its query was cancelled. Locks
+// taken with a single bigint key are reported in pg_locks with the high and
+// low 32 bits of the key as classid and objid, and an objsubid of 1. Advisory
+// locks belong to a database, so only the current database is searched.
+func describeHolders(ctx context.Context, db *sql.DB, id int64) string {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), holdersTimeout)
+	defer cancel()
+	query := `SELECT format('pid %s (application_name=%L state=%L query=%L)',
+			a.pid, a.application_name, a.state, left(a.query, 200))
+		FROM pg_locks l
+		JOIN pg_stat_activity a ON a.pid = l.pid
+		WHERE l.locktype = 'advisory'
+		AND l.database = (SELECT oid FROM pg_database WHERE datname = current_database())
+		AND l.classid = $1
+		AND l.objid = $2
+		AND l.objsubid = 1
+		AND l.granted
+		ORDER BY a.pid`
+	rows, err := db.QueryContext(ctx, query, int64(uint64(id)>>32), int64(uint32(id)))
+	if err != nil {
+		return fmt.Sprintf("an unknown session (failed to find it: %s)", err)
+	}
+	defer rows.Close()
+	var holders []string
+	for rows.Next() {
+		var holder string
+		if err := rows.Scan(&holder); err != nil {
+			return fmt.Sprintf("an unknown session (failed to find it: %s)", err)
+		}
+		holders = append(holders, holder)
+	}
+	if len(holders) == 0 {
+		return "a session that has since released it"
+	}
+	return strings.Join(holders, ", ")
+}
@@ -3,6 +3,7 @@ package sessionlock
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
@@ -84,3 +85,118 @@ func TestWithReturnsUnlockErrors(t *testing.T) {
 		return nil
 	}))
 }
+
+// holdLock holds a lock in the background until the returned function is
+// called.
+func holdLock(ctx context.Context, t *testing.T, db *sql.DB, lockName string) func() {
+	t.Helper()
+	locked := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		check.Nil(t, With(ctx, db, lockName, func(_ *sql.Conn) error {
+			close(locked)
+			<-release
+			return nil
+		}))
+	}()
+	<-locked
+	return func() {
+		close(release)
+		<-done
+	}
+}
+
+func TestWithOptionsTimeoutNamesTheHolder(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	check.Nil(t, withdb.WithDB(ctx, "pgx", func(db *sql.DB) error {
+		release := holdLock(ctx, t, db, "held")
+		defer release()
+
+		var called bool
+		err := WithOptions(ctx, db, "held", Options{Timeout: 100 * time.Millisecond}, func(_ *sql.Conn) error {
+			called = true
+			return nil
+		})
+		check.False(t, called)
+		check.True(t, errors.Is(err, ErrTimeout))
+		check.True(t, strings.Contains(err.Error(), "the lock is held by pid "))
+		return nil
+	}))
+}
+
+func TestWithStopsWaitingWhenContextIsCancelled(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	check.Nil(t, withdb.WithDB(ctx, "pgx", func(db *sql.DB) error {
+		release := holdLock(ctx, t, db, "cancelled")
+		defer release()
+
+		waitCtx, cancel := context.WithCancel(ctx)
+		time.AfterFunc(100*time.Millisecond, cancel)
+		err := With(waitCtx, db, "cancelled", func(_ *sql.Conn) error {
+			return nil
+		})
+		check.True(t, errors.Is(err, context.Canceled))
+		check.True(t, strings.Contains(err.Error(), "the lock is held by pid "))
+		return nil
+	}))
+}
+
+func TestWithOptionsAcquiresReleasedLock(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	check.Nil(t, withdb.WithDB(ctx, "pgx", func(db *sql.DB) error {
+		release := holdLock(ctx, t, db, "released")
+		time.AfterFunc(50*time.Millisecond, release)
+
+		var called bool
+		err := WithOptions(ctx, db, "released", Options{Timeout: 5 * time.Second}, func(_ *sql.Conn) error {
+			called = true
+			return nil
+		})
+		check.Nil(t, err)
+		check.True(t, called)
+		return nil
+	}))
+}
+
+func TestIDIsStableAndDistinct(t *testing.T) {
+	t.Parallel()
+	check.Equal(t, ID("example"), ID("example"))
+	check.NotEqual(t, ID("example"), ID("example2"))
+	check.NotEqual(t, ID("example"), int64(LegacyID("example")))
+}
+
+func TestWithOptionsLegacyExcludesOlderVersions(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	check.Nil(t, withdb.WithDB(ctx, "pgx", func(db *sql.DB) error {
+		// Older versions of pgtestdb only take the lock with the LegacyID.
+		old, err := db.Conn(ctx)
+		assert.Nil(t, err)
+		defer old.Close()
+		_, err = old.ExecContext(ctx, "SELECT pg_advisory_lock($1)", int64(LegacyID("legacy")))
+		assert.Nil(t, err)
+
+		// Without Legacy, the locks don't exclude each other.
+		check.Nil(t, WithOptions(ctx, db, "legacy", Options{Timeout: time.Second}, func(_ *sql.Conn) error {
+			return nil
+		}))
+
+		// With Legacy, the lock waits for the older version to finish.
+		err = WithOptions(ctx, db, "legacy", Options{Timeout: 100 * time.Millisecond, Legacy: true}, func(_ *sql.Conn) error {
+			return nil
+		})
+		check.True(t, errors.Is(err, ErrTimeout))
+
+		_, err = old.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", int64(LegacyID("legacy")))
+		assert.Nil(t, err)
+		check.Nil(t, WithOptions(ctx, db, "legacy", Options{Timeout: time.Second, Legacy: true}, func(_ *sql.Conn) error {
+			return nil
+		}))
+		return nil
+	}))
+}
@@ -0,0 +1,391 @@
+package pgtestdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/peterldowns/pgtestdb/internal/sessionlock"
+)
+
+// schemaTemplateComment is the start of the comment on each template schema
+// once it has been migrated successfully, playing the part of `datistemplate`.
+// It is followed by the ID of the run that built the template.
+const schemaTemplateComment = "pgtestdb template"
+
+// withSearchPath adds the search_path parameter to URL-formatted connection
+// options, so that unqualified names refer to the given schema first and then
+// to the public schema, where extensions are usually installed. The schema is
+// not quoted, since some migration tools quote it themselves, and the names
+// of pgtestdb's schemas never need quoting.
+func withSearchPath(options, schema string) string {
+	values, err := url.ParseQuery(options)
+	if err != nil {
+		values = url.Values{}
+	}
+	values.Set("search_path", schema+",public")
+	return values.Encode()
+}
+
+// getOrCreateSchemaTemplate is like getOrCreateTemplate, but creates the
+// template as a schema in `conf.Database` for use with `conf.IsolateSchemas`.
+// It connects as `conf.User`, since the user may not be able to create roles.
+func getOrCreateSchemaTemplate(
+	ctx context.Context,
+	baseDB *sql.DB,
+	conf Config,
+	migrator Migrator,
+) (*templateState, error) {
+	conf.TestRole = &Role{Username: conf.User, Password: conf.Password}
+	described, err := newTemplateState(ctx, baseDB, conf, migrator)
+	if err != nil {
+		return nil, err
+	}
+	described.conf.Database = conf.Database
+	described.conf.Schema = templateName(described.hash)
+	described.conf.Options = withSearchPath(conf.Options, described.conf.Schema)
+	key := conf.serverKey() + "/" + conf.Database + "/" + described.hash
+	return templates.Set(key, func() (*templateState, error) {
+		state := *described
+		waitStart := time.Now()
+		conf.observe(state.event(EventTemplateLockWait, 0))
+		lockName := conf.Database + "." + state.conf.Schema
+		err := sessionlock.WithOptions(ctx, baseDB, lockName, conf.lockOptions(), func(conn *sql.Conn) error {
+			conf.observe(state.event(EventTemplateLockAcquired, time.Since(waitStart)))
+			return ensureSchemaTemplate(ctx, conn, migrator, state)
+		})
+		if err != nil {
+			failed := state.event(EventTemplateFailed, 0)
+			failed.Err = err
+			conf.observe(failed)
+			return nil, conf.retryable(err)
+		}
+		return &state, nil
+	})
+}
+
+// ensureSchemaTemplate is like ensureTemplate, but for template schemas. The
+// schema's comment is set once it has been migrated successfully.
+func ensureSchemaTemplate(
+	ctx context.Context,
+	conn *sql.Conn,
+	migrator Migrator,
+	state templateState,
+) error {
+	schema := state.conf.Schema
+	comment := schemaTemplateComment + " " + runID()
+	var existing sql.NullString
+	query := "SELECT obj_description(oid, 'pg_namespace') FROM pg_namespace WHERE nspname = $1"
+	err := conn.QueryRowContext(ctx, query, schema).Scan(&existing)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("failed to check if template schema %s already exists: %w", schema, err)
+	}
+	templateExists := existing.Valid && strings.HasPrefix(existing.String, schemaTemplateComment)
+	if templateExists && (!state.conf.rebuild() || existing.String == comment) {
+		state.conf.observe(state.event(EventTemplateReused, 0))
+		return nil
+	}
+
+	query = fmt.Sprintf(`DROP SCHEMA IF EXISTS "%s" CASCADE`, schema)
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to drop broken template schema %s: %w", schema, err)
+	}
+	query = fmt.Sprintf(`CREATE SCHEMA "%s"`, schema)
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to create template schema %s: %w", schema, err)
+	}
+
+	template, err := state.conf.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to template schema %s: %w", schema, err)
+	}
+	defer template.Close()
+	migrateStart := time.Now()
+	if err := migrator.Migrate(ctx, template, state.conf); err != nil {
+		return fmt.Errorf("failed to migrator.Migrate template schema %s: %w", schema, err)
+	}
+	migrateDuration := time.Since(migrateStart)
+
+	query = fmt.Sprintf(`COMMENT ON SCHEMA "%s" IS %s`, schema, quoteLiteral(comment))
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to confirm template schema %s: %w", schema, err)
+	}
+	state.conf.observe(state.event(EventTemplateBuilt, migrateDuration))
+	return nil
+}
+
+// createSchemaInstance creates a new test schema by copying a template schema.
+// If the template contains objects that copySchema can't copy, the test schema
+// is migrated from scratch instead.
+func createSchemaInstance(
+	ctx context.Context,
+	baseDB *sql.DB,
+	template templateState,
+	migrator Migrator,
+) (_ *Config, final error) {
+	testConf := template.conf
+	testConf.Schema = fmt.Sprintf(
+		"testdb_tpl_%s_inst_%s",
+		template.hash,
+		randomID(),
+	)
+	testConf.Options = withSearchPath(template.conf.Options, testConf.Schema)
+
+	copyable, err := schemaIsCopyable(ctx, baseDB, template.conf.Schema)
+	if err != nil {
+		return nil, err
+	}
+	if copyable {
+		if err := copySchema(ctx, baseDB, template.conf.Schema, testConf.Schema); err != nil {
+			return nil, err
+		}
+		return &testConf, nil
+	}
+
+	query := fmt.Sprintf(`CREATE SCHEMA "%s"`, testConf.Schema)
+	if _, err := baseDB.ExecContext(ctx, query); err != nil {
+		return nil, fmt.Errorf("failed to create instance schema %s: %w", testConf.Schema, err)
+	}
+	defer dropSchemaIfFailed(ctx, baseDB, testConf.Schema, &final)
+	db, err := testConf.Connect()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to instance schema %s: %w", testConf.Schema, err)
+	}
+	defer db.Close()
+	if err := migrator.Migrate(ctx, db, testConf); err != nil {
+		return nil, fmt.Errorf("failed to migrator.Migrate instance schema %s: %w", testConf.Schema, err)
+	}
+	return &testConf, nil
+}
+
+// dropSchemaIfFailed drops an instance schema if migrating it failed, like
+// dropIfFailed does for instance databases. An error dropping it is added to
+// the original error.
+func dropSchemaIfFailed(ctx context.Context, baseDB *sql.DB, schema string, final *error) {
+	if *final == nil {
+		return
+	}
+	query := fmt.Sprintf(`DROP SCHEMA IF EXISTS "%s" CASCADE`, schema)
+	if _, err := baseDB.ExecContext(ctx, query); err != nil {
+		*final = fmt.Errorf("%w (and failed to drop instance schema %s: %s)", *final, schema, err)
+	}
+}
+
+// schemaIsCopyable returns true if the schema contains only tables, indexes,
+// and sequences, which are the objects that copySchema knows how to copy. The
+// row types that postgres creates for each table are copied along with the
+// table, but any other type, including user composite types, is not.
+func schemaIsCopyable(ctx context.Context, baseDB *sql.DB, schema string) (bool, error) {
+	query := `SELECT
+		(SELECT count(*) FROM pg_class
+			WHERE relnamespace = n.oid AND relkind NOT IN ('r', 'i', 'S'))
+		+ (SELECT count(*) FROM pg_proc WHERE pronamespace = n.oid)
+		+ (SELECT count(*) FROM pg_type t
+			WHERE t.typnamespace = n.oid AND t.typcategory <> 'A'
+			AND NOT EXISTS (SELECT FROM pg_class c WHERE c.reltype = t.oid AND c.relkind <> 'c'))
+		+ (SELECT count(*) FROM pg_trigger t JOIN pg_class c ON c.oid = t.tgrelid
+			WHERE c.relnamespace = n.oid AND NOT t.tgisinternal)
+		+ (SELECT count(*) FROM pg_policy p JOIN pg_class c ON c.oid = p.polrelid
+			WHERE c.relnamespace = n.oid)
+		+ (SELECT count(*) FROM pg_class
+			WHERE relnamespace = n.oid AND relkind = 'r' AND relrowsecurity)
+	FROM pg_namespace n WHERE n.nspname = $1`
+	var unsupported int
+	if err := baseDB.QueryRowContext(ctx, query, schema).Scan(&unsupported); err != nil {
+		return false, fmt.Errorf("failed to inspect template schema %s: %w", schema, err)
+	}
+	return unsupported == 0, nil
+}
+
+// copySchema copies the tables, indexes, sequences, and data of one schema
+// into a new schema, in a single transaction. References from column defaults
+// and foreign keys to objects in the old schema are rewritten to refer to the
+// new schema.
+func copySchema(ctx context.Context, baseDB *sql.DB, from, to string) error {
+	tx, err := baseDB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin copying schema %s: %w", from, err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// Queries run with the default search_path, so pg_get_expr and
+	// pg_get_constraintdef qualify references to the old schema with its
+	// name, which is a plain identifier.
+	rewrite := func(expr string) string {
+		return strings.ReplaceAll(expr, from+".", fmt.Sprintf(`"%s".`, to))
+	}
+	exec := func(query string, args ...any) error {
+		_, err := tx.ExecContext(ctx, query, args...)
+		return err
+	}
+	if err := exec(fmt.Sprintf(`CREATE SCHEMA "%s"`, to)); err != nil {
+		return fmt.Errorf("failed to create instance schema %s: %w", to, err)
+	}
+
+	// Sequences, except for those that belong to identity columns, which are
+	// created along with their tables.
+	sequences, err := queryStrings(ctx, tx, `SELECT format(
+			'CREATE SEQUENCE %I.%I AS %s INCREMENT BY %s MINVALUE %s MAXVALUE %s START WITH %s CACHE %s %s',
+			$2::text, s.sequencename, s.data_type, s.increment_by, s.min_value,
+			s.max_value, s.start_value, s.cache_size,
+			CASE WHEN s.cycle THEN 'CYCLE' ELSE 'NO CYCLE' END
+		)
+		FROM pg_sequences s
+		JOIN pg_namespace n ON n.nspname = s.schemaname
+		JOIN pg_class c ON c.relnamespace = n.oid AND c.relname = s.sequencename
+		WHERE s.schemaname = $1
+		AND NOT EXISTS (
+			SELECT FROM pg_depend d
+			WHERE d.classid = 'pg_class'::regclass AND d.objid = c.oid AND d.deptype = 'i'
+		)
+		ORDER BY s.sequencename`, from, to)
+	if err != nil {
+		return fmt.Errorf("failed to list sequences in schema %s: %w", from, err)
+	}
+	for _, query := range sequences {
+		if err := exec(query); err != nil {
+			return fmt.Errorf("failed to copy sequence: %w", err)
+		}
+	}
+
+	// Tables, with their columns, defaults, identities, constraints other
+	// than foreign keys, indexes, and comments.
+	tables, err := queryStrings(ctx, tx, `SELECT c.relname FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = $1 AND c.relkind = 'r'
+		ORDER BY c.relname`, from)
+	if err != nil {
+		return fmt.Errorf("failed to list tables in schema %s: %w", from, err)
+	}
+	for _, table := range tables {
+		query := fmt.Sprintf(`CREATE TABLE "%s"."%s" (LIKE "%s"."%s" INCLUDING ALL)`, to, table, from, table)
+		if err := exec(query); err != nil {
+			return fmt.Errorf("failed to copy table %s: %w", table, err)
+		}
+	}
+
+	// Column defaults that refer to the old schema, like nextval() of a
+	// serial column's sequence.
+	defaults, err := queryStrings(ctx, tx, `SELECT format(
+			'ALTER TABLE %I.%I ALTER COLUMN %I SET DEFAULT %s',
+			$2::text, c.relname, a.attname, pg_get_expr(d.adbin, d.adrelid)
+		)
+		FROM pg_attrdef d
+		JOIN pg_class c ON c.oid = d.adrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		JOIN pg_attribute a ON a.attrelid = d.adrelid AND a.attnum = d.adnum
+		WHERE n.nspname = $1 AND a.attgenerated = ''
+		AND strpos(pg_get_expr(d.adbin, d.adrelid), $1 || '.') > 0`, from, to)
+	if err != nil {
+		return fmt.Errorf("failed to list column defaults in schema %s: %w", from, err)
+	}
+	for _, query := range defaults {
+		if err := exec(rewrite(query)); err != nil {
+			return fmt.Errorf("failed to copy column default: %w", err)
+		}
+	}
+
+	// Sequences that belong to serial columns.
+	owners, err := queryStrings(ctx, tx, `SELECT format(
+			'ALTER SEQUENCE %I.%I OWNED BY %I.%I.%I',
+			$2::text, s.relname, $2::text, t.relname, a.attname
+		)
+		FROM pg_depend d
+		JOIN pg_class s ON s.oid = d.objid
+		JOIN pg_class t ON t.oid = d.refobjid
+		JOIN pg_attribute a ON a.attrelid = t.oid AND a.attnum = d.refobjsubid
+		JOIN pg_namespace n ON n.oid = s.relnamespace
+		WHERE d.classid = 'pg_class'::regclass AND d.refclassid = 'pg_class'::regclass
+		AND d.deptype = 'a' AND s.relkind = 'S' AND n.nspname = $1`, from, to)
+	if err != nil {
+		return fmt.Errorf("failed to list sequence owners in schema %s: %w", from, err)
+	}
+	for _, query := range owners {
+		if err := exec(query); err != nil {
+			return fmt.Errorf("failed to copy sequence owner: %w", err)
+		}
+	}
+
+	// Data, before the foreign keys are added so that the order of the
+	// tables doesn't matter. Generated columns are computed again.
+	for _, table := range tables {
+		var columns string
+		query := `SELECT coalesce(string_agg(quote_ident(attname), ', ' ORDER BY attnum), '')
+			FROM pg_attribute
+			WHERE attrelid = $1::regclass AND attnum > 0 AND NOT attisdropped AND attgenerated = ''`
+		if err := tx.QueryRowContext(ctx, query, fmt.Sprintf(`"%s"."%s"`, from, table)).Scan(&columns); err != nil {
+			return fmt.Errorf("failed to list columns of table %s: %w", table, err)
+		}
+		if columns == "" {
+			continue
+		}
+		query = fmt.Sprintf(
+			`INSERT INTO "%s"."%s" (%s) OVERRIDING SYSTEM VALUE SELECT %s FROM "%s"."%s"`,
+			to, table, columns, columns, from, table,
+		)
+		if err := exec(query); err != nil {
+			return fmt.Errorf("failed to copy rows of table %s: %w", table, err)
+		}
+	}
+
+	// The current values of every sequence, including those of identity
+	// columns, which are named the same way in both schemas.
+	values, err := queryStrings(ctx, tx, `SELECT format(
+			'SELECT setval(%L, %s)', format('%I.%I', $2::text, sequencename), last_value
+		)
+		FROM pg_sequences
+		WHERE schemaname = $1 AND last_value IS NOT NULL`, from, to)
+	if err != nil {
+		return fmt.Errorf("failed to list sequence values in schema %s: %w", from, err)
+	}
+	for _, query := range values {
+		if err := exec(query); err != nil {
+			return fmt.Errorf("failed to copy sequence value: %w", err)
+		}
+	}
+
+	foreignKeys, err := queryStrings(ctx, tx, `SELECT format(
+			'ALTER TABLE %I.%I ADD CONSTRAINT %I %s',
+			$2::text, c.relname, con.conname, pg_get_constraintdef(con.oid)
+		)
+		FROM pg_constraint con
+		JOIN pg_class c ON c.oid = con.conrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = $1 AND con.contype = 'f'
+		ORDER BY c.relname, con.conname`, from, to)
+	if err != nil {
+		return fmt.Errorf("failed to list foreign keys in schema %s: %w", from, err)
+	}
+	for _, query := range foreignKeys {
+		if err := exec(rewrite(query)); err != nil {
+			return fmt.Errorf("failed to copy foreign key: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to finish copying schema %s: %w", from, err)
+	}
+	return nil
+}
+
+// queryStrings returns the first column of every row returned by a query.
+func queryStrings(ctx context.Context, tx *sql.Tx, query string, args ...any) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []string
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
@@ -0,0 +1,169 @@
+package pgtestdb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxStackDepth is the most stack frames that are recorded each time a
+// tracked connection is used.
+const maxStackDepth = 32
+
+// connTracker records where each open connection to a test database was last
+// used, so that leaked connections can be traced back to the code that
+// leaked them. It is used when [Config.TrackConnections] is enabled.
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[*capturingConn]*trackedConn
+}
+
+// trackedConn is the last known use of a single connection.
+type trackedConn struct {
+	pid      int // the server's pid for the connection, or 0 if unknown
+	lastUsed time.Time
+	callers  []uintptr
+}
+
+func (ct *connTracker) add(conn *capturingConn, pid int) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if ct.conns == nil {
+		ct.conns = map[*capturingConn]*trackedConn{}
+	}
+	ct.conns[conn] = &trackedConn{pid: pid}
+}
+
+func (ct *connTracker) remove(conn *capturingConn) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	delete(ct.conns, conn)
+}
+
+// touch records the stack of the calling goroutine as the last use of the
+// connection.
+func (ct *connTracker) touch(conn *capturingConn) {
+	pcs := make([]uintptr, maxStackDepth)
+	pcs = pcs[:runtime.Callers(3, pcs)]
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if tracked, ok := ct.conns[conn]; ok {
+		tracked.lastUsed = time.Now()
+		tracked.callers = pcs
+	}
+}
+
+// open returns the connections that have not been closed, oldest first.
+func (ct *connTracker) open() []trackedConn {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	conns := make([]trackedConn, 0, len(ct.conns))
+	for _, tracked := range ct.conns {
+		conns = append(conns, *tracked)
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].lastUsed.Before(conns[j].lastUsed)
+	})
+	return conns
+}
+
+// stack formats the recorded stack in the same style as a goroutine dump,
+// leaving out the frames inside database/sql and pgtestdb's driver wrapper.
+func (tc trackedConn) stack() string {
+	if len(tc.callers) == 0 {
+		return "\t(never used)"
+	}
+	var b strings.Builder
+	frames := runtime.CallersFrames(tc.callers)
+	for {
+		frame, more := frames.Next()
+		if !isWrapperFrame(frame.Function) {
+			fmt.Fprintf(&b, "\t%s\n\t\t%s:%d\n", frame.Function, frame.File, frame.Line)
+		}
+		if !more {
+			break
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func isWrapperFrame(function string) bool {
+	return function == "" ||
+		function == "runtime.goexit" ||
+		strings.HasPrefix(function, "database/sql.") ||
+		strings.HasPrefix(function, "github.com/peterldowns/pgtestdb.(*capturing") ||
+		strings.HasPrefix(function, "github.com/peterldowns/pgtestdb.(*connTracker)")
+}
+
+// backendPID asks the server for the pid of the backend serving a newly
+// opened connection, so that the connection can be matched to its row in
+// pg_stat_activity. It returns 0 if the driver can't run the query directly.
+func backendPID(ctx context.Context, conn driver.Conn) int {
+	queryer, ok := conn.(driver.QueryerContext)
+	if !ok {
+		return 0
+	}
+	rows, err := queryer.QueryContext(ctx, "SELECT pg_backend_pid()", nil)
+	if err != nil {
+		return 0
+	}
+	defer rows.Close()
+	dest := make([]driver.Value, 1)
+	if err := rows.Next(dest); err != nil {
+		return 0
+	}
+	switch pid := dest[0].(type) {
+	case int64:
+		return int(pid)
+	case int32:
+		return int(pid)
+	default:
+		return 0
+	}
+}
+
+// logLeakedConnections logs the connections that are preventing a test
+// database from being dropped, and, if connections are being tracked, the Go
+// stack that last used each of them.
+func logLeakedConnections(t TB, baseDB *sql.DB, instance Config, tracker *connTracker) {
+	backends, err := listBackends(context.Background(), baseDB, instance.Database)
+	if err != nil {
+		t.Logf("pgtestdb: %s", err)
+	}
+	var tracked []trackedConn
+	if tracker != nil {
+		tracked = tracker.open()
+	}
+	stacks := map[int]trackedConn{}
+	for _, tc := range tracked {
+		if tc.pid != 0 {
+			stacks[tc.pid] = tc
+		}
+	}
+
+	t.Logf("pgtestdb: %d connection(s) to %s are still open:", len(backends), instance.Database)
+	for _, b := range backends {
+		t.Logf("  %s", b)
+		if tc, ok := stacks[b.PID]; ok {
+			t.Logf("  last used at %s by:\n%s", tc.lastUsed.Format(time.RFC3339Nano), tc.stack())
+			delete(stacks, b.PID)
+		}
+	}
+	// Connections whose pid couldn't be determined, or that the server has
+	// already stopped reporting, are still worth showing.
+	for _, tc := range tracked {
+		if _, matched := stacks[tc.pid]; tc.pid != 0 && !matched {
+			continue
+		}
+		t.Logf("  connection (pid=%d) last used at %s by:\n%s", tc.pid, tc.lastUsed.Format(time.RFC3339Nano), tc.stack())
+	}
+	if tracker == nil {
+		t.Logf("Set `TrackConnections = true` on your `pgtestdb.Config` to log where in your code each of these connections was last used.")
+	}
+}
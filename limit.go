@@ -0,0 +1,212 @@
+package pgtestdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/peterldowns/pgtestdb/internal/sessionlock"
+)
+
+const (
+	// DefaultMaxInstancesTimeout is how long a test waits for one of the
+	// [Config.MaxInstances] slots to be free, unless
+	// [Config.MaxInstancesTimeout] is set.
+	DefaultMaxInstancesTimeout = 5 * time.Minute
+	// instanceSlotsLockName identifies the advisory locks used as the slots
+	// of the MaxInstances semaphore. The slot number is the second key of
+	// each lock.
+	instanceSlotsLockName = "pgtestdb-instance-slots"
+	// waitLogInterval is how often a waiting test logs what it is waiting
+	// for, like the connections that hold the slots.
+	waitLogInterval = 10 * time.Second
+)
+
+// instanceSlotsKey returns the first key of the advisory locks used as slots,
+// the high 32 bits of the lock's ID. pg_try_advisory_lock(int, int) takes
+// signed integers, while pg_locks reports them as unsigned oids.
+func instanceSlotsKey() (int32, uint32) {
+	id := uint32(uint64(sessionlock.ID(instanceSlotsLockName)) >> 32)
+	return int32(id), id
+}
+
+// acquireInstanceSlot waits for one of the `conf.MaxInstances` slots to be
+// free and takes it, by holding an advisory lock on a dedicated connection to
+// the base database. Because the lock belongs to the connection, the slot is
+// released if the process exits without releasing it. While it waits, it logs
+// which connections hold the slots.
+//
+// If the [Config.Coordinator] limits base connections, the connection only
+// has permission while it waits, and it reconnects for each attempt rather
+// than keeping the permission for as long as it waits. Otherwise, waiting
+// tests could hold every permission while the tests holding slots wait for
+// one to drop their test databases.
+func acquireInstanceSlot(ctx context.Context, t TB, conf Config) (func(), error) {
+	timeout := conf.MaxInstancesTimeout
+	if timeout <= 0 {
+		timeout = DefaultMaxInstancesTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	_, limited := conf.Coordinator.(BaseConnCoordinator)
+	holder := conf
+	holder.Options = withApplicationName(conf.Options, slotHolderApplicationName(t))
+	var db *sql.DB
+	var conn *sql.Conn
+	releaseBaseConn := func() {}
+	closeAll := func() {
+		if conn != nil {
+			_ = conn.Close()
+			conn = nil
+		}
+		if db != nil {
+			_ = db.Close()
+			db = nil
+		}
+		releaseBaseConn()
+		releaseBaseConn = func() {}
+	}
+	connect := func() error {
+		var err error
+		releaseBaseConn, err = conf.acquireBaseConn(ctx)
+		if err != nil {
+			releaseBaseConn = func() {}
+			return err
+		}
+		db, err = holder.Connect()
+		if err != nil {
+			return fmt.Errorf("failed to connect to database: %w", err)
+		}
+		conn, err = db.Conn(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to connect to database: %w", err)
+		}
+		return nil
+	}
+
+	key, _ := instanceSlotsKey()
+	query := `SELECT slot FROM generate_series(0, $2::int - 1) AS slot
+		WHERE pg_try_advisory_lock($1::int, slot)
+		LIMIT 1`
+	start := time.Now()
+	lastLog := time.Time{}
+	wait := 10 * time.Millisecond
+	for {
+		if conn == nil {
+			if err := connect(); err != nil {
+				closeAll()
+				if ctx.Err() != nil {
+					return nil, timeoutError(conf, timeout)
+				}
+				return nil, err
+			}
+		}
+		var slot int
+		err := conn.QueryRowContext(ctx, query, key, conf.MaxInstances).Scan(&slot)
+		if err == nil {
+			// From now on the connection is limited by MaxInstances.
+			releaseBaseConn()
+			releaseBaseConn = func() {}
+			if !lastLog.IsZero() {
+				t.Logf("pgtestdb: acquired test database slot %d after waiting %s", slot, time.Since(start).Round(time.Millisecond))
+			}
+			return func() {
+				// Closing the connection would release the lock anyway, but
+				// unlocking first releases it even if the pool keeps the
+				// connection open.
+				_, _ = conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1::int, $2::int)", key, slot)
+				closeAll()
+			}, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			closeAll()
+			if ctx.Err() != nil {
+				return nil, timeoutError(conf, timeout)
+			}
+			return nil, fmt.Errorf("failed to acquire a test database slot: %w", err)
+		}
+		if time.Since(lastLog) >= waitLogInterval {
+			lastLog = time.Now()
+			t.Logf("pgtestdb: waiting for one of the %d test database slots (MaxInstances) to be free; held by:", conf.MaxInstances)
+			for _, holder := range listSlotHolders(ctx, conn) {
+				t.Logf("  %s", holder)
+			}
+		}
+		if limited {
+			closeAll()
+		}
+		select {
+		case <-ctx.Done():
+			closeAll()
+			return nil, timeoutError(conf, timeout)
+		case <-time.After(wait):
+		}
+		wait = min(2*wait, time.Second)
+	}
+}
+
+// acquireBaseConn waits for permission to connect to the base database, if
+// the [Config.Coordinator] limits base connections, and returns a function
+// that gives the permission back.
+func (c Config) acquireBaseConn(ctx context.Context) (func(), error) {
+	coordinator, ok := c.Coordinator.(BaseConnCoordinator)
+	if !ok {
+		return func() {}, nil
+	}
+	release, err := coordinator.AcquireBaseConn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not acquire permission to connect to the base database: %w", err)
+	}
+	return release, nil
+}
+
+func timeoutError(conf Config, timeout time.Duration) error {
+	return fmt.Errorf(
+		"timed out after %s waiting for one of the %d test database slots (MaxInstances) to be free; "+
+			"increase MaxInstancesTimeout or MaxInstances, or check for tests that create many databases",
+		timeout, conf.MaxInstances,
+	)
+}
+
+// listSlotHolders describes the connections that hold slots, for logging. Any
+// error is reported as the only holder, since it's only used for logging.
+func listSlotHolders(ctx context.Context, conn *sql.Conn) []string {
+	_, key := instanceSlotsKey()
+	query := `SELECT format('slot %s: pid=%s application_name=%L backend_start=%s',
+			l.objid, a.pid, a.application_name, a.backend_start)
+		FROM pg_locks l
+		JOIN pg_stat_activity a ON a.pid = l.pid
+		WHERE l.locktype = 'advisory'
+		AND l.classid = $1
+		AND l.objsubid = 2
+		AND l.granted
+		ORDER BY l.objid`
+	rows, err := conn.QueryContext(ctx, query, int64(key))
+	if err != nil {
+		return []string{fmt.Sprintf("(failed to list slot holders: %s)", err)}
+	}
+	defer rows.Close()
+	var holders []string
+	for rows.Next() {
+		var holder string
+		if err := rows.Scan(&holder); err != nil {
+			return []string{fmt.Sprintf("(failed to list slot holders: %s)", err)}
+		}
+		holders = append(holders, holder)
+	}
+	if err := rows.Err(); err != nil {
+		return []string{fmt.Sprintf("(failed to list slot holders: %s)", err)}
+	}
+	return holders
+}
+
+// slotHolderApplicationName is set on the connections that hold slots, so
+// that they can be told apart from other connections in pg_stat_activity.
+func slotHolderApplicationName(t TB) string {
+	name := strings.TrimSpace("pgtestdb slot " + testName(t))
+	return truncateIdentifier(name)
+}
@@ -36,6 +36,11 @@ func (m *DirMigrator) Hash() (string, error) {
 	return common.HashDir(m.MigrationsDirPath)
 }
 
+// Manifest returns a record of the inputs to Hash.
+func (m *DirMigrator) Manifest() (common.Manifest, error) {
+	return common.ManifestDirs(nil, "*.sql", m.MigrationsDirPath)
+}
+
 // Migrate shells out to the `atlas` CLI program to migrate the template
 // database.
 //
@@ -35,6 +35,11 @@ func (m *SchemaMigrator) Hash() (string, error) {
 	return common.HashFile(m.SchemaFilePath)
 }
 
+// Manifest returns a record of the inputs to Hash.
+func (m *SchemaMigrator) Manifest() (common.Manifest, error) {
+	return common.ManifestFiles(nil, m.SchemaFilePath)
+}
+
 // Migrate shells out to the `atlas` CLI program to migrate the template
 // database.
 //
@@ -42,3 +42,15 @@ func TestSchemaMigrator(t *testing.T) {
 	assert.Nil(t, err)
 	check.Equal(t, 0, numBlogPosts)
 }
+
+func TestSchemaMigratorMatchesDirMigrator(t *testing.T) {
+	t.Parallel()
+	pgtestdb.CompareMigrators(t, pgtestdb.Config{
+		DriverName: "pgx",
+		Host:       "localhost",
+		User:       "postgres",
+		Password:   "password",
+		Port:       "5433",
+		Options:    "sslmode=disable",
+	}, atlasmigrator.NewSchemaMigrator("schema.hcl"), atlasmigrator.NewDirMigrator("migrations"))
+}
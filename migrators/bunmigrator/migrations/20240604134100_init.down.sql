@@ -0,0 +1,3 @@
+DROP TABLE public.blog_posts;
+
+DROP TABLE public.users;
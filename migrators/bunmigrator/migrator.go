@@ -14,7 +14,10 @@ import (
 	"github.com/peterldowns/pgtestdb/migrators/common"
 )
 
-var _ pgtestdb.Migrator = (*BunMigrator)(nil)
+var (
+	_ pgtestdb.StepMigrator     = (*BunMigrator)(nil)
+	_ pgtestdb.ManifestMigrator = (*BunMigrator)(nil)
+)
 
 // Option provides a way to configure the BunMigrator struct and its behaviour.
 //
@@ -95,8 +98,66 @@ func (bm *BunMigrator) Hash() (string, error) {
 	return common.HashDirs(bm.FS, "*.sql", bm.MigrationsDir)
 }
 
+// Manifest returns a record of the inputs to Hash.
+func (bm *BunMigrator) Manifest() (common.Manifest, error) {
+	return common.ManifestDirs(bm.FS, "*.sql", bm.MigrationsDir)
+}
+
 // Migrate migrates the template database.
 func (bm *BunMigrator) Migrate(ctx context.Context, sqldb *sql.DB, _ pgtestdb.Config) error {
+	m, err := bm.migrator(ctx, sqldb)
+	if err != nil {
+		return err
+	}
+	// Apply the migrations.
+	if _, err := m.Migrate(ctx, bm.MigrationOpts...); err != nil {
+		return err
+	}
+	return nil
+}
+
+// StepUp applies the next unapplied migration and returns its name.
+//
+// Each migration is applied as its own migration group, so that StepDown
+// (which rolls back the most recent group) reverts only that migration.
+func (bm *BunMigrator) StepUp(ctx context.Context, sqldb *sql.DB, _ pgtestdb.Config) (string, error) {
+	m, err := bm.migrator(ctx, sqldb)
+	if err != nil {
+		return "", err
+	}
+	migrations, err := m.MigrationsWithStatus(ctx)
+	if err != nil {
+		return "", err
+	}
+	unapplied := migrations.Unapplied()
+	if len(unapplied) == 0 {
+		return "", nil
+	}
+	migration := &unapplied[0]
+	migration.GroupID = migrations.LastGroupID() + 1
+	if migration.Up != nil {
+		if err := migration.Up(ctx, m.DB()); err != nil {
+			return "", err
+		}
+	}
+	if err := m.MarkApplied(ctx, migration); err != nil {
+		return "", err
+	}
+	return migration.Name, nil
+}
+
+// StepDown rolls back the most recently applied migration group.
+func (bm *BunMigrator) StepDown(ctx context.Context, sqldb *sql.DB, _ pgtestdb.Config) error {
+	m, err := bm.migrator(ctx, sqldb)
+	if err != nil {
+		return err
+	}
+	_, err = m.Rollback(ctx, bm.MigrationOpts...)
+	return err
+}
+
+// migrator discovers the migrations and returns an initialized bun migrator.
+func (bm *BunMigrator) migrator(ctx context.Context, sqldb *sql.DB) (*migrate.Migrator, error) {
 	var err error
 	migrations := migrate.NewMigrations()
 	if bm.FS == nil {
@@ -105,19 +166,14 @@ func (bm *BunMigrator) Migrate(ctx context.Context, sqldb *sql.DB, _ pgtestdb.Co
 		err = migrations.Discover(bm.FS)
 	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 	db := bun.NewDB(sqldb, pgdialect.New(), bm.BunDBOpts...)
 	m := migrate.NewMigrator(db, migrations, bm.MigratorOpts...)
 	// Initialize the bun migrator, creating the tables that keep track of which
 	// migrations have been applied.
-	err = m.Init(ctx)
-	if err != nil {
-		return err
+	if err := m.Init(ctx); err != nil {
+		return nil, err
 	}
-	// Apply the migrations.
-	if _, err := m.Migrate(ctx, bm.MigrationOpts...); err != nil {
-		return err
-	}
-	return nil
+	return m, nil
 }
@@ -91,3 +91,16 @@ func TestMigrateFromDisk(t *testing.T) {
 	assert.Nil(t, err)
 	check.Equal(t, 0, numBlogPosts)
 }
+
+func TestBunMigratorIsReversible(t *testing.T) {
+	t.Parallel()
+	bm := bunmigrator.New("migrations")
+	pgtestdb.CheckReversible(t, pgtestdb.Config{
+		DriverName: "pg",
+		Host:       "localhost",
+		User:       "postgres",
+		Password:   "password",
+		Port:       "5433",
+		Options:    "sslmode=disable",
+	}, bm)
+}
@@ -7,6 +7,9 @@ import (
 	hashlib "hash"
 	"io/fs"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
 )
 
 // NewRecursiveHash creates a new [RecursiveHash], and adds any of the given fields
@@ -21,7 +24,17 @@ import (
 //	_ = hash.Add([]byte("world"))
 //	out, _ := hash.String()
 func NewRecursiveHash(fields ...HashField) RecursiveHash {
-	hash := RecursiveHash{md5.New()}
+	hash := RecursiveHash{Hash: md5.New()}
+	hash.AddFields(fields...)
+	return hash
+}
+
+// NewRecursiveHashWithManifest is like [NewRecursiveHash], but the hash also
+// records a [Manifest] of every input that is added to it, which can be used
+// to explain why two hashes are different. The result of String() is the
+// same as that of a hash created with [NewRecursiveHash] from the same inputs.
+func NewRecursiveHashWithManifest(fields ...HashField) RecursiveHash {
+	hash := RecursiveHash{Hash: md5.New(), manifest: &Manifest{}}
 	hash.AddFields(fields...)
 	return hash
 }
@@ -30,20 +43,29 @@ func NewRecursiveHash(fields ...HashField) RecursiveHash {
 // added to the hash, it will update itself to include the hash of all previous
 // contents. This is good for hashing multiple migration files. The interface is slightly
 // easier to use than constructing an md5 hash on your own.
+//
+// A RecursiveHash created with [NewRecursiveHashWithManifest] also records a
+// [Manifest] of the inputs that were added to it.
 type RecursiveHash struct {
 	hashlib.Hash
+	manifest *Manifest
 }
 
 // Add updates the hash with the hash of new content.
 func (h RecursiveHash) Add(bytes []byte) {
-	if _, err := fmt.Fprintf(h, "%x=%x\n", h.Sum(nil), md5.Sum(bytes)); err != nil {
-		panic(err)
-	}
+	h.add(ManifestEntry{Kind: "data"}, bytes)
 }
 
 // AddField updates the hash with the hash of a new field.
 func (h RecursiveHash) AddField(key string, value any) {
-	h.Add([]byte(fmt.Sprintf("%s=%v", key, value)))
+	h.add(ManifestEntry{Kind: "field", Name: key}, []byte(fmt.Sprintf("%s=%v", key, value)))
+}
+
+// AddNestedField updates the hash with the hash of a new field whose value is
+// itself the result of another [RecursiveHash], exactly like AddField, and
+// records that hash's manifest as the inputs of the field.
+func (h RecursiveHash) AddNestedField(key string, value string, manifest Manifest) {
+	h.add(ManifestEntry{Kind: "field", Name: key, Children: manifest}, []byte(key+"="+value))
 }
 
 // AddFields updates the hash with the hash of multiple fields at once.
@@ -54,23 +76,72 @@ func (h RecursiveHash) AddFields(fields ...HashField) {
 }
 
 func (h RecursiveHash) AddFiles(base fs.FS, paths ...string) error {
-	filesHash, err := HashFiles(base, paths...)
-	if err != nil {
+	files := h.nested()
+	if err := files.addFiles(base, paths...); err != nil {
 		return err
 	}
-	h.Add([]byte(filesHash))
+	h.add(ManifestEntry{Kind: "files", Children: files.Manifest()}, []byte(files.String()))
 	return nil
 }
 
 func (h RecursiveHash) AddDirs(base fs.FS, pattern string, dirs ...string) error {
-	dirsHash, err := HashDirs(base, pattern, dirs...)
-	if err != nil {
+	dirsHash := h.nested()
+	if err := dirsHash.addDirs(base, pattern, dirs...); err != nil {
+		return err
+	}
+	h.add(ManifestEntry{Kind: "dirs", Children: dirsHash.Manifest()}, []byte(dirsHash.String()))
+	return nil
+}
+
+func (h RecursiveHash) AddTree(base fs.FS, include, exclude []string, dirs ...string) error {
+	tree := h.nested()
+	if err := tree.addTree(base, include, exclude, dirs...); err != nil {
 		return err
 	}
-	h.Add([]byte(dirsHash))
+	h.add(ManifestEntry{Kind: "tree", Children: tree.Manifest()}, []byte(tree.String()))
 	return nil
 }
 
+// nested returns a new hash for content that will be added to this one. It
+// records a manifest if this one does.
+func (h RecursiveHash) nested() RecursiveHash {
+	if h.manifest == nil {
+		return NewRecursiveHash()
+	}
+	return NewRecursiveHashWithManifest()
+}
+
+// Manifest returns a record of every input that has been added to the hash so
+// far, in order. It is nil unless the hash was created with
+// [NewRecursiveHashWithManifest].
+func (h RecursiveHash) Manifest() Manifest {
+	if h.manifest == nil {
+		return nil
+	}
+	return append(Manifest{}, *h.manifest...)
+}
+
+// add updates the hash with the hash of new content, and records it in the
+// manifest, if there is one.
+func (h RecursiveHash) add(entry ManifestEntry, bytes []byte) {
+	digest := md5.Sum(bytes)
+	h.write(digest[:])
+	if h.manifest == nil {
+		return
+	}
+	entry.Digest = hex.EncodeToString(digest[:])
+	*h.manifest = append(*h.manifest, entry)
+}
+
+// write updates the hash with an already-computed digest, without recording
+// anything in the manifest.
+func (h RecursiveHash) write(digest []byte) {
+	if _, err := fmt.Fprintf(h, "%x=%x\n", h.Sum(nil), digest); err != nil {
+		panic(err)
+	}
+}
+
+// String returns the hex-encoded hash.
 func (h RecursiveHash) String() string {
 	return hex.EncodeToString(h.Sum(nil))
 }
@@ -98,9 +169,26 @@ type HashField struct {
 //	HashFiles(nil, "0001_initial.sql", "0002_users.up.sql")
 //	HashDirs(embeddedFS, "migrations/0001_initial.sql")
 func HashFiles(base fs.FS, paths ...string) (string, error) {
+	hash := NewRecursiveHash()
+	if err := hash.addFiles(base, paths...); err != nil {
+		return "", err
+	}
+	return hash.String(), nil
+}
+
+// ManifestFiles returns the [Manifest] of the inputs to [HashFiles] with the
+// same arguments.
+func ManifestFiles(base fs.FS, paths ...string) (Manifest, error) {
+	hash := NewRecursiveHashWithManifest()
+	if err := hash.addFiles(base, paths...); err != nil {
+		return nil, err
+	}
+	return hash.Manifest(), nil
+}
+
+func (h RecursiveHash) addFiles(base fs.FS, paths ...string) error {
 	var err error
 	var contents []byte
-	hash := NewRecursiveHash()
 	for _, path := range paths {
 		if base == nil {
 			contents, err = os.ReadFile(path)
@@ -108,11 +196,11 @@ func HashFiles(base fs.FS, paths ...string) (string, error) {
 			contents, err = fs.ReadFile(base, path)
 		}
 		if err != nil {
-			return "", err
+			return err
 		}
-		hash.Add(contents)
+		h.add(ManifestEntry{Kind: "file", Name: filepath.ToSlash(path)}, contents)
 	}
-	return hash.String(), nil
+	return nil
 }
 
 // HashDirs will return as unique hash based on the contents of all files that
@@ -125,8 +213,25 @@ func HashFiles(base fs.FS, paths ...string) (string, error) {
 //	HashDirs(nil, "*.sql", "migrations/old", "migrations/current")
 //	HashDirs(embeddedFS, "*.sql", ".")
 func HashDirs(base fs.FS, pattern string, dirs ...string) (string, error) {
-	var dir fs.FS
 	hash := NewRecursiveHash()
+	if err := hash.addDirs(base, pattern, dirs...); err != nil {
+		return "", err
+	}
+	return hash.String(), nil
+}
+
+// ManifestDirs returns the [Manifest] of the inputs to [HashDirs] with the
+// same arguments.
+func ManifestDirs(base fs.FS, pattern string, dirs ...string) (Manifest, error) {
+	hash := NewRecursiveHashWithManifest()
+	if err := hash.addDirs(base, pattern, dirs...); err != nil {
+		return nil, err
+	}
+	return hash.Manifest(), nil
+}
+
+func (h RecursiveHash) addDirs(base fs.FS, pattern string, dirs ...string) error {
+	var dir fs.FS
 	for _, path := range dirs {
 		if base == nil {
 			dir = os.DirFS(path)
@@ -134,22 +239,22 @@ func HashDirs(base fs.FS, pattern string, dirs ...string) (string, error) {
 			var err error
 			dir, err = fs.Sub(base, path)
 			if err != nil {
-				return "", err
+				return err
 			}
 		}
 		entries, err := fs.Glob(dir, pattern)
 		if err != nil {
-			return "", err
+			return err
 		}
 		for _, entry := range entries {
 			contents, err := fs.ReadFile(dir, entry)
 			if err != nil {
-				return "", err
+				return err
 			}
-			hash.Add(contents)
+			h.add(ManifestEntry{Kind: "file", Name: filepath.ToSlash(filepath.Join(path, entry))}, contents)
 		}
 	}
-	return hash.String(), nil
+	return nil
 }
 
 // Returns a unique hash based on the contents of any "*.sql" files found in the
@@ -162,3 +267,157 @@ func HashDir(pathToDir string) (string, error) {
 func HashFile(pathToFile string) (string, error) {
 	return HashFiles(nil, pathToFile)
 }
+
+// HashTree will return a unique hash based on every file beneath any of the
+// given directories whose path matches at least one of the `include` patterns
+// and none of the `exclude` patterns. If `include` is empty, every file is
+// included. If `base` is nil, it will read the directories and files from the
+// real file system.
+//
+// Unlike [HashDirs], HashTree walks each directory recursively, and it hashes
+// the relative path and mode of each file along with its contents, so renaming
+// `0002_a.sql` to `0003_a.sql` will change the result. Patterns are matched
+// with [MatchGlob] against the slash-separated path of each file relative to
+// the directory being walked, and modes are normalized the same way git
+// normalizes them, so the result is the same on every operating system.
+//
+// Examples:
+//
+//	HashTree(nil, []string{"**/*.sql"}, nil, "migrations")
+//	HashTree(nil, []string{"**/*.sql"}, []string{"old/**"}, "db/migrations")
+//	HashTree(embeddedFS, nil, []string{"**/*.md"}, ".")
+func HashTree(base fs.FS, include, exclude []string, dirs ...string) (string, error) {
+	hash := NewRecursiveHash()
+	if err := hash.addTree(base, include, exclude, dirs...); err != nil {
+		return "", err
+	}
+	return hash.String(), nil
+}
+
+// ManifestTree returns the [Manifest] of the inputs to [HashTree] with the
+// same arguments.
+func ManifestTree(base fs.FS, include, exclude []string, dirs ...string) (Manifest, error) {
+	hash := NewRecursiveHashWithManifest()
+	if err := hash.addTree(base, include, exclude, dirs...); err != nil {
+		return nil, err
+	}
+	return hash.Manifest(), nil
+}
+
+func (h RecursiveHash) addTree(base fs.FS, include, exclude []string, dirs ...string) error {
+	for _, pattern := range append(append([]string{}, include...), exclude...) {
+		if _, err := MatchGlob(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	var dir fs.FS
+	for _, root := range dirs {
+		if base == nil {
+			dir = os.DirFS(root)
+		} else {
+			var err error
+			dir, err = fs.Sub(base, path.Clean(filepath.ToSlash(root)))
+			if err != nil {
+				return err
+			}
+		}
+		err := fs.WalkDir(dir, ".", func(name string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if entry.IsDir() || !matchesAny(include, name, true) || matchesAny(exclude, name, false) {
+				return nil
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			contents, err := fs.ReadFile(dir, name)
+			if err != nil {
+				return err
+			}
+			mode := normalizeMode(info.Mode())
+			header := md5.Sum([]byte(fmt.Sprintf("%s %s", mode, name)))
+			h.write(header[:])
+			h.add(ManifestEntry{
+				Kind: "file",
+				Name: path.Join(path.Clean(filepath.ToSlash(root)), name),
+				Mode: mode,
+			}, contents)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MatchGlob reports whether `name`, a slash-separated path, matches `pattern`.
+// Each segment of the pattern is matched with [path.Match], except for `**`,
+// which matches any number of segments (including zero).
+//
+// Examples:
+//
+//	MatchGlob("*.sql", "0001_init.sql")             // true
+//	MatchGlob("*.sql", "nested/0001_init.sql")      // false
+//	MatchGlob("**/*.sql", "nested/0001_init.sql")   // true
+//	MatchGlob("nested/**", "nested/deeper/foo.sql") // true
+func MatchGlob(pattern, name string) (bool, error) {
+	// Check the pattern up front so that a malformed pattern is reported even
+	// when matching would otherwise short-circuit.
+	for _, segment := range strings.Split(pattern, "/") {
+		if _, err := path.Match(segment, ""); err != nil {
+			return false, err
+		}
+	}
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/")), nil
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// matchesAny reports whether `name` matches any of the patterns, or returns
+// `empty` if there are no patterns at all.
+func matchesAny(patterns []string, name string, empty bool) bool {
+	if len(patterns) == 0 {
+		return empty
+	}
+	for _, pattern := range patterns {
+		if ok, _ := MatchGlob(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeMode returns the mode of a file the way that git records it, so
+// that differences in umask or operating system do not change the hash.
+func normalizeMode(mode fs.FileMode) string {
+	switch {
+	case mode&fs.ModeSymlink != 0:
+		return "120000"
+	case mode.Perm()&0o111 != 0:
+		return "100755"
+	default:
+		return "100644"
+	}
+}
@@ -1,9 +1,14 @@
 package common_test
 
 import (
+	"os"
+	"path/filepath"
+	"sort"
 	"testing"
+	"testing/fstest"
 
 	"github.com/peterldowns/testy/assert"
+	"github.com/peterldowns/testy/check"
 
 	"github.com/peterldowns/pgtestdb/migrators/common"
 )
@@ -36,3 +41,198 @@ func TestRecursivityOfFields(t *testing.T) {
 	)
 	assert.NotEqual(t, hash1.String(), hash2.String())
 }
+
+func TestMatchGlob(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"*.sql", "0001_init.sql", true},
+		{"*.sql", "nested/0001_init.sql", false},
+		{"**/*.sql", "0001_init.sql", true},
+		{"**/*.sql", "nested/0001_init.sql", true},
+		{"**/*.sql", "nested/deeper/0001_init.sql", true},
+		{"**/*.sql", "nested/README.md", false},
+		{"nested/**", "nested/deeper/foo.sql", true},
+		{"nested/**", "other/foo.sql", false},
+		{"a/**/b/*.sql", "a/b/foo.sql", true},
+		{"a/**/b/*.sql", "a/x/y/b/foo.sql", true},
+		{"a/**/b/*.sql", "a/x/y/c/foo.sql", false},
+		{"**", "anything/at/all", true},
+	}
+	for _, tc := range cases {
+		match, err := common.MatchGlob(tc.pattern, tc.name)
+		if check.Nil(t, err) && !check.Equal(t, tc.match, match) {
+			t.Logf("pattern=%q name=%q", tc.pattern, tc.name)
+		}
+	}
+	_, err := common.MatchGlob("[", "foo")
+	check.Error(t, err)
+}
+
+func TestHashTreeIsRecursive(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{
+		"migrations/0001_init.sql":        {Data: []byte("CREATE TABLE a ();")},
+		"migrations/nested/0002_cats.sql": {Data: []byte("CREATE TABLE cats ();")},
+	}
+	flat, err := common.HashTree(fsys, []string{"*.sql"}, nil, "migrations")
+	assert.Nil(t, err)
+	recursive, err := common.HashTree(fsys, []string{"**/*.sql"}, nil, "migrations")
+	assert.Nil(t, err)
+	check.NotEqual(t, flat, recursive)
+
+	fsys["migrations/nested/0002_cats.sql"] = &fstest.MapFile{Data: []byte("CREATE TABLE dogs ();")}
+	changed, err := common.HashTree(fsys, []string{"**/*.sql"}, nil, "migrations")
+	assert.Nil(t, err)
+	check.NotEqual(t, recursive, changed)
+}
+
+func TestHashTreeIncludesNames(t *testing.T) {
+	t.Parallel()
+	before := fstest.MapFS{"0002_a.sql": {Data: []byte("SELECT 1;")}}
+	after := fstest.MapFS{"0003_a.sql": {Data: []byte("SELECT 1;")}}
+	beforeHash, err := common.HashTree(before, nil, nil, ".")
+	assert.Nil(t, err)
+	afterHash, err := common.HashTree(after, nil, nil, ".")
+	assert.Nil(t, err)
+	check.NotEqual(t, beforeHash, afterHash)
+
+	// HashDirs only considers contents, so it cannot tell the difference.
+	beforeDirs, err := common.HashDirs(before, "*.sql", ".")
+	assert.Nil(t, err)
+	afterDirs, err := common.HashDirs(after, "*.sql", ".")
+	assert.Nil(t, err)
+	check.Equal(t, beforeDirs, afterDirs)
+}
+
+func TestHashTreeIncludesModes(t *testing.T) {
+	t.Parallel()
+	regular := fstest.MapFS{"run.sh": {Data: []byte("echo hi"), Mode: 0o644}}
+	executable := fstest.MapFS{"run.sh": {Data: []byte("echo hi"), Mode: 0o755}}
+	readonly := fstest.MapFS{"run.sh": {Data: []byte("echo hi"), Mode: 0o444}}
+	regularHash, err := common.HashTree(regular, nil, nil, ".")
+	assert.Nil(t, err)
+	executableHash, err := common.HashTree(executable, nil, nil, ".")
+	assert.Nil(t, err)
+	readonlyHash, err := common.HashTree(readonly, nil, nil, ".")
+	assert.Nil(t, err)
+	check.NotEqual(t, regularHash, executableHash)
+	// Permissions other than the executable bit are normalized away.
+	check.Equal(t, regularHash, readonlyHash)
+}
+
+func TestHashTreeExcludes(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{
+		"0001_init.sql":     {Data: []byte("CREATE TABLE a ();")},
+		"old/0000_gone.sql": {Data: []byte("CREATE TABLE b ();")},
+	}
+	all, err := common.HashTree(fsys, []string{"**/*.sql"}, nil, ".")
+	assert.Nil(t, err)
+	excluded, err := common.HashTree(fsys, []string{"**/*.sql"}, []string{"old/**"}, ".")
+	assert.Nil(t, err)
+	check.NotEqual(t, all, excluded)
+
+	delete(fsys, "old/0000_gone.sql")
+	removed, err := common.HashTree(fsys, []string{"**/*.sql"}, nil, ".")
+	assert.Nil(t, err)
+	check.Equal(t, excluded, removed)
+
+	_, err = common.HashTree(fsys, []string{"["}, nil, ".")
+	check.Error(t, err)
+}
+
+func TestHashTreeRealFilesystemMatchesFS(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "nested"), 0o755))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "0001_init.sql"), []byte("CREATE TABLE a ();"), 0o600))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "nested", "0002_cats.sql"), []byte("CREATE TABLE cats ();"), 0o600))
+	fromDisk, err := common.HashTree(nil, []string{"**/*.sql"}, nil, dir)
+	assert.Nil(t, err)
+
+	fsys := fstest.MapFS{
+		"0001_init.sql":        {Data: []byte("CREATE TABLE a ();"), Mode: 0o644},
+		"nested/0002_cats.sql": {Data: []byte("CREATE TABLE cats ();"), Mode: 0o644},
+	}
+	fromFS, err := common.HashTree(fsys, []string{"**/*.sql"}, nil, ".")
+	assert.Nil(t, err)
+	check.Equal(t, fromDisk, fromFS)
+}
+
+func TestManifestRecordsInputs(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{
+		"migrations/0001_init.sql": {Data: []byte("CREATE TABLE a ();")},
+		"migrations/0002_cats.sql": {Data: []byte("CREATE TABLE cats ();")},
+	}
+	hash := common.NewRecursiveHashWithManifest(common.Field("TableName", "migrations"))
+	assert.Nil(t, hash.AddDirs(fsys, "*.sql", "migrations"))
+	manifest := hash.Manifest()
+	assert.Equal(t, 2, len(manifest))
+	check.Equal(t, "field", manifest[0].Kind)
+	check.Equal(t, "TableName", manifest[0].Name)
+	check.Equal(t, "dirs", manifest[1].Kind)
+	if check.Equal(t, 2, len(manifest[1].Children)) {
+		check.Equal(t, "migrations/0001_init.sql", manifest[1].Children[0].Name)
+		check.Equal(t, "migrations/0002_cats.sql", manifest[1].Children[1].Name)
+	}
+	check.Equal(t, []string{
+		"TableName",
+		"dirs[0]/migrations/0001_init.sql",
+		"dirs[0]/migrations/0002_cats.sql",
+	}, sortedKeys(manifest.Flatten()))
+
+	// Recording a manifest does not change the hash, and hashes created
+	// without one don't record anything.
+	plain := common.NewRecursiveHash(common.Field("TableName", "migrations"))
+	assert.Nil(t, plain.AddDirs(fsys, "*.sql", "migrations"))
+	check.Equal(t, hash.String(), plain.String())
+	check.Equal(t, 0, len(plain.Manifest()))
+	dirs, err := common.ManifestDirs(fsys, "*.sql", "migrations")
+	assert.Nil(t, err)
+	check.Equal(t, manifest[1].Children, dirs)
+}
+
+func TestManifestNestsFields(t *testing.T) {
+	t.Parallel()
+	inner := common.NewRecursiveHashWithManifest(common.Field("TableName", "nested_migrations"))
+	outer := common.NewRecursiveHashWithManifest()
+	outer.AddNestedField("MigratorHash", inner.String(), inner.Manifest())
+	check.Equal(t, []string{"MigratorHash/TableName"}, sortedKeys(outer.Manifest().Flatten()))
+	check.Equal(t, common.NewRecursiveHash(common.Field("MigratorHash", inner.String())).String(), outer.String())
+}
+
+func TestManifestDiff(t *testing.T) {
+	t.Parallel()
+	before := fstest.MapFS{
+		"0001_init.sql": {Data: []byte("CREATE TABLE a ();")},
+		"0002_cats.sql": {Data: []byte("CREATE TABLE cats ();")},
+	}
+	after := fstest.MapFS{
+		"0001_init.sql": {Data: []byte("CREATE TABLE b ();")},
+		"0003_cats.sql": {Data: []byte("CREATE TABLE cats ();")},
+	}
+	hashBefore := common.NewRecursiveHashWithManifest(common.Field("TableName", "migrations"))
+	assert.Nil(t, hashBefore.AddTree(before, nil, nil, "."))
+	hashAfter := common.NewRecursiveHashWithManifest(common.Field("TableName", "migrations"))
+	assert.Nil(t, hashAfter.AddTree(after, nil, nil, "."))
+	check.Equal(t, []string{
+		"changed: tree[0]/0001_init.sql",
+		"removed: tree[0]/0002_cats.sql",
+		"added:   tree[0]/0003_cats.sql",
+	}, hashBefore.Manifest().Diff(hashAfter.Manifest()))
+	check.Equal(t, 0, len(hashBefore.Manifest().Diff(hashBefore.Manifest())))
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,99 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Manifest is a record of every input that was added to a [RecursiveHash], in
+// the order that they were added.
+type Manifest []ManifestEntry
+
+// ManifestEntry describes a single input that was added to a [RecursiveHash].
+type ManifestEntry struct {
+	// Kind is one of "field", "file", "files", "dirs", "tree", or "data".
+	Kind string `json:"kind"`
+	// Name is the key of a field or the slash-separated path of a file.
+	Name string `json:"name,omitempty"`
+	// Mode is the normalized mode of a file, if it was included in the hash.
+	Mode string `json:"mode,omitempty"`
+	// Digest is the md5 hash of the content that was added.
+	Digest string `json:"digest"`
+	// Children is the manifest of the content that was added, if that content
+	// was itself the result of a [RecursiveHash].
+	Children Manifest `json:"children,omitempty"`
+}
+
+// Flatten returns the digest of every input in the manifest, keyed by a
+// human-readable path. Entries with children are replaced by their children,
+// so that each path refers to an individual field, file, or piece of data.
+//
+// Example:
+//
+//	"Username"                      -> "…"
+//	"MigratorHash/TableName"        -> "…"
+//	"MigratorHash/dirs[0]/0001.sql" -> "…"
+func (m Manifest) Flatten() map[string]string {
+	out := map[string]string{}
+	m.flatten("", out)
+	return out
+}
+
+func (m Manifest) flatten(prefix string, out map[string]string) {
+	counts := map[string]int{}
+	for _, entry := range m {
+		name := entry.Name
+		if name == "" {
+			name = fmt.Sprintf("%s[%d]", entry.Kind, counts[entry.Kind])
+		}
+		counts[entry.Kind]++
+		key := prefix + name
+		// Inputs with the same name can be added multiple times, make sure
+		// that each one gets its own key.
+		for i := 2; ; i++ {
+			if _, exists := out[key]; !exists {
+				break
+			}
+			key = fmt.Sprintf("%s%s#%d", prefix, name, i)
+		}
+		if len(entry.Children) != 0 {
+			entry.Children.flatten(key+"/", out)
+			continue
+		}
+		out[key] = strings.TrimPrefix(entry.Mode+" ", " ") + entry.Digest
+	}
+}
+
+// Diff returns a human-readable description of every input that differs
+// between two manifests, sorted by path. If the manifests describe the same
+// inputs, the result is empty.
+//
+// Example:
+//
+//	added:   MigratorHash/dirs[0]/0003_dogs.sql
+//	removed: MigratorHash/dirs[0]/0002_cats.sql
+//	changed: MigratorHash/TableName
+func (m Manifest) Diff(other Manifest) []string {
+	before := m.Flatten()
+	after := other.Flatten()
+	var out []string
+	for key, digest := range before {
+		otherDigest, ok := after[key]
+		switch {
+		case !ok:
+			out = append(out, "removed: "+key)
+		case otherDigest != digest:
+			out = append(out, "changed: "+key)
+		}
+	}
+	for key := range after {
+		if _, ok := before[key]; !ok {
+			out = append(out, "added:   "+key)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i][9:] < out[j][9:]
+	})
+	return out
+}
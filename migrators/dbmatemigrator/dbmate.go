@@ -13,6 +13,8 @@ import (
 	"github.com/peterldowns/pgtestdb/migrators/common"
 )
 
+var _ pgtestdb.StepMigrator = (*DbmateMigrator)(nil)
+
 // Option provides a way to configure the DbmateMigrator struct and its behavior.
 //
 // dbmate documentation: https://github.com/amacneil/dbmate#command-line-options
@@ -80,6 +82,9 @@ func New(opts ...Option) *DbmateMigrator {
 }
 
 // DbmateMigrator is a pgtestdb.Migrator that uses dbmate to perform migrations.
+//
+// DbmateMigrator implements [pgtestdb.StepMigrator], so its down migrations
+// can be checked with [pgtestdb.CheckReversible].
 type DbmateMigrator struct {
 	MigrationsDir       []string
 	MigrationsTableName string
@@ -87,28 +92,119 @@ type DbmateMigrator struct {
 }
 
 func (m *DbmateMigrator) Hash() (string, error) {
-	hash := common.NewRecursiveHash(
-		common.Field("MigrationsTableName", m.MigrationsTableName),
-	)
-	if err := hash.AddDirs(m.FS, "*.sql", m.MigrationsDir...); err != nil {
+	hash, err := m.recursiveHash()
+	if err != nil {
 		return "", err
 	}
 	return hash.String(), nil
 }
 
+// Manifest returns a record of the inputs to Hash.
+func (m *DbmateMigrator) Manifest() (common.Manifest, error) {
+	hash, err := m.recursiveHash()
+	if err != nil {
+		return nil, err
+	}
+	return hash.Manifest(), nil
+}
+
+func (m *DbmateMigrator) recursiveHash() (common.RecursiveHash, error) {
+	hash := common.NewRecursiveHashWithManifest(
+		common.Field("MigrationsTableName", m.MigrationsTableName),
+	)
+	err := hash.AddDirs(m.FS, "*.sql", m.MigrationsDir...)
+	return hash, err
+}
+
 // Migrate runs dbmate.CreateAndMigrate() to migrate the template database.
 func (m *DbmateMigrator) Migrate(
 	_ context.Context,
 	_ *sql.DB,
 	templateConfig pgtestdb.Config,
 ) error {
-	u, err := url.Parse(templateConfig.URL())
+	dbm, err := m.dbmate(templateConfig)
 	if err != nil {
 		return err
 	}
+	return dbm.CreateAndMigrate()
+}
+
+// StepUp applies the next pending migration the same way that dbmate.Migrate()
+// does, since dbmate can't apply a single migration, and returns its version.
+// It is used by [pgtestdb.CheckReversible].
+func (m *DbmateMigrator) StepUp(
+	ctx context.Context,
+	db *sql.DB,
+	conf pgtestdb.Config,
+) (string, error) {
+	dbm, err := m.dbmate(conf)
+	if err != nil {
+		return "", err
+	}
+	drv, err := dbm.Driver()
+	if err != nil {
+		return "", err
+	}
+	if err := drv.CreateMigrationsTable(db); err != nil {
+		return "", err
+	}
+	migrations, err := dbm.FindMigrations()
+	if err != nil {
+		return "", err
+	}
+	for _, migration := range migrations {
+		if migration.Applied {
+			continue
+		}
+		parsed, err := migration.Parse()
+		if err != nil {
+			return "", err
+		}
+		if !parsed.UpOptions.Transaction() {
+			if _, err := db.ExecContext(ctx, parsed.Up); err != nil {
+				return "", err
+			}
+			return migration.Version, drv.InsertMigration(db, migration.Version)
+		}
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return "", err
+		}
+		defer func() { _ = tx.Rollback() }()
+		if _, err := tx.ExecContext(ctx, parsed.Up); err != nil {
+			return "", err
+		}
+		if err := drv.InsertMigration(tx, migration.Version); err != nil {
+			return "", err
+		}
+		return migration.Version, tx.Commit()
+	}
+	return "", nil
+}
+
+// StepDown runs dbmate.Rollback() to revert the most recently applied
+// migration. It is used by [pgtestdb.CheckReversible].
+func (m *DbmateMigrator) StepDown(
+	_ context.Context,
+	_ *sql.DB,
+	conf pgtestdb.Config,
+) error {
+	dbm, err := m.dbmate(conf)
+	if err != nil {
+		return err
+	}
+	return dbm.Rollback()
+}
+
+// dbmate returns a dbmate.DB that connects to the database described by conf.
+func (m *DbmateMigrator) dbmate(conf pgtestdb.Config) (*dbmate.DB, error) {
+	u, err := url.Parse(conf.URL())
+	if err != nil {
+		return nil, err
+	}
 	dbm := dbmate.New(u)
 	dbm.MigrationsDir = m.MigrationsDir
 	dbm.MigrationsTableName = m.MigrationsTableName
 	dbm.FS = m.FS
-	return dbm.CreateAndMigrate()
+	return dbm, nil
 }
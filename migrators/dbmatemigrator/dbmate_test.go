@@ -121,3 +121,16 @@ func TestDbmateMigratorWithDefaults(t *testing.T) {
 	}, m)
 	assert.NotEqual(t, nil, db)
 }
+
+func TestDbmateMigratorIsReversible(t *testing.T) {
+	t.Parallel()
+	m := dbmatemigrator.New(dbmatemigrator.WithDir("migrations", "more"))
+	pgtestdb.CheckReversible(t, pgtestdb.Config{
+		DriverName: "pgx",
+		Host:       "localhost",
+		User:       "postgres",
+		Password:   "password",
+		Port:       "5433",
+		Options:    "sslmode=disable",
+	}, m)
+}
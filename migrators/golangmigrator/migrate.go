@@ -3,10 +3,12 @@ package golangmigrator
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"io/fs"
+	"os"
+	"strconv"
 
 	"github.com/golang-migrate/migrate/v4"
-	"github.com/golang-migrate/migrate/v4/source"
 	"github.com/golang-migrate/migrate/v4/source/iofs"
 
 	_ "github.com/golang-migrate/migrate/v4/database/postgres" // pgx driver
@@ -56,6 +58,9 @@ func New(migrationsDir string, opts ...Option) *GolangMigrator {
 // Because Hash() requires calculating a unique hash based on the contents of
 // the migrations, database, this implementation only supports reading migration
 // files from disk or an embedded filesystem.
+//
+// GolangMigrator implements [pgtestdb.StepMigrator], so its down migrations
+// can be checked with [pgtestdb.CheckReversible].
 type GolangMigrator struct {
 	// Where the migrations come from
 	MigrationsDir string
@@ -66,25 +71,72 @@ func (gm *GolangMigrator) Hash() (string, error) {
 	return common.HashDirs(gm.FS, "*.sql", gm.MigrationsDir)
 }
 
+// Manifest returns a record of the inputs to Hash.
+func (gm *GolangMigrator) Manifest() (common.Manifest, error) {
+	return common.ManifestDirs(gm.FS, "*.sql", gm.MigrationsDir)
+}
+
 // Migrate runs migrate.Up() to migrate the template database.
 func (gm *GolangMigrator) Migrate(
 	_ context.Context,
 	_ *sql.DB,
 	templateConfig pgtestdb.Config,
 ) error {
-	var err error
-	var m *migrate.Migrate
-	if gm.FS == nil {
-		m, err = migrate.New("file://"+gm.MigrationsDir, templateConfig.URL())
-	} else {
-		var d source.Driver
-		if d, err = iofs.New(gm.FS, gm.MigrationsDir); err == nil {
-			m, err = migrate.NewWithSourceInstance("iofs", d, templateConfig.URL())
+	m, err := gm.newMigrate(templateConfig)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	return m.Up()
+}
+
+// StepUp runs migrate.Steps(1) to apply the next pending migration, and
+// returns its version. It is used by [pgtestdb.CheckReversible].
+func (gm *GolangMigrator) StepUp(
+	_ context.Context,
+	_ *sql.DB,
+	config pgtestdb.Config,
+) (string, error) {
+	m, err := gm.newMigrate(config)
+	if err != nil {
+		return "", err
+	}
+	defer m.Close()
+	if err := m.Steps(1); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil
 		}
+		return "", err
+	}
+	version, _, err := m.Version()
+	if err != nil {
+		return "", err
 	}
+	return strconv.FormatUint(uint64(version), 10), nil
+}
+
+// StepDown runs migrate.Steps(-1) to revert the most recently applied
+// migration. It is used by [pgtestdb.CheckReversible].
+func (gm *GolangMigrator) StepDown(
+	_ context.Context,
+	_ *sql.DB,
+	config pgtestdb.Config,
+) error {
+	m, err := gm.newMigrate(config)
 	if err != nil {
 		return err
 	}
 	defer m.Close()
-	return m.Up()
+	return m.Steps(-1)
+}
+
+func (gm *GolangMigrator) newMigrate(config pgtestdb.Config) (*migrate.Migrate, error) {
+	if gm.FS == nil {
+		return migrate.New("file://"+gm.MigrationsDir, config.URL())
+	}
+	d, err := iofs.New(gm.FS, gm.MigrationsDir)
+	if err != nil {
+		return nil, err
+	}
+	return migrate.NewWithSourceInstance("iofs", d, config.URL())
 }
@@ -103,3 +103,16 @@ func TestMigrateFromDisk(t *testing.T) {
 	assert.Nil(t, err)
 	check.Equal(t, 0, numBlogPosts)
 }
+
+func TestMigrateIsReversible(t *testing.T) {
+	t.Parallel()
+	gm := golangmigrator.New("migrations")
+	pgtestdb.CheckReversible(t, pgtestdb.Config{
+		DriverName: "pgx",
+		Host:       "localhost",
+		User:       "postgres",
+		Password:   "password",
+		Port:       "5433",
+		Options:    "sslmode=disable",
+	}, gm)
+}
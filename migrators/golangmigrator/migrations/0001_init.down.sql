@@ -0,0 +1,2 @@
+DROP TABLE "public"."blog_posts";
+DROP TABLE "public"."users";
@@ -3,9 +3,11 @@ package goosemigrator
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"strconv"
 
 	"github.com/pressly/goose/v3"
 	"github.com/pressly/goose/v3/database"
@@ -94,6 +96,9 @@ func New(migrationsDir string, opts ...Option) *GooseMigrator {
 // GooseMigrator does not allow specifying ExcludeNames or ExcludeVersions
 // and will configure goose to run all the migrations ending in `*.sql` within
 // the given filesystem and directory.
+//
+// GooseMigrator implements [pgtestdb.StepMigrator], so its down migrations can
+// be checked with [pgtestdb.CheckReversible].
 type GooseMigrator struct {
 	TableName     string
 	MigrationsDir string
@@ -101,37 +106,92 @@ type GooseMigrator struct {
 }
 
 func (gm *GooseMigrator) Hash() (string, error) {
-	hash := common.NewRecursiveHash(
-		common.Field("TableName", gm.TableName),
-	)
-	if err := hash.AddDirs(gm.FS, "*.sql", gm.MigrationsDir); err != nil {
+	hash, err := gm.recursiveHash()
+	if err != nil {
 		return "", err
 	}
 	return hash.String(), nil
 }
 
+// Manifest returns a record of the inputs to Hash.
+func (gm *GooseMigrator) Manifest() (common.Manifest, error) {
+	hash, err := gm.recursiveHash()
+	if err != nil {
+		return nil, err
+	}
+	return hash.Manifest(), nil
+}
+
+func (gm *GooseMigrator) recursiveHash() (common.RecursiveHash, error) {
+	hash := common.NewRecursiveHashWithManifest(
+		common.Field("TableName", gm.TableName),
+	)
+	err := hash.AddDirs(gm.FS, "*.sql", gm.MigrationsDir)
+	return hash, err
+}
+
 // Migrate runs migrate.Up() to migrate the template database.
 func (gm *GooseMigrator) Migrate(
 	ctx context.Context,
 	db *sql.DB,
 	_ pgtestdb.Config,
 ) error {
-	store, err := database.NewStore(database.DialectPostgres, gm.TableName)
+	provider, err := gm.provider(db)
 	if err != nil {
 		return err
 	}
-	providerOptions := []goose.ProviderOption{
-		goose.WithStore(store),
-		goose.WithDisableGlobalRegistry(true),
+	_, err = provider.Up(ctx)
+	return err
+}
+
+// StepUp runs provider.UpByOne() to apply the next pending migration, and
+// returns its version. It is used by [pgtestdb.CheckReversible].
+func (gm *GooseMigrator) StepUp(
+	ctx context.Context,
+	db *sql.DB,
+	_ pgtestdb.Config,
+) (string, error) {
+	provider, err := gm.provider(db)
+	if err != nil {
+		return "", err
+	}
+	result, err := provider.UpByOne(ctx)
+	if errors.Is(err, goose.ErrNoNextVersion) {
+		return "", nil
 	}
-	migrationsDir, err := fs.Sub(gm.FS, gm.MigrationsDir)
 	if err != nil {
-		return err
+		return "", err
 	}
-	provider, err := goose.NewProvider("", db, migrationsDir, providerOptions...)
+	return strconv.FormatInt(result.Source.Version, 10), nil
+}
+
+// StepDown runs provider.Down() to revert the most recently applied
+// migration. It is used by [pgtestdb.CheckReversible].
+func (gm *GooseMigrator) StepDown(
+	ctx context.Context,
+	db *sql.DB,
+	_ pgtestdb.Config,
+) error {
+	provider, err := gm.provider(db)
 	if err != nil {
 		return err
 	}
-	_, err = provider.Up(ctx)
+	_, err = provider.Down(ctx)
 	return err
 }
+
+func (gm *GooseMigrator) provider(db *sql.DB) (*goose.Provider, error) {
+	store, err := database.NewStore(database.DialectPostgres, gm.TableName)
+	if err != nil {
+		return nil, err
+	}
+	providerOptions := []goose.ProviderOption{
+		goose.WithStore(store),
+		goose.WithDisableGlobalRegistry(true),
+	}
+	migrationsDir, err := fs.Sub(gm.FS, gm.MigrationsDir)
+	if err != nil {
+		return nil, err
+	}
+	return goose.NewProvider("", db, migrationsDir, providerOptions...)
+}
@@ -133,3 +133,16 @@ func TestGooseMigratorFromEmbedFS(t *testing.T) {
 	assert.Nil(t, err)
 	check.Equal(t, 0, numBlogPosts)
 }
+
+func TestGooseMigratorIsReversible(t *testing.T) {
+	t.Parallel()
+	m := goosemigrator.New("migrations")
+	pgtestdb.CheckReversible(t, pgtestdb.Config{
+		DriverName: "pgx",
+		Host:       "localhost",
+		User:       "postgres",
+		Password:   "password",
+		Port:       "5433",
+		Options:    "sslmode=disable",
+	}, m)
+}
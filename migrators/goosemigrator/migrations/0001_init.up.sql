@@ -23,4 +23,5 @@ CREATE TABLE "public"."blog_posts" (
 
 -- +goose Down
 DROP TABLE "public"."blog_posts";
-DROP TABLE "public"."users";
\ No newline at end of file
+DROP TABLE "public"."users";
+DROP TABLE post;
\ No newline at end of file
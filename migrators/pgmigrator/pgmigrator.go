@@ -62,13 +62,22 @@ type PGMigrator struct {
 }
 
 func (pgm *PGMigrator) Hash() (string, error) {
-	hash := common.NewRecursiveHash(
+	return pgm.recursiveHash().String(), nil
+}
+
+// Manifest returns a record of the inputs to Hash.
+func (pgm *PGMigrator) Manifest() (common.Manifest, error) {
+	return pgm.recursiveHash().Manifest(), nil
+}
+
+func (pgm *PGMigrator) recursiveHash() common.RecursiveHash {
+	hash := common.NewRecursiveHashWithManifest(
 		common.Field("TableName", pgm.m.TableName),
 	)
 	for _, migration := range pgm.m.Migrations {
 		hash.Add([]byte(migration.SQL))
 	}
-	return hash.String(), nil
+	return hash
 }
 
 func (pgm *PGMigrator) Migrate(
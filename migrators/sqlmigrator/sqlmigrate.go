@@ -28,19 +28,39 @@ func New(source migrate.MigrationSource, migrationSet *migrate.MigrationSet) *SQ
 }
 
 // SQLMigrator is a pgtestdb.Migrator that uses sql-migrate to perform migrations.
+//
+// SQLMigrator implements [pgtestdb.StepMigrator], so its down migrations can
+// be checked with [pgtestdb.CheckReversible].
 type SQLMigrator struct {
 	Source       migrate.MigrationSource
 	MigrationSet *migrate.MigrationSet
 }
 
 func (sm *SQLMigrator) Hash() (string, error) {
-	migrations, err := sm.Source.FindMigrations()
+	hash, err := sm.recursiveHash()
 	if err != nil {
 		return "", err
 	}
+	return hash.String(), nil
+}
+
+// Manifest returns a record of the inputs to Hash.
+func (sm *SQLMigrator) Manifest() (common.Manifest, error) {
+	hash, err := sm.recursiveHash()
+	if err != nil {
+		return nil, err
+	}
+	return hash.Manifest(), nil
+}
+
+func (sm *SQLMigrator) recursiveHash() (common.RecursiveHash, error) {
+	migrations, err := sm.Source.FindMigrations()
+	if err != nil {
+		return common.RecursiveHash{}, err
+	}
 	// Include settings/values in the hash that affect the resulting schema of
 	// the database,
-	hash := common.NewRecursiveHash(
+	hash := common.NewRecursiveHashWithManifest(
 		common.Field("TableName", sm.MigrationSet.TableName),
 		common.Field("SchemaName", sm.MigrationSet.SchemaName),
 	)
@@ -50,7 +70,7 @@ func (sm *SQLMigrator) Hash() (string, error) {
 			hash.Add([]byte(contents))
 		}
 	}
-	return hash.String(), nil
+	return hash, nil
 }
 
 // Migrate runs migrationSet.Exec() to migrate the template database.
@@ -62,3 +82,31 @@ func (sm *SQLMigrator) Migrate(
 	_, err := sm.MigrationSet.Exec(db, "postgres", sm.Source, migrate.Up)
 	return err
 }
+
+// StepUp runs migrationSet.ExecMax() to apply the next pending migration, and
+// returns its id. It is used by [pgtestdb.CheckReversible].
+func (sm *SQLMigrator) StepUp(
+	_ context.Context,
+	db *sql.DB,
+	_ pgtestdb.Config,
+) (string, error) {
+	planned, _, err := sm.MigrationSet.PlanMigration(db, "postgres", sm.Source, migrate.Up, 1)
+	if err != nil || len(planned) == 0 {
+		return "", err
+	}
+	if _, err := sm.MigrationSet.ExecMax(db, "postgres", sm.Source, migrate.Up, 1); err != nil {
+		return "", err
+	}
+	return planned[0].Id, nil
+}
+
+// StepDown runs migrationSet.ExecMax() to revert the most recently applied
+// migration. It is used by [pgtestdb.CheckReversible].
+func (sm *SQLMigrator) StepDown(
+	_ context.Context,
+	db *sql.DB,
+	_ pgtestdb.Config,
+) error {
+	_, err := sm.MigrationSet.ExecMax(db, "postgres", sm.Source, migrate.Down, 1)
+	return err
+}
@@ -155,3 +155,18 @@ func TestSQLMigratorWithTableDisabled(t *testing.T) {
 	check.Equal(t, 0, numBlogPosts)
 }
 */
+
+func TestSQLMigratorIsReversible(t *testing.T) {
+	t.Parallel()
+	sm := sqlmigrator.New(&migrate.FileMigrationSource{
+		Dir: "migrations",
+	}, nil)
+	pgtestdb.CheckReversible(t, pgtestdb.Config{
+		DriverName: "pgx",
+		Host:       "localhost",
+		User:       "postgres",
+		Password:   "password",
+		Port:       "5433",
+		Options:    "sslmode=disable",
+	}, sm)
+}
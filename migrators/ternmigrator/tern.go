@@ -13,7 +13,10 @@ import (
 	"github.com/peterldowns/pgtestdb/migrators/common"
 )
 
-var _ pgtestdb.Migrator = (*TernMigrator)(nil)
+var (
+	_ pgtestdb.StepMigrator     = (*TernMigrator)(nil)
+	_ pgtestdb.ManifestMigrator = (*TernMigrator)(nil)
+)
 
 // DefaultTableName is the default name for tern's migration table. This is
 // the same as the default value in the tern command line tool.
@@ -58,6 +61,9 @@ func New(migrationsDir string, opts ...Option) *TernMigrator {
 }
 
 // TernMigrator is a pgtestdb.Migrator that uses tern to perform migrations.
+//
+// TernMigrator implements [pgtestdb.StepMigrator], so its down migrations can
+// be checked with [pgtestdb.CheckReversible].
 type TernMigrator struct {
 	TableName     string
 	MigrationsDir string
@@ -66,14 +72,28 @@ type TernMigrator struct {
 
 // Hash returns a hash of the migrations.
 func (tm *TernMigrator) Hash() (string, error) {
-	hash := common.NewRecursiveHash(common.Field("TableName", tm.TableName))
-	err := hash.AddDirs(tm.FS, "*.sql", tm.MigrationsDir)
+	hash, err := tm.recursiveHash()
 	if err != nil {
 		return "", err
 	}
 	return hash.String(), nil
 }
 
+// Manifest returns a record of the inputs to Hash.
+func (tm *TernMigrator) Manifest() (common.Manifest, error) {
+	hash, err := tm.recursiveHash()
+	if err != nil {
+		return nil, err
+	}
+	return hash.Manifest(), nil
+}
+
+func (tm *TernMigrator) recursiveHash() (common.RecursiveHash, error) {
+	hash := common.NewRecursiveHashWithManifest(common.Field("TableName", tm.TableName))
+	err := hash.AddDirs(tm.FS, "*.sql", tm.MigrationsDir)
+	return hash, err
+}
+
 func (tm *TernMigrator) fsys() (fs.FS, error) {
 	if tm.FS == nil {
 		return os.DirFS(tm.MigrationsDir), nil
@@ -82,7 +102,55 @@ func (tm *TernMigrator) fsys() (fs.FS, error) {
 }
 
 // Migrate migrates the template database.
-func (tm *TernMigrator) Migrate(ctx context.Context, _ *sql.DB, config pgtestdb.Config) (errOut error) {
+func (tm *TernMigrator) Migrate(ctx context.Context, _ *sql.DB, config pgtestdb.Config) error {
+	return tm.withMigrator(ctx, config, func(mig *migrate.Migrator) error {
+		return mig.Migrate(ctx)
+	})
+}
+
+// StepUp applies the next pending migration and returns its name. It is used
+// by [pgtestdb.CheckReversible].
+func (tm *TernMigrator) StepUp(ctx context.Context, _ *sql.DB, config pgtestdb.Config) (string, error) {
+	var name string
+	err := tm.withMigrator(ctx, config, func(mig *migrate.Migrator) error {
+		current, err := mig.GetCurrentVersion(ctx)
+		if err != nil {
+			return err
+		}
+		if int(current) >= len(mig.Migrations) {
+			return nil
+		}
+		if err := mig.MigrateTo(ctx, current+1); err != nil {
+			return err
+		}
+		name = mig.Migrations[current].Name
+		return nil
+	})
+	return name, err
+}
+
+// StepDown reverts the most recently applied migration. It is used by
+// [pgtestdb.CheckReversible].
+func (tm *TernMigrator) StepDown(ctx context.Context, _ *sql.DB, config pgtestdb.Config) error {
+	return tm.withMigrator(ctx, config, func(mig *migrate.Migrator) error {
+		current, err := mig.GetCurrentVersion(ctx)
+		if err != nil {
+			return err
+		}
+		if current == 0 {
+			return nil
+		}
+		return mig.MigrateTo(ctx, current-1)
+	})
+}
+
+// withMigrator connects to the database and calls `cb` with a tern migrator
+// that has loaded all of the migrations.
+func (tm *TernMigrator) withMigrator(
+	ctx context.Context,
+	config pgtestdb.Config,
+	cb func(*migrate.Migrator) error,
+) (errOut error) {
 	conn, err := pgx.Connect(ctx, config.URL())
 	if err != nil {
 		return err
@@ -105,5 +173,5 @@ func (tm *TernMigrator) Migrate(ctx context.Context, _ *sql.DB, config pgtestdb.
 	if err != nil {
 		return err
 	}
-	return mig.Migrate(ctx)
+	return cb(mig)
 }
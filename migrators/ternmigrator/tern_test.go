@@ -127,3 +127,16 @@ func TestTernMigratorWithTableName(t *testing.T) {
 	assert.Nil(t, err)
 	check.Equal(t, 0, numBlogPosts)
 }
+
+func TestTernMigratorIsReversible(t *testing.T) {
+	t.Parallel()
+	m := ternmigrator.New("migrations")
+	pgtestdb.CheckReversible(t, pgtestdb.Config{
+		DriverName: "pgx",
+		Host:       "localhost",
+		User:       "postgres",
+		Password:   "password",
+		Port:       "5433",
+		Options:    "sslmode=disable",
+	}, m)
+}
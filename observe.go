@@ -0,0 +1,140 @@
+package pgtestdb
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// EventType identifies a step in the lifecycle of a template or test database.
+type EventType string
+
+const (
+	// EventSlotAcquired is sent once the [Config.Coordinator], or the
+	// [Config.MaxInstances] limit, allows a test database to be created.
+	// Duration is how long the test waited.
+	EventSlotAcquired EventType = "slot_acquired"
+	// EventRoleEnsured is sent after the test role has been found or created,
+	// at most once per role per program.
+	EventRoleEnsured EventType = "role_ensured"
+	// EventTemplateLockWait is sent when pgtestdb starts waiting for the
+	// advisory lock that guards the creation of a template. Other programs
+	// creating or verifying the same template will hold it.
+	EventTemplateLockWait EventType = "template_lock_wait"
+	// EventTemplateLockAcquired is sent once the template lock has been
+	// acquired. Duration is how long pgtestdb waited for it.
+	EventTemplateLockAcquired EventType = "template_lock_acquired"
+	// EventTemplateBuilt is sent after a template has been created and
+	// migrated. Duration is how long the migrator took.
+	EventTemplateBuilt EventType = "template_built"
+	// EventTemplateReused is sent when a template built by an earlier run or
+	// by another program is found on the server and used as-is.
+	EventTemplateReused EventType = "template_reused"
+	// EventTemplateFailed is sent when a template can't be created, migrated,
+	// or verified. Err is the reason.
+	EventTemplateFailed EventType = "template_failed"
+	// EventServerConnected is sent after pgtestdb connects to the server to
+	// create or drop a test database. Duration is how long connecting took.
+	EventServerConnected EventType = "server_connected"
+	// EventInstanceCloned is sent after a test database has been cloned from
+	// its template. Duration is how long the clone took.
+	EventInstanceCloned EventType = "instance_cloned"
+	// EventInstanceKept is sent when a test fails and its database is left
+	// on the server for investigation.
+	EventInstanceKept EventType = "instance_kept"
+	// EventConnectionsTerminated is sent after pgtestdb terminates the
+	// connections to a test database, when [Config.ForceTerminateConnections]
+	// is enabled. Duration is how long the termination took.
+	EventConnectionsTerminated EventType = "connections_terminated"
+	// EventInstanceDropped is sent after a test database has been dropped at
+	// the end of a test. Duration is how long the drop took.
+	EventInstanceDropped EventType = "instance_dropped"
+	// EventCleanupError is sent when a test database can't be closed or
+	// dropped at the end of a test. Err is the reason.
+	EventCleanupError EventType = "cleanup_error"
+)
+
+// Event describes a single step taken by pgtestdb. Fields that don't apply to
+// a given type of event are left empty.
+type Event struct {
+	Type         EventType
+	Time         time.Time     // when the event happened
+	Duration     time.Duration // how long the step took, if it took any time
+	Test         string        // the name of the test, if known
+	Role         string        // the name of the test role
+	MigratorType string        // the Go type of the migrator, "*goosemigrator.GooseMigrator"
+	Hash         string        // the hash that identifies the template
+	Template     string        // the name of the template database, or schema with IsolateSchemas
+	Database     string        // the name of the test database, or schema with IsolateSchemas
+	Err          error         // the error, for EventTemplateFailed and EventCleanupError
+}
+
+// Observer receives an [Event] for each step that pgtestdb takes while
+// creating templates and test databases. Set one on [Config.Observer] to see
+// where the time in a test suite goes and when tests contend for templates.
+// Observe may be called from many goroutines at once, and should return
+// quickly, since it is called synchronously.
+type Observer interface {
+	Observe(Event)
+}
+
+// ObserverFunc adapts an ordinary function to the [Observer] interface.
+type ObserverFunc func(Event)
+
+// Observe calls f(event).
+func (f ObserverFunc) Observe(event Event) {
+	f(event)
+}
+
+// SlogObserver returns an [Observer] that logs each event to the given logger,
+// at [slog.LevelError] for events with errors and [slog.LevelDebug] for
+// everything else.
+//
+// Example:
+//
+//	conf := pgtestdb.Config{
+//		Observer: pgtestdb.SlogObserver(slog.Default()),
+//		...
+//	}
+func SlogObserver(logger *slog.Logger) Observer {
+	return ObserverFunc(func(event Event) {
+		level := slog.LevelDebug
+		if event.Err != nil {
+			level = slog.LevelError
+		}
+		if !logger.Enabled(context.Background(), level) {
+			return
+		}
+		var attrs []slog.Attr
+		addString := func(key, value string) {
+			if value != "" {
+				attrs = append(attrs, slog.String(key, value))
+			}
+		}
+		addString("test", event.Test)
+		addString("role", event.Role)
+		addString("migrator", event.MigratorType)
+		addString("hash", event.Hash)
+		addString("template", event.Template)
+		addString("database", event.Database)
+		if event.Duration != 0 {
+			attrs = append(attrs, slog.Duration("duration", event.Duration))
+		}
+		if event.Err != nil {
+			attrs = append(attrs, slog.String("error", event.Err.Error()))
+		}
+		logger.LogAttrs(context.Background(), level, "pgtestdb: "+string(event.Type), attrs...)
+	})
+}
+
+// observe records the duration of an event for [Timings], and sends it to the
+// config's observer, if it has one.
+func (c Config) observe(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	timings.record(event)
+	if c.Observer != nil {
+		c.Observer.Observe(event)
+	}
+}
@@ -0,0 +1,203 @@
+// Package otel records the work that pgtestdb does to create templates and
+// test databases as OpenTelemetry spans.
+//
+// Use it by setting the [pgtestdb.Config.Observer] to an [Observer] created
+// with the context of the test, so that pgtestdb's spans become children of
+// the test's span:
+//
+//	ctx, span := tracer.Start(context.Background(), t.Name())
+//	defer span.End()
+//	conf.Observer = otel.NewObserver(ctx, nil)
+//	db := pgtestdb.New(t, conf, migrator)
+package otel
+
+import (
+	"context"
+	"sync"
+
+	otelglobal "go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/peterldowns/pgtestdb"
+)
+
+// TracerName is the name of the tracer that creates pgtestdb's spans.
+const TracerName = "github.com/peterldowns/pgtestdb/otel"
+
+// The names of the spans created by the [Observer].
+const (
+	SpanAcquire        = "pgtestdb.Coordinator.Acquire"
+	SpanEnsureRole     = "pgtestdb.ensureRole"
+	SpanGetOrCreate    = "pgtestdb.getOrCreateTemplate"
+	SpanLockWait       = "pgtestdb.sessionlock.With"
+	SpanMigrate        = "pgtestdb.Migrator.Migrate"
+	SpanConnect        = "pgtestdb.connect"
+	SpanCreateInstance = "pgtestdb.createInstance"
+	SpanCleanup        = "pgtestdb.cleanup"
+	SpanTerminate      = "pgtestdb.terminateConnections"
+	SpanDropInstance   = "pgtestdb.dropInstance"
+)
+
+// attributePrefix is the prefix of the names of the attributes that pgtestdb
+// sets on its spans, "pgtestdb.hash".
+const attributePrefix = "pgtestdb."
+
+// Observer is a [pgtestdb.Observer] that turns pgtestdb's events into spans.
+// pgtestdb reports each step once it has finished, along with how long it
+// took, so each span is created after the fact with the step's real start and
+// end times.
+type Observer struct {
+	ctx    context.Context
+	tracer trace.Tracer
+
+	mu        sync.Mutex
+	templates map[string]trace.Span // open getOrCreateTemplate spans, by hash
+	instances map[string]trace.Span // open cleanup spans, by database; nil until cleanup begins
+}
+
+// NewObserver returns an [Observer] whose spans are children of the span in
+// `ctx`. If `provider` is nil, the global tracer provider is used.
+func NewObserver(ctx context.Context, provider trace.TracerProvider) *Observer {
+	if provider == nil {
+		provider = otelglobal.GetTracerProvider()
+	}
+	return &Observer{
+		ctx:       ctx,
+		tracer:    provider.Tracer(TracerName),
+		templates: map[string]trace.Span{},
+		instances: map[string]trace.Span{},
+	}
+}
+
+// Observe implements [pgtestdb.Observer].
+func (o *Observer) Observe(event pgtestdb.Event) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	switch event.Type {
+	case pgtestdb.EventSlotAcquired:
+		o.record(o.ctx, SpanAcquire, event)
+	case pgtestdb.EventRoleEnsured:
+		o.record(o.ctx, SpanEnsureRole, event)
+
+	case pgtestdb.EventTemplateLockWait:
+		_, span := o.tracer.Start(o.ctx, SpanGetOrCreate,
+			trace.WithTimestamp(event.Time),
+			trace.WithAttributes(attributes(event)...),
+		)
+		o.templates[event.Hash] = span
+	case pgtestdb.EventTemplateLockAcquired:
+		o.record(o.templateContext(event), SpanLockWait, event)
+	case pgtestdb.EventTemplateBuilt:
+		o.record(o.templateContext(event), SpanMigrate, event)
+		o.endTemplate(event)
+	case pgtestdb.EventTemplateReused:
+		o.endTemplate(event, attribute.Bool(attributePrefix+"reused", true))
+	case pgtestdb.EventTemplateFailed:
+		o.endTemplate(event)
+
+	case pgtestdb.EventServerConnected:
+		if _, cloned := o.instances[event.Database]; cloned {
+			o.record(o.cleanupContext(event), SpanConnect, event)
+		} else {
+			o.record(o.ctx, SpanConnect, event)
+		}
+	case pgtestdb.EventInstanceCloned:
+		o.record(o.ctx, SpanCreateInstance, event)
+		o.instances[event.Database] = nil
+	case pgtestdb.EventConnectionsTerminated:
+		o.record(o.cleanupContext(event), SpanTerminate, event)
+	case pgtestdb.EventInstanceDropped:
+		o.record(o.cleanupContext(event), SpanDropInstance, event)
+		o.endCleanup(event)
+	case pgtestdb.EventInstanceKept:
+		o.cleanupContext(event)
+		o.endCleanup(event, attribute.Bool(attributePrefix+"kept", true))
+	case pgtestdb.EventCleanupError:
+		o.cleanupContext(event)
+		o.endCleanup(event)
+	}
+}
+
+// record creates a span for a step that has just finished.
+func (o *Observer) record(ctx context.Context, name string, event pgtestdb.Event) {
+	_, span := o.tracer.Start(ctx, name,
+		trace.WithTimestamp(event.Time.Add(-event.Duration)),
+		trace.WithAttributes(attributes(event)...),
+	)
+	if event.Err != nil {
+		span.RecordError(event.Err)
+		span.SetStatus(codes.Error, event.Err.Error())
+	}
+	span.End(trace.WithTimestamp(event.Time))
+}
+
+// templateContext returns a context containing the open getOrCreateTemplate
+// span for the event's template, if there is one.
+func (o *Observer) templateContext(event pgtestdb.Event) context.Context {
+	if span, ok := o.templates[event.Hash]; ok {
+		return trace.ContextWithSpan(o.ctx, span)
+	}
+	return o.ctx
+}
+
+func (o *Observer) endTemplate(event pgtestdb.Event, attrs ...attribute.KeyValue) {
+	span, ok := o.templates[event.Hash]
+	if !ok {
+		return
+	}
+	delete(o.templates, event.Hash)
+	end(span, event, attrs...)
+}
+
+// cleanupContext returns a context containing the cleanup span for the event's
+// database, starting the span if this is the first step of the cleanup.
+func (o *Observer) cleanupContext(event pgtestdb.Event) context.Context {
+	span := o.instances[event.Database]
+	if span == nil {
+		_, span = o.tracer.Start(o.ctx, SpanCleanup,
+			trace.WithTimestamp(event.Time.Add(-event.Duration)),
+			trace.WithAttributes(attributes(event)...),
+		)
+		o.instances[event.Database] = span
+	}
+	return trace.ContextWithSpan(o.ctx, span)
+}
+
+func (o *Observer) endCleanup(event pgtestdb.Event, attrs ...attribute.KeyValue) {
+	span := o.instances[event.Database]
+	if span == nil {
+		return
+	}
+	delete(o.instances, event.Database)
+	end(span, event, attrs...)
+}
+
+func end(span trace.Span, event pgtestdb.Event, attrs ...attribute.KeyValue) {
+	span.SetAttributes(attrs...)
+	if event.Err != nil {
+		span.RecordError(event.Err)
+		span.SetStatus(codes.Error, event.Err.Error())
+	}
+	span.End(trace.WithTimestamp(event.Time))
+}
+
+// attributes describes the template and database involved in an event.
+func attributes(event pgtestdb.Event) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{attribute.String("db.system", "postgresql")}
+	add := func(key, value string) {
+		if value != "" {
+			attrs = append(attrs, attribute.String(attributePrefix+key, value))
+		}
+	}
+	add("test", event.Test)
+	add("role", event.Role)
+	add("migrator_type", event.MigratorType)
+	add("hash", event.Hash)
+	add("template", event.Template)
+	add("database", event.Database)
+	return attrs
+}
+
+var _ pgtestdb.Observer = (*Observer)(nil)
@@ -0,0 +1,153 @@
+package otel_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib" // "pgx" driver
+	"github.com/peterldowns/testy/assert"
+	"github.com/peterldowns/testy/check"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/peterldowns/pgtestdb"
+	"github.com/peterldowns/pgtestdb/otel"
+)
+
+func newTracer() (*tracetest.InMemoryExporter, *sdktrace.TracerProvider) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	return exporter, provider
+}
+
+// spansByName indexes the exported spans by name, keeping the last span with
+// each name.
+func spansByName(exporter *tracetest.InMemoryExporter) map[string]tracetest.SpanStub {
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	return spans
+}
+
+func attributeValue(span tracetest.SpanStub, key attribute.Key) string {
+	for _, attr := range span.Attributes {
+		if attr.Key == key {
+			return attr.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestObserverBuildsSpansFromEvents(t *testing.T) {
+	t.Parallel()
+	exporter, provider := newTracer()
+	ctx, root := provider.Tracer("test").Start(context.Background(), "TestSomething")
+	observer := otel.NewObserver(ctx, provider)
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+	template := pgtestdb.Event{Hash: "abc", Template: "testdb_tpl_abc", MigratorType: "*sqlmigrator.SQLMigrator"}
+	instance := template
+	instance.Database = "testdb_tpl_abc_inst_1"
+	instance.Test = "TestSomething"
+	send := func(base pgtestdb.Event, typ pgtestdb.EventType, time time.Time, duration time.Duration) {
+		base.Type = typ
+		base.Time = time
+		base.Duration = duration
+		observer.Observe(base)
+	}
+	send(template, pgtestdb.EventTemplateLockWait, at(0), 0)
+	send(template, pgtestdb.EventTemplateLockAcquired, at(100*time.Millisecond), 100*time.Millisecond)
+	send(template, pgtestdb.EventTemplateBuilt, at(1100*time.Millisecond), 900*time.Millisecond)
+	send(instance, pgtestdb.EventServerConnected, at(1110*time.Millisecond), 5*time.Millisecond)
+	send(instance, pgtestdb.EventInstanceCloned, at(1150*time.Millisecond), 30*time.Millisecond)
+	send(instance, pgtestdb.EventServerConnected, at(2005*time.Millisecond), 5*time.Millisecond)
+	send(instance, pgtestdb.EventInstanceDropped, at(2050*time.Millisecond), 40*time.Millisecond)
+	root.End()
+
+	spans := spansByName(exporter)
+	rootID := spans["TestSomething"].SpanContext.SpanID()
+
+	getOrCreate := spans[otel.SpanGetOrCreate]
+	check.Equal(t, rootID, getOrCreate.Parent.SpanID())
+	check.Equal(t, at(0), getOrCreate.StartTime)
+	check.Equal(t, at(1100*time.Millisecond), getOrCreate.EndTime)
+	check.Equal(t, "abc", attributeValue(getOrCreate, "pgtestdb.hash"))
+	check.Equal(t, "*sqlmigrator.SQLMigrator", attributeValue(getOrCreate, "pgtestdb.migrator_type"))
+
+	lockWait := spans[otel.SpanLockWait]
+	check.Equal(t, getOrCreate.SpanContext.SpanID(), lockWait.Parent.SpanID())
+	check.Equal(t, 100*time.Millisecond, lockWait.EndTime.Sub(lockWait.StartTime))
+
+	migrate := spans[otel.SpanMigrate]
+	check.Equal(t, getOrCreate.SpanContext.SpanID(), migrate.Parent.SpanID())
+	check.Equal(t, at(200*time.Millisecond), migrate.StartTime)
+
+	createInstance := spans[otel.SpanCreateInstance]
+	check.Equal(t, rootID, createInstance.Parent.SpanID())
+	check.Equal(t, "testdb_tpl_abc_inst_1", attributeValue(createInstance, "pgtestdb.database"))
+	check.Equal(t, "TestSomething", attributeValue(createInstance, "pgtestdb.test"))
+
+	cleanup := spans[otel.SpanCleanup]
+	check.Equal(t, rootID, cleanup.Parent.SpanID())
+	check.Equal(t, at(2000*time.Millisecond), cleanup.StartTime)
+	check.Equal(t, at(2050*time.Millisecond), cleanup.EndTime)
+	drop := spans[otel.SpanDropInstance]
+	check.Equal(t, cleanup.SpanContext.SpanID(), drop.Parent.SpanID())
+	// The second connection, made during the cleanup, belongs to the cleanup.
+	connect := spans[otel.SpanConnect]
+	check.Equal(t, cleanup.SpanContext.SpanID(), connect.Parent.SpanID())
+}
+
+func TestObserverRecordsErrors(t *testing.T) {
+	t.Parallel()
+	exporter, provider := newTracer()
+	observer := otel.NewObserver(context.Background(), provider)
+	now := time.Now()
+	observer.Observe(pgtestdb.Event{Type: pgtestdb.EventTemplateLockWait, Time: now, Hash: "abc"})
+	observer.Observe(pgtestdb.Event{
+		Type: pgtestdb.EventTemplateFailed,
+		Time: now.Add(time.Second),
+		Hash: "abc",
+		Err:  errors.New("syntax error at or near \"CRATE\""),
+	})
+	spans := spansByName(exporter)
+	getOrCreate := spans[otel.SpanGetOrCreate]
+	check.Equal(t, codes.Error, getOrCreate.Status.Code)
+	check.Equal(t, "syntax error at or near \"CRATE\"", getOrCreate.Status.Description)
+	assert.Equal(t, 1, len(getOrCreate.Events))
+	check.Equal(t, "exception", getOrCreate.Events[0].Name)
+}
+
+func TestObserverWithPgtestdb(t *testing.T) {
+	t.Parallel()
+	exporter, provider := newTracer()
+	ctx, root := provider.Tracer("test").Start(context.Background(), t.Name())
+	conf := pgtestdb.Config{
+		DriverName: "pgx",
+		User:       "postgres",
+		Password:   "password",
+		Host:       "localhost",
+		Port:       "5433",
+		Options:    "sslmode=disable",
+		Observer:   otel.NewObserver(ctx, provider),
+	}
+	t.Run("test", func(t *testing.T) {
+		db := pgtestdb.New(t, conf, pgtestdb.NoopMigrator{})
+		assert.Nil(t, db.Ping())
+	})
+	root.End()
+
+	spans := spansByName(exporter)
+	for _, name := range []string{otel.SpanCreateInstance, otel.SpanCleanup, otel.SpanDropInstance} {
+		span, ok := spans[name]
+		assert.True(t, ok)
+		check.Equal(t, root.SpanContext().TraceID(), span.SpanContext.TraceID())
+	}
+	check.Equal(t, "pgtestdb.NoopMigrator", attributeValue(spans[otel.SpanCreateInstance], "pgtestdb.migrator_type"))
+}
@@ -0,0 +1,527 @@
+package pgtestdb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultQueryLogSize is the number of recent queries that are logged when a
+// test that captures queries fails, unless [Config.QueryLogSize] is set.
+const DefaultQueryLogSize = 20
+
+// Query is a single statement that was executed by a test, as recorded when
+// [Config.CaptureQueries] is enabled.
+type Query struct {
+	SQL      string        // the text of the statement
+	Args     []any         // the arguments passed with the statement
+	Start    time.Time     // when the statement was sent to the server
+	Duration time.Duration // how long the server took to respond
+	// Rows is the number of rows affected by a statement run with Exec, or
+	// the number of rows read from a statement run with Query.
+	Rows int64
+	Err  error // the error returned by the driver, if any
+}
+
+// String returns a one-line description of the query.
+func (q Query) String() string {
+	var b strings.Builder
+	b.WriteString(strings.Join(strings.Fields(q.SQL), " "))
+	if len(q.Args) > 0 {
+		fmt.Fprintf(&b, " %v", q.Args)
+	}
+	fmt.Fprintf(&b, " (%s, %d rows", q.Duration.Round(time.Microsecond), q.Rows)
+	if q.Err != nil {
+		fmt.Fprintf(&b, ", error: %s", q.Err)
+	}
+	b.WriteString(")")
+	return b.String()
+}
+
+// QueryLog records the statements executed through a test database. Get the
+// log for a database with [CapturedQueries].
+type QueryLog struct {
+	mu sync.Mutex
+	// queries are pointers so that rows can fill in their count once they
+	// have been read, even if the log has been reset in the meantime.
+	queries []*Query
+}
+
+// Queries returns every query recorded since the log was created or last
+// [QueryLog.Reset].
+func (l *QueryLog) Queries() []Query {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	queries := make([]Query, len(l.queries))
+	for i, q := range l.queries {
+		queries[i] = *q
+	}
+	return queries
+}
+
+// Len returns the number of queries recorded since the log was created or
+// last [QueryLog.Reset].
+func (l *QueryLog) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.queries)
+}
+
+// Reset forgets every query recorded so far. Call it after setting up a test
+// so that only the queries made by the code under test are counted.
+func (l *QueryLog) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.queries = nil
+}
+
+// record adds a query to the log and returns the recorded entry, so that the
+// number of rows can be filled in once they have been read. Does nothing if
+// the log is nil, which is the case when connections are tracked but queries
+// aren't captured.
+func (l *QueryLog) record(q Query) *Query {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.queries = append(l.queries, &q)
+	return &q
+}
+
+// setRows updates the number of rows read for a recorded query. If the log
+// was reset in the meantime, the query is no longer in the log, and updating
+// it has no effect.
+func (l *QueryLog) setRows(q *Query, rows int64) {
+	if l == nil || q == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	q.Rows = rows
+}
+
+// logRecent logs the most recent `n` queries with `t.Logf()`.
+func (l *QueryLog) logRecent(t TB, n int) {
+	queries := l.Queries()
+	if len(queries) > n {
+		queries = queries[len(queries)-n:]
+	}
+	t.Logf("pgtestdb: the last %d queries executed by the test were:", len(queries))
+	for _, q := range queries {
+		t.Logf("  %s", q)
+	}
+}
+
+// queryLogs maps each test database that is capturing queries to its log.
+var queryLogs sync.Map //nolint:gochecknoglobals // map[*sql.DB]*QueryLog
+
+// CapturedQueries returns the log of queries executed through a database
+// returned by [New] with [Config.CaptureQueries] enabled. If queries are not
+// being captured for the database, the test is failed with `t.Fatalf()`.
+func CapturedQueries(t TB, db *sql.DB) *QueryLog {
+	t.Helper()
+	log, ok := queryLogs.Load(db)
+	if !ok {
+		t.Fatalf("pgtestdb is not capturing queries for this database, set CaptureQueries in your pgtestdb.Config")
+		return nil // unreachable
+	}
+	return log.(*QueryLog)
+}
+
+// AssertQueryCount fails the test if the number of queries executed through
+// the database since it was created, or since its log was last reset, is not
+// `n`. It is useful for catching N+1 query regressions. Queries are only
+// recorded when [Config.CaptureQueries] is enabled.
+//
+// Example:
+//
+//	db := pgtestdb.New(t, pgtestdb.Config{CaptureQueries: true, ...}, migrator)
+//	seed(t, db)
+//	pgtestdb.CapturedQueries(t, db).Reset()
+//	_, err := repo.ListPostsWithAuthors(ctx, db)
+//	pgtestdb.AssertQueryCount(t, db, 1)
+func AssertQueryCount(t TB, db *sql.DB, n int) {
+	t.Helper()
+	log := CapturedQueries(t, db)
+	if log == nil {
+		return // unreachable
+	}
+	queries := log.Queries()
+	if len(queries) == n {
+		return
+	}
+	lines := make([]string, len(queries))
+	for i, q := range queries {
+		lines[i] = fmt.Sprintf("  %d: %s", i+1, q)
+	}
+	t.Fatalf("expected %d queries, got %d:\n%s", n, len(queries), strings.Join(lines, "\n"))
+}
+
+// connectCapturing connects to the database described by the config, through
+// a wrapper around its driver that records every statement in the log and
+// every use of each connection in the tracker. Either may be nil.
+func (c Config) connectCapturing(log *QueryLog, tracker *connTracker) (*sql.DB, error) {
+	db, err := c.Connect()
+	if err != nil {
+		return nil, err
+	}
+	base := db.Driver()
+	if err := db.Close(); err != nil {
+		return nil, err
+	}
+	connector := &capturingConnector{dsn: c.URL(), driver: base, log: log, tracker: tracker}
+	if dc, ok := base.(driver.DriverContext); ok {
+		connector.base, err = dc.OpenConnector(c.URL())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sql.OpenDB(connector), nil
+}
+
+// capturingConnector opens connections with an underlying driver and wraps
+// them so that every statement is recorded.
+type capturingConnector struct {
+	dsn     string
+	driver  driver.Driver
+	base    driver.Connector // nil if the driver does not implement driver.DriverContext
+	log     *QueryLog
+	tracker *connTracker
+}
+
+func (c *capturingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	var conn driver.Conn
+	var err error
+	if c.base != nil {
+		conn, err = c.base.Connect(ctx)
+	} else {
+		conn, err = c.driver.Open(c.dsn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	wrapped := &capturingConn{Conn: conn, log: c.log, tracker: c.tracker}
+	if c.tracker != nil {
+		c.tracker.add(wrapped, backendPID(ctx, conn))
+	}
+	return wrapped, nil
+}
+
+func (c *capturingConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// capturingConn wraps a driver connection and records every statement
+// executed on it. It implements all of the optional interfaces that
+// database/sql checks for, falling back to the behavior database/sql would use
+// if the underlying connection does not.
+type capturingConn struct {
+	driver.Conn
+	log     *QueryLog
+	tracker *connTracker
+}
+
+// touch records the calling code as the last user of the connection, if
+// connections are being tracked.
+func (c *capturingConn) touch() {
+	if c.tracker != nil {
+		c.tracker.touch(c)
+	}
+}
+
+func (c *capturingConn) Close() error {
+	if c.tracker != nil {
+		c.tracker.remove(c)
+	}
+	return c.Conn.Close()
+}
+
+// Unwrap returns the underlying driver connection, for code that needs to use
+// driver-specific features through [sql.Conn.Raw].
+func (c *capturingConn) Unwrap() driver.Conn {
+	return c.Conn
+}
+
+func (c *capturingConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *capturingConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	c.touch()
+	var stmt driver.Stmt
+	var err error
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = preparer.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &capturingStmt{Stmt: stmt, query: query, conn: c}, nil
+}
+
+func (c *capturingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	c.touch()
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin() //nolint:staticcheck // fallback for drivers without BeginTx
+}
+
+func (c *capturingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	c.touch()
+	start := time.Now()
+	result, err := execer.ExecContext(ctx, query, args)
+	if errors.Is(err, driver.ErrSkip) {
+		// database/sql will prepare the statement and execute it through
+		// capturingStmt instead, which records it.
+		return nil, err
+	}
+	c.log.record(execQuery(query, args, start, result, err))
+	return result, err
+}
+
+func (c *capturingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	c.touch()
+	start := time.Now()
+	rows, err := queryer.QueryContext(ctx, query, args)
+	if errors.Is(err, driver.ErrSkip) {
+		return nil, err
+	}
+	return recordRows(c.log, query, args, start, rows, err)
+}
+
+func (c *capturingConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *capturingConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *capturingConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+func (c *capturingConn) CheckNamedValue(value *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+	return driver.ErrSkip
+}
+
+// capturingStmt wraps a prepared statement and records each execution.
+type capturingStmt struct {
+	driver.Stmt
+	query string
+	conn  *capturingConn
+}
+
+func (s *capturingStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	s.conn.touch()
+	start := time.Now()
+	var result driver.Result
+	var err error
+	if execer, ok := s.Stmt.(driver.StmtExecContext); ok {
+		result, err = execer.ExecContext(ctx, args)
+	} else {
+		var values []driver.Value
+		if values, err = namedValuesToValues(args); err == nil {
+			result, err = s.Stmt.Exec(values) //nolint:staticcheck // fallback for drivers without ExecContext
+		}
+	}
+	s.conn.log.record(execQuery(s.query, args, start, result, err))
+	return result, err
+}
+
+func (s *capturingStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	s.conn.touch()
+	start := time.Now()
+	var rows driver.Rows
+	var err error
+	if queryer, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = queryer.QueryContext(ctx, args)
+	} else {
+		var values []driver.Value
+		if values, err = namedValuesToValues(args); err == nil {
+			rows, err = s.Stmt.Query(values) //nolint:staticcheck // fallback for drivers without QueryContext
+		}
+	}
+	return recordRows(s.conn.log, s.query, args, start, rows, err)
+}
+
+func (s *capturingStmt) CheckNamedValue(value *driver.NamedValue) error {
+	if checker, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+	return driver.ErrSkip
+}
+
+// capturingRows counts the rows read from a query, and records the count
+// when the rows are closed.
+type capturingRows struct {
+	driver.Rows
+	log   *QueryLog
+	query *Query // the entry in the log, nil if queries aren't captured
+	count int64
+}
+
+func (r *capturingRows) Next(dest []driver.Value) error {
+	err := r.Rows.Next(dest)
+	if err == nil {
+		r.count++
+	}
+	return err
+}
+
+func (r *capturingRows) Close() error {
+	r.log.setRows(r.query, r.count)
+	return r.Rows.Close()
+}
+
+// The rest of the methods of capturingRows forward the optional interfaces of
+// the underlying rows, returning the same defaults that database/sql uses if
+// the underlying rows do not implement them.
+
+func (r *capturingRows) HasNextResultSet() bool {
+	if next, ok := r.Rows.(driver.RowsNextResultSet); ok {
+		return next.HasNextResultSet()
+	}
+	return false
+}
+
+func (r *capturingRows) NextResultSet() error {
+	if next, ok := r.Rows.(driver.RowsNextResultSet); ok {
+		return next.NextResultSet()
+	}
+	return io.EOF
+}
+
+func (r *capturingRows) ColumnTypeScanType(index int) reflect.Type {
+	if typer, ok := r.Rows.(driver.RowsColumnTypeScanType); ok {
+		return typer.ColumnTypeScanType(index)
+	}
+	return reflect.TypeOf(new(any)).Elem()
+}
+
+func (r *capturingRows) ColumnTypeDatabaseTypeName(index int) string {
+	if typer, ok := r.Rows.(driver.RowsColumnTypeDatabaseTypeName); ok {
+		return typer.ColumnTypeDatabaseTypeName(index)
+	}
+	return ""
+}
+
+func (r *capturingRows) ColumnTypeLength(index int) (int64, bool) {
+	if typer, ok := r.Rows.(driver.RowsColumnTypeLength); ok {
+		return typer.ColumnTypeLength(index)
+	}
+	return 0, false
+}
+
+func (r *capturingRows) ColumnTypeNullable(index int) (bool, bool) {
+	if typer, ok := r.Rows.(driver.RowsColumnTypeNullable); ok {
+		return typer.ColumnTypeNullable(index)
+	}
+	return false, false
+}
+
+func (r *capturingRows) ColumnTypePrecisionScale(index int) (int64, int64, bool) {
+	if typer, ok := r.Rows.(driver.RowsColumnTypePrecisionScale); ok {
+		return typer.ColumnTypePrecisionScale(index)
+	}
+	return 0, 0, false
+}
+
+func execQuery(query string, args []driver.NamedValue, start time.Time, result driver.Result, err error) Query {
+	q := Query{SQL: query, Args: namedValueArgs(args), Start: start, Duration: time.Since(start), Err: err}
+	if result != nil {
+		if affected, rerr := result.RowsAffected(); rerr == nil {
+			q.Rows = affected
+		}
+	}
+	return q
+}
+
+func recordRows(
+	log *QueryLog,
+	query string,
+	args []driver.NamedValue,
+	start time.Time,
+	rows driver.Rows,
+	err error,
+) (driver.Rows, error) {
+	recorded := log.record(Query{SQL: query, Args: namedValueArgs(args), Start: start, Duration: time.Since(start), Err: err})
+	if err != nil {
+		return nil, err
+	}
+	return &capturingRows{Rows: rows, log: log, query: recorded}, nil
+}
+
+func namedValueArgs(args []driver.NamedValue) []any {
+	if len(args) == 0 {
+		return nil
+	}
+	values := make([]any, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	return values
+}
+
+func namedValuesToValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, fmt.Errorf("pgtestdb: driver does not support named arguments: %s", arg.Name)
+		}
+		values[i] = arg.Value
+	}
+	return values, nil
+}
+
+var (
+	_ driver.Connector                      = (*capturingConnector)(nil)
+	_ driver.ConnPrepareContext             = (*capturingConn)(nil)
+	_ driver.ConnBeginTx                    = (*capturingConn)(nil)
+	_ driver.ExecerContext                  = (*capturingConn)(nil)
+	_ driver.QueryerContext                 = (*capturingConn)(nil)
+	_ driver.Pinger                         = (*capturingConn)(nil)
+	_ driver.SessionResetter                = (*capturingConn)(nil)
+	_ driver.Validator                      = (*capturingConn)(nil)
+	_ driver.NamedValueChecker              = (*capturingConn)(nil)
+	_ driver.StmtExecContext                = (*capturingStmt)(nil)
+	_ driver.StmtQueryContext               = (*capturingStmt)(nil)
+	_ driver.NamedValueChecker              = (*capturingStmt)(nil)
+	_ driver.RowsNextResultSet              = (*capturingRows)(nil)
+	_ driver.RowsColumnTypeScanType         = (*capturingRows)(nil)
+	_ driver.RowsColumnTypeDatabaseTypeName = (*capturingRows)(nil)
+	_ driver.RowsColumnTypeLength           = (*capturingRows)(nil)
+	_ driver.RowsColumnTypeNullable         = (*capturingRows)(nil)
+	_ driver.RowsColumnTypePrecisionScale   = (*capturingRows)(nil)
+)
@@ -0,0 +1,179 @@
+package pgtestdb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/peterldowns/pgtestdb/internal/once"
+	"github.com/peterldowns/pgtestdb/internal/sessionlock"
+)
+
+const (
+	// DefaultCloneRetryTimeout is how long pgtestdb retries cloning a template
+	// that is in use by another connection, unless
+	// [Config.CloneRetryTimeout] is set.
+	DefaultCloneRetryTimeout = 30 * time.Second
+	// sqlStateObjectInUse is the SQLSTATE of the error returned when a
+	// template can't be copied because "source database is being accessed by
+	// other users".
+	sqlStateObjectInUse = "55006"
+)
+
+// A RetryPolicy decides whether an error that failed the creation of a
+// template or role is transient. Transient errors are returned to the tests
+// that were waiting for that attempt, and the next test tries again. Other
+// errors are returned to every later test in the program, so that the suite
+// fails fast.
+type RetryPolicy func(err error) bool
+
+// IsTransientError is the default [RetryPolicy]. It treats as transient the
+// server errors whose SQLSTATE is in a class that describes the connection or
+// the server rather than the migrations (08, 40, 53, 55, 57, and 58), network
+// errors, connections that were closed, and timeouts and cancellations. Other
+// errors, like syntax errors in a migration, are permanent.
+func IsTransientError(err error) bool {
+	var coded interface{ SQLState() string }
+	if errors.As(err, &coded) {
+		code := coded.SQLState()
+		if len(code) != 5 {
+			return false
+		}
+		switch code[:2] {
+		case "08", "40", "53", "55", "57", "58":
+			return true
+		}
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, sessionlock.ErrTimeout) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, context.Canceled)
+}
+
+// retryableError marks an error that [Config.TemplateRetryPolicy] decided is
+// transient, so that it is forgotten by the once.Maps that cache templates and
+// roles. It is otherwise transparent.
+type retryableError struct {
+	error
+}
+
+func (e retryableError) Unwrap() error {
+	return e.error
+}
+
+// forgetRetryable configures the once.Maps that cache templates, roles, and
+// details of each server to forget the errors marked by [Config.retryable].
+var forgetRetryable = once.MapOptions{ //nolint:gochecknoglobals
+	Forget: func(err error) bool {
+		var retryable retryableError
+		return errors.As(err, &retryable)
+	},
+}
+
+// retryable marks the error as retryable if the retry policy decides it is
+// transient.
+func (c Config) retryable(err error) error {
+	policy := c.TemplateRetryPolicy
+	if policy == nil {
+		policy = IsTransientError
+	}
+	if err == nil || !policy(err) {
+		return err
+	}
+	return retryableError{err}
+}
+
+// isObjectInUse returns true if the error is from the server and has the
+// object_in_use SQLSTATE. Both pgx and lib/pq errors report their SQLSTATE
+// with a SQLState() method.
+func isObjectInUse(err error) bool {
+	var coded interface{ SQLState() string }
+	return errors.As(err, &coded) && coded.SQLState() == sqlStateObjectInUse
+}
+
+// cloneWithRetry calls clone until it succeeds, fails for some reason other
+// than the template being in use, or `conf.CloneRetryTimeout` has passed.
+// While the template is in use, the connections to it are logged every so
+// often, and if `conf.TerminateTemplateConnections` is set and the template was
+// created by pgtestdb, they are terminated.
+func cloneWithRetry(
+	ctx context.Context,
+	t TB,
+	conf Config,
+	baseDB *sql.DB,
+	template string,
+	clone func() (*Config, error),
+) (*Config, error) {
+	timeout := conf.CloneRetryTimeout
+	if timeout == 0 {
+		timeout = DefaultCloneRetryTimeout
+	}
+	start := time.Now()
+	deadline := start.Add(timeout)
+	terminate := conf.TerminateTemplateConnections && strings.HasPrefix(template, templatePrefix)
+	wait := 10 * time.Millisecond
+	lastLog := time.Time{}
+	for {
+		instance, err := clone()
+		if err == nil || !isObjectInUse(err) {
+			return instance, err
+		}
+		holders := listTemplateHolders(ctx, baseDB, template)
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf(
+				"template %s is still being used by other connections after %s: %s; "+
+					"close them, increase CloneRetryTimeout, or set TerminateTemplateConnections: %w",
+				template, time.Since(start).Round(time.Millisecond), strings.Join(holders, "; "), err,
+			)
+		}
+		if time.Since(lastLog) >= waitLogInterval {
+			lastLog = time.Now()
+			if terminate {
+				t.Logf("pgtestdb: terminating the connections to template %s so that it can be cloned:", template)
+			} else {
+				t.Logf("pgtestdb: waiting for the connections to template %s to close so that it can be cloned:", template)
+			}
+			for _, holder := range holders {
+				t.Logf("  %s", holder)
+			}
+		}
+		if terminate {
+			query := `SELECT pg_terminate_backend(pid) FROM pg_stat_activity
+				WHERE datname = $1 AND pid <> pg_backend_pid()`
+			if _, err := baseDB.ExecContext(ctx, query, template); err != nil {
+				return nil, fmt.Errorf("failed to terminate connections to template %s: %w", template, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		wait = min(2*wait, time.Second)
+	}
+}
+
+// listTemplateHolders describes the connections to a template, for logging.
+// Any error is reported as the only holder, since it's only used for logging.
+func listTemplateHolders(ctx context.Context, baseDB *sql.DB, template string) []string {
+	backends, err := listBackends(ctx, baseDB, template)
+	if err != nil {
+		return []string{fmt.Sprintf("(%s)", err)}
+	}
+	holders := make([]string, 0, len(backends))
+	for _, b := range backends {
+		holders = append(holders, b.String())
+	}
+	return holders
+}
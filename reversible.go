@@ -0,0 +1,141 @@
+package pgtestdb
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/peterldowns/pgtestdb/internal/catalog"
+)
+
+// DefaultBookkeepingTables contains the names of the tables that the supported
+// migration frameworks use to keep track of which migrations have been
+// applied. These tables are ignored when comparing schemas, since their
+// presence and contents depend on the framework rather than on the
+// migrations.
+func DefaultBookkeepingTables() []string {
+	return []string{
+		"atlas_schema_revisions", // atlas
+		"bun_migration_locks",    // bun
+		"bun_migrations",         // bun
+		"goose_db_version",       // goose
+		"gorp_migrations",        // sql-migrate
+		"pgmigrate_migrations",   // pgmigrate
+		"schema_migrations",      // golang-migrate, dbmate
+		"schema_version",         // tern
+	}
+}
+
+// bookkeepingOptions returns catalog options that leave out the
+// [DefaultBookkeepingTables], the schema that atlas keeps its revisions in,
+// and any other tables that the caller wants to ignore.
+func bookkeepingOptions(ignoreTables []string) catalog.Options {
+	return catalog.Options{
+		ExcludeTables:  append(DefaultBookkeepingTables(), ignoreTables...),
+		ExcludeSchemas: []string{"atlas_schema_revisions"},
+	}
+}
+
+// A StepMigrator is a [Migrator] that can also apply and revert its migrations
+// one at a time. It is used by [CheckReversible] to verify that each
+// migration's down migration actually undoes its changes.
+type StepMigrator interface {
+	Migrator
+	// StepUp applies the next pending migration and returns an identifier for
+	// it, like its version or filename. If there are no pending migrations,
+	// it returns an empty string.
+	StepUp(context.Context, *sql.DB, Config) (string, error)
+	// StepDown reverts the most recently applied migration.
+	StepDown(context.Context, *sql.DB, Config) error
+}
+
+// CheckReversible verifies that each of the migrator's migrations can be
+// reverted. Starting from a new, empty, database, for each migration it will:
+//
+//   - apply the migration with StepUp
+//   - revert the migration with StepDown, and check that the schema is the
+//     same as it was before the migration was applied
+//   - re-apply the migration with StepUp, and check that the schema is the
+//     same as it was after the migration was first applied
+//
+// If any of these steps fail, the test is failed with `t.Fatalf()` and a
+// description of the first broken migration. The tables listed in
+// [DefaultBookkeepingTables], along with any `ignoreTables`, are left out of
+// the comparisons.
+func CheckReversible(t TB, conf Config, migrator StepMigrator, ignoreTables ...string) {
+	t.Helper()
+	ctx := context.Background()
+	instance := Custom(t, conf, NoopMigrator{})
+	db, err := instance.Connect()
+	if err != nil {
+		t.Fatalf("failed to connect to instance: %s", err)
+		return // unreachable
+	}
+	t.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			t.Fatalf("could not close test database: '%s': %s", instance.Database, err)
+		}
+	})
+
+	opts := bookkeepingOptions(ignoreTables)
+	describe := func(when string) (string, bool) {
+		desc, err := catalog.Describe(ctx, db, opts)
+		if err != nil {
+			t.Fatalf("failed to describe schema %s: %s", when, err)
+			return "", false // unreachable
+		}
+		return desc, true
+	}
+
+	before, ok := describe("before migrating")
+	if !ok {
+		return // unreachable
+	}
+	previous := "(none)"
+	for {
+		version, err := migrator.StepUp(ctx, db, *instance)
+		if err != nil {
+			t.Fatalf("failed to apply the migration after %s: %s", previous, err)
+			return // unreachable
+		}
+		if version == "" {
+			return
+		}
+		after, ok := describe("after applying " + version)
+		if !ok {
+			return // unreachable
+		}
+
+		if err := migrator.StepDown(ctx, db, *instance); err != nil {
+			t.Fatalf("failed to revert migration %s: %s", version, err)
+			return // unreachable
+		}
+		reverted, ok := describe("after reverting " + version)
+		if !ok {
+			return // unreachable
+		}
+		if diff := schemaDiff(before, reverted); diff != "" {
+			t.Fatalf("reverting migration %s did not restore the previous schema (-before +reverted):\n%s", version, diff)
+			return // unreachable
+		}
+
+		reapplied, err := migrator.StepUp(ctx, db, *instance)
+		if err != nil {
+			t.Fatalf("failed to re-apply migration %s: %s", version, err)
+			return // unreachable
+		}
+		if reapplied != version {
+			t.Fatalf("re-applying migration %s applied %q instead", version, reapplied)
+			return // unreachable
+		}
+		again, ok := describe("after re-applying " + version)
+		if !ok {
+			return // unreachable
+		}
+		if diff := schemaDiff(after, again); diff != "" {
+			t.Fatalf("re-applying migration %s after reverting it resulted in a different schema (-applied +re-applied):\n%s", version, diff)
+			return // unreachable
+		}
+		before = after
+		previous = version
+	}
+}
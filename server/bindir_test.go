@@ -0,0 +1,36 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/peterldowns/testy/check"
+)
+
+func TestSortNewestFirstComparesVersionsNumerically(t *testing.T) {
+	t.Parallel()
+	dirs := []string{
+		"/usr/lib/postgresql/9.6/bin",
+		"/usr/lib/postgresql/16/bin",
+		"/usr/lib/postgresql/12/bin",
+	}
+	sortNewestFirst(dirs)
+	check.Equal(t, []string{
+		"/usr/lib/postgresql/16/bin",
+		"/usr/lib/postgresql/12/bin",
+		"/usr/lib/postgresql/9.6/bin",
+	}, dirs)
+
+	dirs = []string{
+		"/opt/homebrew/opt/postgresql/bin",
+		"/opt/homebrew/opt/postgresql@9.6/bin",
+		"/opt/homebrew/opt/postgresql@16/bin",
+		"/opt/homebrew/opt/postgresql@12/bin",
+	}
+	sortNewestFirst(dirs)
+	check.Equal(t, []string{
+		"/opt/homebrew/opt/postgresql@16/bin",
+		"/opt/homebrew/opt/postgresql@12/bin",
+		"/opt/homebrew/opt/postgresql@9.6/bin",
+		"/opt/homebrew/opt/postgresql/bin",
+	}, dirs)
+}
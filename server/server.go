@@ -0,0 +1,488 @@
+// server package runs a disposable postgres server for tests, using the
+// postgres binaries installed on the machine, so that running the tests
+// doesn't require starting a server by hand or with docker first.
+//
+// The server is shared by every test process that uses the same [Options.Dir],
+// such as the test binaries that `go test ./...` runs for each package, and
+// is shut down by the last of them to call [Server.Stop].
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/peterldowns/pgtestdb"
+	"github.com/peterldowns/pgtestdb/internal/flock"
+)
+
+const (
+	// User is the superuser that the server is initialized with. The server
+	// trusts every local connection, so no password is needed.
+	User = "postgres"
+	// Password is set on the returned [pgtestdb.Config] for completeness; the
+	// server doesn't check it.
+	Password = "password"
+	// socketPort is the port used in the name of the server's unix socket when
+	// [Options.UnixSocket] is set. Each server has its own socket directory,
+	// so it doesn't need to be unique.
+	socketPort = 5432
+)
+
+// ErrNotFound is returned by [Start] if the postgres binaries can't be found.
+// Tests can check for it to fall back to another server, or to skip.
+var ErrNotFound = errors.New("could not find the postgres binaries (initdb, pg_ctl, postgres), install postgres or set Options.BinDir")
+
+// Options configures the server started by [Start]. The zero value is ready
+// to use.
+type Options struct {
+	// BinDir is the directory containing the `initdb`, `pg_ctl`, and
+	// `postgres` binaries. If empty, they are looked up on the PATH and then
+	// in the directories that common package managers install them to.
+	BinDir string
+	// Dir is the directory that holds the server's data, socket, log, and lock
+	// files. Every process using the same Dir shares the same server. If
+	// empty, a directory named after the current user and the postgres
+	// binaries is created in /dev/shm, if it exists, or else in the system's
+	// temporary directory.
+	Dir string
+	// If true, UnixSocket makes the server listen only on a unix socket in
+	// Dir, instead of on a free TCP port on 127.0.0.1.
+	UnixSocket bool
+	// Settings are written to the server's configuration file, overriding
+	// the [DefaultSettings]. They take effect the next time the server
+	// starts. Values are written as-is, so values that contain spaces or
+	// punctuation must be single-quoted: `"log_line_prefix": "'%m [%p] '"`.
+	Settings map[string]string
+	// DriverName is the DriverName of the returned [pgtestdb.Config].
+	// Defaults to "pgx".
+	DriverName string
+}
+
+// DefaultSettings returns the settings that the server is configured with
+// unless they are overridden by [Options.Settings]. They match the settings
+// in pgtestdb's docker-compose.yml, trading durability for speed.
+func DefaultSettings() map[string]string {
+	return map[string]string{
+		"fsync":              "off",
+		"synchronous_commit": "off",
+		"full_page_writes":   "off",
+		"shared_buffers":     "1024MB",
+		"max_connections":    "1000",
+		"log_line_prefix":    "'%m [%p] %q%a@%d '",
+	}
+}
+
+// Server is a running postgres server. Create one with [Start].
+type Server struct {
+	bin     string
+	dir     string
+	port    int
+	opts    Options
+	users   *flock.File
+	stopped bool
+}
+
+// Start starts the server described by the options, or connects to it if
+// another process has already started it. Call [Server.Stop] when the tests
+// are done with it, usually from TestMain; see [Main].
+func Start(opts Options) (*Server, error) {
+	bin, err := findBinDir(opts.BinDir)
+	if err != nil {
+		return nil, err
+	}
+	dir := opts.Dir
+	if dir == "" {
+		dir = defaultDir(bin, opts.UnixSocket)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create server directory %s: %w", dir, err)
+	}
+	s := &Server{bin: bin, dir: dir, opts: opts}
+
+	// The lock file serializes starting and stopping the server between
+	// processes.
+	lock, err := flock.Open(filepath.Join(dir, "lock"))
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+	if err := lock.Lock(); err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(filepath.Join(s.dataDir(), "PG_VERSION")); errors.Is(err, os.ErrNotExist) {
+		if err := s.initdb(); err != nil {
+			return nil, err
+		}
+	}
+	running, err := s.running()
+	if err != nil {
+		return nil, err
+	}
+	if running {
+		s.port, err = readPort(s.dataDir())
+		if err != nil {
+			return nil, err
+		}
+	} else if err := s.start(); err != nil {
+		return nil, err
+	}
+
+	// Every process using the server holds a shared lock on the users file,
+	// so that the last one to stop can tell that it is the last.
+	s.users, err = flock.Open(filepath.Join(dir, "users"))
+	if err != nil {
+		return nil, err
+	}
+	if err := s.users.RLock(); err != nil {
+		s.users.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Config returns the configuration for connecting to the server as its
+// superuser, ready to pass to [pgtestdb.New]. Its ServerLogPath is set to
+// the server's log file, for use with DiagnoseFailures.
+func (s *Server) Config() pgtestdb.Config {
+	driverName := s.opts.DriverName
+	if driverName == "" {
+		driverName = "pgx"
+	}
+	conf := pgtestdb.Config{
+		DriverName:    driverName,
+		User:          User,
+		Password:      Password,
+		Host:          "127.0.0.1",
+		Port:          strconv.Itoa(s.port),
+		Database:      "postgres",
+		Options:       "sslmode=disable",
+		ServerLogPath: s.LogPath(),
+	}
+	if s.opts.UnixSocket {
+		conf.Host = ""
+		conf.Options = "host=" + url.QueryEscape(s.dir) + "&sslmode=disable"
+	}
+	return conf
+}
+
+// Dir returns the directory that holds the server's data, socket, log, and
+// lock files.
+func (s *Server) Dir() string {
+	return s.dir
+}
+
+// LogPath returns the path of the server's log file.
+func (s *Server) LogPath() string {
+	return filepath.Join(s.dir, "server.log")
+}
+
+// Stop releases this process's use of the server, and shuts the server down
+// if no other process is using it. It is safe to call more than once.
+func (s *Server) Stop() error {
+	if s.stopped {
+		return nil
+	}
+	s.stopped = true
+	lock, err := flock.Open(filepath.Join(s.dir, "lock"))
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := lock.Lock(); err != nil {
+		return err
+	}
+	defer s.users.Close()
+	if err := s.users.Unlock(); err != nil {
+		return err
+	}
+	last, err := s.users.TryLock()
+	if err != nil || !last {
+		return err
+	}
+	return s.pgctl("stop", "-D", s.dataDir(), "-m", "fast", "-w")
+}
+
+// Main starts the server, stores its configuration in `conf`, runs the tests,
+// stops the server, and exits. Call it from TestMain:
+//
+//	var conf pgtestdb.Config
+//
+//	func TestMain(m *testing.M) {
+//		server.Main(m, server.Options{}, &conf)
+//	}
+func Main(m interface{ Run() int }, opts Options, conf *pgtestdb.Config) {
+	s, err := Start(opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "pgtestdb/server: %s\n", err)
+		os.Exit(1)
+	}
+	*conf = s.Config()
+	code := m.Run()
+	if err := s.Stop(); err != nil {
+		fmt.Fprintf(os.Stderr, "pgtestdb/server: %s\n", err)
+		if code == 0 {
+			code = 1
+		}
+	}
+	os.Exit(code)
+}
+
+func (s *Server) dataDir() string {
+	return filepath.Join(s.dir, "data")
+}
+
+// initdb creates a new cluster in the data directory, and includes the
+// settings file that is rewritten every time the server starts.
+func (s *Server) initdb() error {
+	// A previous attempt may have failed part way through.
+	if err := os.RemoveAll(s.dataDir()); err != nil {
+		return fmt.Errorf("failed to remove incomplete cluster %s: %w", s.dataDir(), err)
+	}
+	err := s.run("initdb",
+		"--pgdata", s.dataDir(),
+		"--username", User,
+		"--auth", "trust",
+		"--encoding", "UTF8",
+		"--no-locale",
+		"--no-sync",
+	)
+	if err != nil {
+		return err
+	}
+	conf, err := os.OpenFile(filepath.Join(s.dataDir(), "postgresql.conf"), os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to configure cluster: %w", err)
+	}
+	defer conf.Close()
+	if _, err := conf.WriteString("\ninclude 'pgtestdb.conf'\n"); err != nil {
+		return fmt.Errorf("failed to configure cluster: %w", err)
+	}
+	return nil
+}
+
+// start picks a port, writes the settings, and starts the server, waiting
+// until it is ready to accept connections.
+func (s *Server) start() error {
+	s.port = socketPort
+	if !s.opts.UnixSocket {
+		port, err := freePort()
+		if err != nil {
+			return err
+		}
+		s.port = port
+	}
+	settings := renderSettings(s.settings())
+	if err := os.WriteFile(filepath.Join(s.dataDir(), "pgtestdb.conf"), []byte(settings), 0o600); err != nil {
+		return fmt.Errorf("failed to configure cluster: %w", err)
+	}
+	return s.pgctl("start", "-D", s.dataDir(), "-l", s.LogPath(), "-w")
+}
+
+// settings returns every setting for the server, including the ones that
+// pgtestdb controls.
+func (s *Server) settings() map[string]string {
+	settings := DefaultSettings()
+	for key, value := range s.opts.Settings {
+		settings[key] = value
+	}
+	settings["port"] = strconv.Itoa(s.port)
+	settings["unix_socket_directories"] = quote(s.dir)
+	if s.opts.UnixSocket {
+		settings["listen_addresses"] = "''"
+	} else {
+		settings["listen_addresses"] = "'127.0.0.1'"
+	}
+	return settings
+}
+
+// running returns true if the server is running.
+func (s *Server) running() (bool, error) {
+	cmd := exec.Command(filepath.Join(s.bin, "pg_ctl"), "status", "-D", s.dataDir())
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 3:
+		// pg_ctl exits with status 3 if the server isn't running.
+		return false, nil
+	default:
+		return false, fmt.Errorf("failed to check server status: %w", err)
+	}
+}
+
+func (s *Server) pgctl(args ...string) error {
+	return s.run("pg_ctl", args...)
+}
+
+func (s *Server) run(name string, args ...string) error {
+	var output bytes.Buffer
+	cmd := exec.Command(filepath.Join(s.bin, name), args...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s failed: %w\n%s", name, args[0], err, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
+
+// renderSettings formats settings as the lines of a postgresql.conf file,
+// sorted by name. Values must already be quoted if necessary.
+func renderSettings(settings map[string]string) string {
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString("# Written by pgtestdb/server every time the server starts.\n")
+	for _, key := range keys {
+		fmt.Fprintf(&b, "%s = %s\n", key, settings[key])
+	}
+	return b.String()
+}
+
+// quote quotes a string for use as a value in postgresql.conf.
+func quote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// readPort returns the port that a running server is listening on, from the
+// fourth line of its postmaster.pid file.
+func readPort(dataDir string) (int, error) {
+	contents, err := os.ReadFile(filepath.Join(dataDir, "postmaster.pid"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read postmaster.pid: %w", err)
+	}
+	return parsePort(string(contents))
+}
+
+func parsePort(pidFile string) (int, error) {
+	lines := strings.Split(pidFile, "\n")
+	if len(lines) < 4 {
+		return 0, errors.New("failed to read port from postmaster.pid: file is incomplete")
+	}
+	port, err := strconv.Atoi(strings.TrimSpace(lines[3]))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read port from postmaster.pid: %w", err)
+	}
+	return port, nil
+}
+
+// freePort returns a TCP port on 127.0.0.1 that nothing is listening on.
+func freePort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, fmt.Errorf("failed to find a free port: %w", err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// findBinDir returns the directory containing the postgres binaries.
+func findBinDir(binDir string) (string, error) {
+	if binDir != "" {
+		if !hasBinaries(binDir) {
+			return "", fmt.Errorf("%w: they are not all in %s", ErrNotFound, binDir)
+		}
+		return binDir, nil
+	}
+	if pgctl, err := exec.LookPath("pg_ctl"); err == nil {
+		if dir := filepath.Dir(pgctl); hasBinaries(dir) {
+			return dir, nil
+		}
+	}
+	for _, pattern := range []string{
+		"/usr/lib/postgresql/*/bin",         // debian, ubuntu
+		"/usr/pgsql-*/bin",                  // fedora, rhel
+		"/opt/homebrew/opt/postgresql*/bin", // homebrew on apple silicon
+		"/usr/local/opt/postgresql*/bin",    // homebrew on intel
+		"/Applications/Postgres.app/Contents/Versions/latest/bin",
+	} {
+		matches, _ := filepath.Glob(pattern)
+		sortNewestFirst(matches)
+		for _, dir := range matches {
+			if hasBinaries(dir) {
+				return dir, nil
+			}
+		}
+	}
+	return "", ErrNotFound
+}
+
+// versionPattern matches the postgres version in the name of the directory
+// that contains a bin directory, like "16" or "9.6" in "/usr/lib/postgresql/16"
+// or "/opt/homebrew/opt/postgresql@9.6".
+var versionPattern = regexp.MustCompile(`\d+(\.\d+)*`)
+
+// sortNewestFirst sorts bin directories so that the newest postgres version
+// comes first. Versions are compared by their numeric parts, so that 16 comes
+// before 9.6, and directories without a version come last.
+func sortNewestFirst(dirs []string) {
+	sort.SliceStable(dirs, func(i, j int) bool {
+		a, b := binDirVersion(dirs[i]), binDirVersion(dirs[j])
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] > b[k]
+			}
+		}
+		return len(a) > len(b)
+	})
+}
+
+// binDirVersion returns the numeric parts of the postgres version of a bin
+// directory, or nil if its parent directory's name doesn't contain one.
+func binDirVersion(dir string) []int {
+	match := versionPattern.FindString(filepath.Base(filepath.Dir(dir)))
+	if match == "" {
+		return nil
+	}
+	var version []int
+	for _, part := range strings.Split(match, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil
+		}
+		version = append(version, n)
+	}
+	return version
+}
+
+func hasBinaries(dir string) bool {
+	for _, name := range []string{"initdb", "pg_ctl", "postgres"} {
+		if runtime.GOOS == "windows" {
+			name += ".exe"
+		}
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil || info.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// defaultDir returns the directory for the server's files, which depends on
+// the user, the postgres binaries, and how the server listens, so that
+// different users and postgres versions get different servers.
+func defaultDir(binDir string, unixSocket bool) string {
+	parent := os.TempDir()
+	if info, err := os.Stat("/dev/shm"); err == nil && info.IsDir() {
+		parent = "/dev/shm"
+	}
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%t", binDir, unixSocket)))
+	return filepath.Join(parent, fmt.Sprintf("pgtestdb-%d-%s", os.Getuid(), hex.EncodeToString(hash[:])[:8]))
+}
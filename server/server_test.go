@@ -0,0 +1,78 @@
+package server_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	_ "github.com/jackc/pgx/v5/stdlib" // "pgx" driver
+	"github.com/peterldowns/testy/assert"
+	"github.com/peterldowns/testy/check"
+
+	"github.com/peterldowns/pgtestdb"
+	"github.com/peterldowns/pgtestdb/server"
+)
+
+func start(t *testing.T, opts server.Options) *server.Server {
+	t.Helper()
+	s, err := server.Start(opts)
+	if errors.Is(err, server.ErrNotFound) {
+		t.Skip(err)
+	}
+	assert.Nil(t, err)
+	return s
+}
+
+func ping(conf pgtestdb.Config) error {
+	db, err := conf.Connect()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Ping()
+}
+
+// Each call to Start holds its own lock, just like separate processes would,
+// so two servers in one test behave like two test binaries sharing a server.
+func TestServerIsSharedAndStoppedByLastUser(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() == 0 {
+		t.Skip("initdb refuses to run as root")
+	}
+	opts := server.Options{Dir: t.TempDir()}
+	first := start(t, opts)
+	second := start(t, opts)
+	check.Equal(t, first.Config(), second.Config())
+
+	// The test database is dropped at the end of the subtest, while the
+	// server is still running.
+	t.Run("new", func(t *testing.T) {
+		db := pgtestdb.New(t, first.Config(), pgtestdb.NoopMigrator{})
+		assert.Nil(t, db.Ping())
+	})
+
+	assert.Nil(t, first.Stop())
+	assert.Nil(t, ping(second.Config()))
+
+	assert.Nil(t, second.Stop())
+	check.NotEqual(t, nil, ping(second.Config()))
+}
+
+func TestServerListensOnUnixSocket(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() == 0 {
+		t.Skip("initdb refuses to run as root")
+	}
+	// Unix socket paths are limited to about 100 bytes, which the directories
+	// returned by t.TempDir() can exceed.
+	dir, err := os.MkdirTemp("", "pgtestdb-server")
+	assert.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	s := start(t, server.Options{Dir: dir, UnixSocket: true})
+	t.Cleanup(func() { _ = s.Stop() })
+	conf := s.Config()
+	check.Equal(t, "", conf.Host)
+	check.Equal(t, s.LogPath(), conf.ServerLogPath)
+	assert.Nil(t, ping(conf))
+}
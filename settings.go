@@ -0,0 +1,250 @@
+package pgtestdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/peterldowns/pgtestdb/internal/once"
+	"github.com/peterldowns/pgtestdb/migrators/common"
+)
+
+// ServerSettings describes the parts of a postgres server's configuration that
+// can change the result of migrating a template database.
+type ServerSettings struct {
+	// Version is the `server_version_num` of the server, "150004".
+	Version string `json:"version"`
+	// Encoding is the encoding that new databases are created with, "UTF8".
+	Encoding string `json:"encoding"`
+	// Collate is the LC_COLLATE that new databases are created with, "en_US.utf8".
+	Collate string `json:"collate"`
+	// Ctype is the LC_CTYPE that new databases are created with, "en_US.utf8".
+	Ctype string `json:"ctype"`
+	// Extensions contains the version of every extension installed in
+	// template1, which new databases start with, keyed by name. Extensions
+	// that are only available on the server are left out, so that installing
+	// an unrelated extension package doesn't change the settings.
+	Extensions map[string]string `json:"extensions"`
+}
+
+// queryer is implemented by both *sql.DB and *sql.Conn.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// serverSettings caches the settings of each server, since reading them takes
+// several queries.
+var serverSettings once.Map[string, ServerSettings] = once.NewMapWithOptions[string, ServerSettings](forgetRetryable) //nolint:gochecknoglobals
+
+// cachedServerSettings reads the [ServerSettings] of the server once per
+// program.
+func cachedServerSettings(ctx context.Context, baseDB *sql.DB, conf Config) (*ServerSettings, error) {
+	return serverSettings.Set(conf.serverKey(), func() (*ServerSettings, error) {
+		settings, err := getServerSettings(ctx, baseDB, conf)
+		return settings, conf.retryable(err)
+	})
+}
+
+// getServerSettings reads the current [ServerSettings] of the server that `db`
+// is connected to, and that `conf` describes.
+func getServerSettings(ctx context.Context, db queryer, conf Config) (*ServerSettings, error) {
+	settings := ServerSettings{}
+	query := "SELECT current_setting('server_version_num')"
+	if err := db.QueryRowContext(ctx, query).Scan(&settings.Version); err != nil {
+		return nil, fmt.Errorf("failed to read server version: %w", err)
+	}
+	// New databases are copies of template1, so they inherit its settings.
+	query = `SELECT pg_encoding_to_char(encoding), datcollate, datctype
+		FROM pg_database WHERE datname = 'template1'`
+	if err := db.QueryRowContext(ctx, query).Scan(&settings.Encoding, &settings.Collate, &settings.Ctype); err != nil {
+		return nil, fmt.Errorf("failed to read server encoding and locale: %w", err)
+	}
+	var err error
+	settings.Extensions, err = template1Extensions(ctx, conf)
+	if err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+// template1Extensions returns the version of each extension installed in
+// template1. Extensions are installed per database, so this connects to
+// template1 itself. The connection is closed right away: `CREATE DATABASE`
+// copies template1, and waits for up to 5 seconds for other connections to it
+// to go away before failing.
+func template1Extensions(ctx context.Context, conf Config) (map[string]string, error) {
+	conf.Database = "template1"
+	db, err := conf.Connect()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template1 extensions: %w", err)
+	}
+	defer db.Close()
+	rows, err := db.QueryContext(ctx, "SELECT extname, extversion FROM pg_extension")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template1 extensions: %w", err)
+	}
+	defer rows.Close()
+	extensions := map[string]string{}
+	for rows.Next() {
+		var name, version string
+		if err := rows.Scan(&name, &version); err != nil {
+			return nil, fmt.Errorf("failed to read template1 extensions: %w", err)
+		}
+		extensions[name] = version
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read template1 extensions: %w", err)
+	}
+	return extensions, nil
+}
+
+// Hash returns a hash of the settings, suitable for including in the hash
+// that identifies a template.
+func (s ServerSettings) Hash() string {
+	return s.recursiveHash().String()
+}
+
+// recursiveHash returns the hash of the settings, with a manifest of each
+// setting.
+func (s ServerSettings) recursiveHash() common.RecursiveHash {
+	hash := common.NewRecursiveHashWithManifest(
+		common.Field("Version", s.Version),
+		common.Field("Encoding", s.Encoding),
+		common.Field("Collate", s.Collate),
+		common.Field("Ctype", s.Ctype),
+	)
+	for _, name := range sortedKeys(s.Extensions) {
+		hash.AddField("Extension:"+name, s.Extensions[name])
+	}
+	return hash
+}
+
+// Diff returns a human-readable description of every setting that differs
+// between two sets of settings. If the settings are the same, the result is
+// empty.
+//
+// Example:
+//
+//	version: 150004 -> 160001
+//	extension pg_trgm: 1.6 -> (missing)
+func (s ServerSettings) Diff(other ServerSettings) []string {
+	var out []string
+	compare := func(name, before, after string) {
+		if before != after {
+			out = append(out, fmt.Sprintf("%s: %s -> %s", name, before, after))
+		}
+	}
+	compare("version", s.Version, other.Version)
+	compare("encoding", s.Encoding, other.Encoding)
+	compare("collate", s.Collate, other.Collate)
+	compare("ctype", s.Ctype, other.Ctype)
+	names := map[string]bool{}
+	for name := range s.Extensions {
+		names[name] = true
+	}
+	for name := range other.Extensions {
+		names[name] = true
+	}
+	for _, name := range sortedKeys(names) {
+		before, ok := s.Extensions[name]
+		if !ok {
+			before = "(missing)"
+		}
+		after, ok := other.Extensions[name]
+		if !ok {
+			after = "(missing)"
+		}
+		compare("extension "+name, before, after)
+	}
+	return out
+}
+
+// StaleTemplate is a template that was created under different
+// [ServerSettings] than the server currently has.
+type StaleTemplate struct {
+	// Database is the name of the template database.
+	Database string
+	// Differences describes each setting that has changed since the template
+	// was created, see [ServerSettings.Diff].
+	Differences []string
+}
+
+// StaleTemplates connects to the server described by `conf` and returns every
+// pgtestdb template that was created under different [ServerSettings] than
+// the server currently has, including templates whose settings were not
+// recorded because they were created without [Config.IncludeServerSettings]
+// or by older versions of pgtestdb.
+//
+// Stale templates will continue to be used unless
+// [Config.IncludeServerSettings] is set, or they are dropped.
+func StaleTemplates(ctx context.Context, conf Config) ([]StaleTemplate, error) {
+	db, err := conf.Connect()
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to database: %w", err)
+	}
+	defer db.Close()
+
+	current, err := getServerSettings(ctx, db, conf)
+	if err != nil {
+		return nil, err
+	}
+	names, err := listTemplates(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	var stale []StaleTemplate
+	for _, name := range names {
+		metadata, err := readTemplateMetadata(ctx, db, name)
+		if err != nil && !errors.Is(err, errNoMetadata) {
+			return nil, err
+		}
+		if metadata == nil || metadata.Settings == nil {
+			stale = append(stale, StaleTemplate{
+				Database:    name,
+				Differences: []string{"no server settings were recorded for this template"},
+			})
+			continue
+		}
+		if diff := metadata.Settings.Diff(*current); len(diff) != 0 {
+			stale = append(stale, StaleTemplate{Database: name, Differences: diff})
+		}
+	}
+	return stale, nil
+}
+
+// listTemplates returns the names of every template database that was
+// created by pgtestdb.
+func listTemplates(ctx context.Context, db queryer) ([]string, error) {
+	query := `SELECT datname FROM pg_database
+		WHERE datistemplate = true AND starts_with(datname, $1)
+		ORDER BY datname`
+	rows, err := db.QueryContext(ctx, query, templatePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list templates: %w", err)
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("failed to list templates: %w", err)
+		}
+		names = append(names, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list templates: %w", err)
+	}
+	return names, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
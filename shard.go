@@ -0,0 +1,146 @@
+package pgtestdb
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync/atomic"
+)
+
+// A ShardStrategy chooses which of the [Config.Shards] a test database is
+// created on, and returns its index. The shards it is given have already been
+// merged with the rest of the Config, so they can be connected to directly.
+type ShardStrategy func(ctx context.Context, t TB, shards []Config) (int, error)
+
+// defaultShardStrategy is used when [Config.ShardStrategy] is not set.
+var defaultShardStrategy = RoundRobin() //nolint:gochecknoglobals
+
+// RoundRobin returns a [ShardStrategy] that creates each test database on the
+// shard after the one that the previous test database was created on.
+func RoundRobin() ShardStrategy {
+	var next atomic.Uint64
+	return func(_ context.Context, _ TB, shards []Config) (int, error) {
+		return int((next.Add(1) - 1) % uint64(len(shards))), nil
+	}
+}
+
+// LeastLoaded returns a [ShardStrategy] that creates each test database on
+// the shard with the fewest test databases, as counted in `pg_database`. Ties
+// are broken in round-robin order, so that tests starting at the same time are
+// still spread across the shards. Every shard is connected to for each test
+// database, and if any of them can't be reached, the test fails.
+func LeastLoaded() ShardStrategy {
+	var next atomic.Uint64
+	return func(ctx context.Context, _ TB, shards []Config) (int, error) {
+		offset := int((next.Add(1) - 1) % uint64(len(shards)))
+		best, bestCount := -1, 0
+		for i := range shards {
+			index := (offset + i) % len(shards)
+			count, err := countInstances(ctx, shards[index])
+			if err != nil {
+				return 0, err
+			}
+			if best == -1 || count < bestCount {
+				best, bestCount = index, count
+			}
+		}
+		return best, nil
+	}
+}
+
+// HashTestName returns a [ShardStrategy] that chooses a shard based on a hash
+// of the name of the test, so that each test always uses the same shard. If
+// the TB has no Name() method, every test database is created on the first
+// shard.
+func HashTestName() ShardStrategy {
+	return func(_ context.Context, t TB, shards []Config) (int, error) {
+		hash := fnv.New32a()
+		_, _ = hash.Write([]byte(testName(t)))
+		return int(hash.Sum32() % uint32(len(shards))), nil
+	}
+}
+
+// countInstances returns the number of test databases on a server.
+func countInstances(ctx context.Context, conf Config) (int, error) {
+	releaseBaseConn, err := conf.acquireBaseConn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer releaseBaseConn()
+	db, err := conf.Connect()
+	if err != nil {
+		return 0, fmt.Errorf("failed to connect to shard %s: %w", conf.serverKey(), err)
+	}
+	defer db.Close()
+	// Underscores are wildcards in LIKE patterns, so they are escaped.
+	pattern := strings.ReplaceAll(templatePrefix, "_", `\_`) + `%\_inst\_%`
+	var count int
+	query := "SELECT count(*) FROM pg_database WHERE datname LIKE $1"
+	if err := db.QueryRowContext(ctx, query, pattern).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count test databases on shard %s: %w", conf.serverKey(), err)
+	}
+	return count, nil
+}
+
+// chooseShard returns the Config of the server that a test database should be
+// created on. If there are no shards, it is the Config itself.
+func (c Config) chooseShard(ctx context.Context, t TB) (Config, error) {
+	if len(c.Shards) == 0 {
+		return c, nil
+	}
+	shards := make([]Config, len(c.Shards))
+	for i, shard := range c.Shards {
+		shards[i] = c.onShard(shard)
+	}
+	strategy := c.ShardStrategy
+	if strategy == nil {
+		strategy = defaultShardStrategy
+	}
+	index, err := strategy(ctx, t, shards)
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to choose a shard: %w", err)
+	}
+	if index < 0 || index >= len(shards) {
+		return Config{}, fmt.Errorf("failed to choose a shard: strategy returned %d, but there are %d shards", index, len(shards))
+	}
+	return shards[index], nil
+}
+
+// onShard returns a copy of the Config that connects to the given shard. The
+// fields that are set on the shard replace those of the Config.
+func (c Config) onShard(shard Config) Config {
+	if shard.DriverName != "" {
+		c.DriverName = shard.DriverName
+	}
+	if shard.Host != "" {
+		c.Host = shard.Host
+	}
+	if shard.Port != "" {
+		c.Port = shard.Port
+	}
+	if shard.User != "" {
+		c.User = shard.User
+	}
+	if shard.Password != "" {
+		c.Password = shard.Password
+	}
+	if shard.Database != "" {
+		c.Database = shard.Database
+	}
+	if shard.Options != "" {
+		c.Options = shard.Options
+	}
+	if shard.ServerLogPath != "" {
+		c.ServerLogPath = shard.ServerLogPath
+	}
+	c.Shards = nil
+	return c
+}
+
+// serverKey identifies the server that the Config connects to, so that roles
+// and templates are get-or-created once per server rather than once per
+// program.
+func (c Config) serverKey() string {
+	return fmt.Sprintf("%s:%s?%s", c.Host, c.Port, c.Options)
+}
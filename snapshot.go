@@ -0,0 +1,305 @@
+package pgtestdb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Snapshot records the rows of a set of tables at a point in time, so that a
+// test can later check which rows it inserted, updated, and deleted. Create
+// one with [TakeSnapshot].
+type Snapshot struct {
+	db     *sql.DB
+	tables []*tableSnapshot
+}
+
+// tableSnapshot records the rows of a single table, keyed by primary key.
+type tableSnapshot struct {
+	name        string   // the schema-qualified name of the table, "public.users"
+	quoted      string   // the quoted name of the table, for use in queries
+	key         []string // the columns of the primary key, if there is one
+	fingerprint string   // see currentFingerprint
+	rows        map[string]snapshotRow
+}
+
+// snapshotRow is a single row, as returned by to_jsonb().
+type snapshotRow struct {
+	text    string
+	columns map[string]json.RawMessage
+}
+
+// TakeSnapshot records the current rows of each of the given tables, or of
+// every table in the database if none are given. Table names may be
+// schema-qualified ("public.users") or not ("users"). If there is an error,
+// the test is failed with `t.Fatalf()`.
+//
+// Rows are identified by their primary key, so that a changed row is reported
+// as an update. Rows in tables without a primary key are identified by their
+// contents, so a changed row is reported as a deletion and an insertion.
+func TakeSnapshot(t TB, db *sql.DB, tables ...string) *Snapshot {
+	t.Helper()
+	ctx := context.Background()
+	if len(tables) == 0 {
+		var err error
+		tables, err = listUserTables(ctx, db)
+		if err != nil {
+			t.Fatalf("failed to list tables: %s", err)
+			return nil // unreachable
+		}
+	}
+	snapshot := &Snapshot{db: db}
+	for _, name := range tables {
+		table, err := newTableSnapshot(ctx, db, name)
+		if err != nil {
+			t.Fatalf("%s", err)
+			return nil // unreachable
+		}
+		if err := table.load(ctx, db); err != nil {
+			t.Fatalf("%s", err)
+			return nil // unreachable
+		}
+		snapshot.tables = append(snapshot.tables, table)
+	}
+	return snapshot
+}
+
+// Changes returns a description of every row that has been inserted, updated,
+// or deleted since the snapshot was taken, one per line, sorted. If nothing
+// has changed, the result is empty. If there is an error, the test is failed
+// with `t.Fatalf()`.
+//
+// Example:
+//
+//	deleted public.users (id=2): {"id": 2, "email": "bob@example.com"}
+//	inserted public.users (id=3): {"id": 3, "email": "carol@example.com"}
+//	updated public.users (id=1): email: "alice@example.com" -> "alice@example.org"
+func (s *Snapshot) Changes(t TB) []string {
+	t.Helper()
+	ctx := context.Background()
+	var changes []string
+	for _, before := range s.tables {
+		// Most tables are untouched by any given test, so the fingerprints of
+		// the tables are compared before fetching and decoding their rows.
+		// The counters in pg_stat_user_tables would be cheaper, but other
+		// connections report them asynchronously, so they may not include the
+		// test's most recent changes.
+		fingerprint, err := before.currentFingerprint(ctx, s.db)
+		if err != nil {
+			t.Fatalf("%s", err)
+			return nil // unreachable
+		}
+		if fingerprint == before.fingerprint {
+			continue
+		}
+		after := *before
+		if err := after.load(ctx, s.db); err != nil {
+			t.Fatalf("%s", err)
+			return nil // unreachable
+		}
+		changes = append(changes, before.diff(&after)...)
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// AssertChanges fails the test with a line-by-line diff if the rows that have
+// been inserted, updated, or deleted since the snapshot was taken are not
+// exactly the ones described by `want`, in the format returned by
+// [Snapshot.Changes]. The order of `want` does not matter.
+func (s *Snapshot) AssertChanges(t TB, want ...string) {
+	t.Helper()
+	got := s.Changes(t)
+	want = append([]string{}, want...)
+	sort.Strings(want)
+	if diff := schemaDiff(strings.Join(want, "\n"), strings.Join(got, "\n")); diff != "" {
+		t.Fatalf("unexpected changes to the database (-want +got):\n%s", diff)
+		return // unreachable
+	}
+}
+
+// AssertUnchanged fails the test if any rows have been inserted, updated, or
+// deleted since the snapshot was taken.
+func (s *Snapshot) AssertUnchanged(t TB) {
+	t.Helper()
+	s.AssertChanges(t)
+}
+
+// listUserTables returns the names of all of the tables in the database that
+// are not managed by postgres itself.
+func listUserTables(ctx context.Context, db *sql.DB) ([]string, error) {
+	query := `SELECT format('%I.%I', n.nspname, c.relname)
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'p')
+		AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+		AND n.nspname NOT LIKE 'pg\_toast%'
+		AND n.nspname NOT LIKE 'pg\_temp\_%'
+		ORDER BY 1`
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	return tables, rows.Err()
+}
+
+// newTableSnapshot looks up the full name and primary key of a table.
+func newTableSnapshot(ctx context.Context, db *sql.DB, name string) (*tableSnapshot, error) {
+	table := &tableSnapshot{}
+	query := `SELECT n.nspname || '.' || c.relname, format('%I.%I', n.nspname, c.relname)
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.oid = $1::text::regclass`
+	if err := db.QueryRowContext(ctx, query, name).Scan(&table.name, &table.quoted); err != nil {
+		return nil, fmt.Errorf("failed to find table %s: %w", name, err)
+	}
+	query = `SELECT a.attname
+		FROM pg_index i
+		CROSS JOIN LATERAL unnest(i.indkey) WITH ORDINALITY AS k(attnum, position)
+		JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = k.attnum
+		WHERE i.indrelid = $1::text::regclass
+		AND i.indisprimary
+		ORDER BY k.position`
+	rows, err := db.QueryContext(ctx, query, table.quoted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find primary key of %s: %w", table.name, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, fmt.Errorf("failed to find primary key of %s: %w", table.name, err)
+		}
+		table.key = append(table.key, column)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to find primary key of %s: %w", table.name, err)
+	}
+	return table, nil
+}
+
+// currentFingerprint returns the number of rows in the table, the newest
+// transaction ID that inserted or updated one of them, and the sum of the
+// hashes of every row. The row count and transaction ID catch most changes on
+// their own, but an update committed by a transaction that started before the
+// newest write doesn't raise the newest transaction ID, so the hashes are
+// needed to catch it. Reading the fingerprint is still much cheaper than
+// loading and comparing every row, since only a single value is returned.
+func (ts *tableSnapshot) currentFingerprint(ctx context.Context, db *sql.DB) (string, error) {
+	query := fmt.Sprintf(
+		`SELECT count(*) || ':' || coalesce(max(t.xmin::text::bigint), 0) || ':' || coalesce(sum(hashtext(t::text)::bigint), 0) FROM %s t`,
+		ts.quoted,
+	)
+	var fingerprint string
+	if err := db.QueryRowContext(ctx, query).Scan(&fingerprint); err != nil {
+		return "", fmt.Errorf("failed to fingerprint %s: %w", ts.name, err)
+	}
+	return fingerprint, nil
+}
+
+// load replaces the recorded rows and fingerprint of the table with its
+// current contents.
+func (ts *tableSnapshot) load(ctx context.Context, db *sql.DB) error {
+	fingerprint, err := ts.currentFingerprint(ctx, db)
+	if err != nil {
+		return err
+	}
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT to_jsonb(t)::text FROM %s t", ts.quoted))
+	if err != nil {
+		return fmt.Errorf("failed to read rows of %s: %w", ts.name, err)
+	}
+	defer rows.Close()
+	ts.fingerprint = fingerprint
+	ts.rows = map[string]snapshotRow{}
+	for rows.Next() {
+		var r snapshotRow
+		if err := rows.Scan(&r.text); err != nil {
+			return fmt.Errorf("failed to read rows of %s: %w", ts.name, err)
+		}
+		if err := json.Unmarshal([]byte(r.text), &r.columns); err != nil {
+			return fmt.Errorf("failed to decode row of %s: %w", ts.name, err)
+		}
+		key := ts.rowKey(r)
+		// Tables without a primary key may contain identical rows.
+		for n := 2; ; n++ {
+			if _, exists := ts.rows[key]; !exists {
+				break
+			}
+			key = fmt.Sprintf("%s #%d", ts.rowKey(r), n)
+		}
+		ts.rows[key] = r
+	}
+	return rows.Err()
+}
+
+// rowKey returns the description of the primary key of a row, "id=1", or the
+// whole row if the table has no primary key.
+func (ts *tableSnapshot) rowKey(r snapshotRow) string {
+	if len(ts.key) == 0 {
+		return r.text
+	}
+	parts := make([]string, len(ts.key))
+	for i, column := range ts.key {
+		parts[i] = fmt.Sprintf("%s=%s", column, r.columns[column])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// diff describes the rows that differ between two snapshots of the same
+// table.
+func (ts *tableSnapshot) diff(after *tableSnapshot) []string {
+	var changes []string
+	for key, old := range ts.rows {
+		updated, ok := after.rows[key]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("deleted %s (%s): %s", ts.name, key, old.text))
+			continue
+		}
+		var columns []string
+		for _, column := range sortedKeys(unionColumns(old.columns, updated.columns)) {
+			was, is := old.columns[column], updated.columns[column]
+			if string(was) != string(is) {
+				columns = append(columns, fmt.Sprintf("%s: %s -> %s", column, rawOrMissing(was), rawOrMissing(is)))
+			}
+		}
+		if len(columns) > 0 {
+			changes = append(changes, fmt.Sprintf("updated %s (%s): %s", ts.name, key, strings.Join(columns, ", ")))
+		}
+	}
+	for key, inserted := range after.rows {
+		if _, ok := ts.rows[key]; !ok {
+			changes = append(changes, fmt.Sprintf("inserted %s (%s): %s", ts.name, key, inserted.text))
+		}
+	}
+	return changes
+}
+
+func unionColumns(a, b map[string]json.RawMessage) map[string]bool {
+	union := map[string]bool{}
+	for column := range a {
+		union[column] = true
+	}
+	for column := range b {
+		union[column] = true
+	}
+	return union
+}
+
+func rawOrMissing(raw json.RawMessage) string {
+	if raw == nil {
+		return "(missing)"
+	}
+	return string(raw)
+}
@@ -1,12 +1,23 @@
 package pgtestdb_test
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
-	pgx "github.com/jackc/pgx/v5"      // "pgx" driver
+	pgx "github.com/jackc/pgx/v5" // "pgx" driver
+	"github.com/jackc/pgx/v5/pgconn"
 	_ "github.com/jackc/pgx/v5/stdlib" // "pgx" driver
 	_ "github.com/lib/pq"              // "postgres"
 	"github.com/peterldowns/testy/assert"
@@ -175,6 +186,738 @@ func TestDifferentHashesAlwaysResultInDifferentDatabases(t *testing.T) {
 	}
 }
 
+func TestDiffTemplatesExplainsDifferentHashes(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	dbconf := pgtestdb.Config{
+		DriverName: "pgx",
+		User:       "postgres",
+		Password:   "password",
+		Host:       "localhost",
+		Port:       "5433",
+		Options:    "sslmode=disable",
+	}
+	before := &sqlMigrator{
+		migrations: []string{
+			"CREATE TABLE explain_before (id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY)",
+		},
+	}
+	after := &sqlMigrator{
+		migrations: []string{
+			"CREATE TABLE explain_after (id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY)",
+		},
+	}
+	beforeConf := pgtestdb.Custom(t, dbconf, before)
+	afterConf := pgtestdb.Custom(t, dbconf, after)
+
+	// Instance databases are named "testdb_tpl_<hash>_inst_<id>".
+	beforeTemplate := strings.Split(beforeConf.Database, "_inst_")[0]
+	afterTemplate := strings.Split(afterConf.Database, "_inst_")[0]
+	diff, err := pgtestdb.DiffTemplates(ctx, dbconf, beforeTemplate, afterTemplate)
+	assert.Nil(t, err)
+	check.Equal(t, []string{"changed: MigratorHash/data[0]"}, diff)
+
+	diff, err = pgtestdb.DiffTemplates(ctx, dbconf, beforeTemplate, beforeTemplate)
+	assert.Nil(t, err)
+	check.Equal(t, 0, len(diff))
+}
+
+func TestServerSettingsDiff(t *testing.T) {
+	t.Parallel()
+	before := pgtestdb.ServerSettings{
+		Version:    "150004",
+		Encoding:   "UTF8",
+		Collate:    "en_US.utf8",
+		Ctype:      "en_US.utf8",
+		Extensions: map[string]string{"pg_trgm": "1.6", "hstore": "1.8"},
+	}
+	after := before
+	after.Version = "160001"
+	after.Extensions = map[string]string{"hstore": "1.8", "postgis": "3.4.0"}
+	check.Equal(t, []string{
+		"version: 150004 -> 160001",
+		"extension pg_trgm: 1.6 -> (missing)",
+		"extension postgis: (missing) -> 3.4.0",
+	}, before.Diff(after))
+	check.Equal(t, 0, len(before.Diff(before)))
+	check.NotEqual(t, before.Hash(), after.Hash())
+}
+
+func TestIncludeServerSettingsTemplatesAreNotStale(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	dbconf := pgtestdb.Config{
+		DriverName:            "pgx",
+		User:                  "postgres",
+		Password:              "password",
+		Host:                  "localhost",
+		Port:                  "5433",
+		Options:               "sslmode=disable",
+		IncludeServerSettings: true,
+	}
+	migrator := &sqlMigrator{
+		migrations: []string{
+			"CREATE TABLE server_settings (id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY)",
+		},
+	}
+	instance := pgtestdb.Custom(t, dbconf, migrator)
+	template := strings.Split(instance.Database, "_inst_")[0]
+
+	stale, err := pgtestdb.StaleTemplates(ctx, dbconf)
+	assert.Nil(t, err)
+	for _, tpl := range stale {
+		check.NotEqual(t, template, tpl.Database)
+	}
+}
+
+func TestForceRebuildAlwaysCallsMigrate(t *testing.T) {
+	t.Parallel()
+	dbconf := pgtestdb.Config{
+		DriverName:   "pgx",
+		User:         "postgres",
+		Password:     "password",
+		Host:         "localhost",
+		Port:         "5433",
+		Options:      "sslmode=disable",
+		ForceRebuild: true,
+	}
+	// This migrator always has the same hash, so its template will usually
+	// already exist on the server from previous test runs.
+	migrator := &countingMigrator{hash: "force-rebuild-always-calls-migrate"}
+	for i := 0; i < 5; i++ {
+		_ = pgtestdb.New(t, dbconf, migrator)
+	}
+	// Templates are still only rebuilt once per program.
+	check.Equal(t, int32(1), migrator.calls.Load())
+}
+
+func TestForceRebuildOncePerRun(t *testing.T) {
+	t.Parallel()
+	dbconf := pgtestdb.Config{
+		DriverName:   "pgx",
+		User:         "postgres",
+		Password:     "password",
+		Host:         "localhost",
+		Port:         "5433",
+		Options:      "sslmode=disable",
+		ForceRebuild: true,
+	}
+	migrator := &countingMigrator{hash: "force-rebuild-once-per-run"}
+	_ = pgtestdb.New(t, dbconf, migrator)
+	check.Equal(t, int32(1), migrator.calls.Load())
+
+	// Different options don't change the template's hash, but are cached
+	// separately, like another package's program in the same `go test` run.
+	// It must re-use the template rather than dropping it while this program
+	// may be cloning it.
+	other := dbconf
+	other.Options = "sslmode=disable&connect_timeout=10"
+	_ = pgtestdb.New(t, other, migrator)
+	check.Equal(t, int32(1), migrator.calls.Load())
+}
+
+// countingMigrator is a test helper that satisfies the pgtestdb.Migrator
+// interface and counts the number of times that Migrate() is called.
+type countingMigrator struct {
+	hash  string
+	calls atomic.Int32
+	// errs, if set, are returned by the first calls to Migrate, in order.
+	errs []error
+}
+
+func (c *countingMigrator) Hash() (string, error) {
+	return c.hash, nil
+}
+
+func (c *countingMigrator) Migrate(_ context.Context, _ *sql.DB, _ pgtestdb.Config) error {
+	call := int(c.calls.Add(1))
+	if call <= len(c.errs) {
+		return c.errs[call-1]
+	}
+	return nil
+}
+
+func TestCheckReversible(t *testing.T) {
+	t.Parallel()
+	dbconf := pgtestdb.Config{
+		DriverName: "pgx",
+		User:       "postgres",
+		Password:   "password",
+		Host:       "localhost",
+		Port:       "5433",
+		Options:    "sslmode=disable",
+	}
+	t.Run("reversible migrations pass", func(t *testing.T) {
+		t.Parallel()
+		migrator := &stepMigrator{
+			up: []string{
+				"CREATE TABLE cats (id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY)",
+				"ALTER TABLE cats ADD COLUMN name TEXT",
+			},
+			down: []string{
+				"DROP TABLE cats",
+				"ALTER TABLE cats DROP COLUMN name",
+			},
+		}
+		pgtestdb.CheckReversible(t, dbconf, migrator)
+	})
+	t.Run("broken down migrations fail", func(t *testing.T) {
+		t.Parallel()
+		migrator := &stepMigrator{
+			up: []string{
+				"CREATE TABLE cats (id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY)",
+				"CREATE INDEX cats_id_idx ON cats (id)",
+			},
+			down: []string{
+				"DROP TABLE cats",
+				"SELECT 1", // forgets to drop the index
+			},
+		}
+		tt := &MockT{}
+		pgtestdb.CheckReversible(tt, dbconf, migrator)
+		tt.DoCleanup()
+		assert.True(t, tt.Failed())
+	})
+}
+
+func TestAssertGolden(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "schema.golden.sql")
+
+	missing := &MockT{}
+	pgtestdb.AssertGolden(missing, path, "table public.cats\n")
+	assert.True(t, missing.Failed())
+
+	assert.Nil(t, os.WriteFile(path, []byte("table public.cats\n"), 0o600))
+	matching := &MockT{}
+	pgtestdb.AssertGolden(matching, path, "table public.cats\n")
+	check.False(t, matching.Failed())
+
+	different := &MockT{}
+	pgtestdb.AssertGolden(different, path, "table public.dogs\n")
+	check.True(t, different.Failed())
+}
+
+func TestAssertSchemaGolden(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	dbconf := pgtestdb.Config{
+		DriverName: "pgx",
+		User:       "postgres",
+		Password:   "password",
+		Host:       "localhost",
+		Port:       "5433",
+		Options:    "sslmode=disable",
+	}
+	migrator := &sqlMigrator{
+		migrations: []string{
+			"CREATE TABLE cats (id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY, name TEXT)",
+			"CREATE INDEX cats_name_idx ON cats (name)",
+		},
+	}
+	// An instance has the same schema as the template it was cloned from.
+	desc, err := pgtestdb.DescribeSchema(ctx, pgtestdb.New(t, dbconf, migrator))
+	assert.Nil(t, err)
+	check.True(t, strings.Contains(desc, "table public.cats"))
+	check.True(t, strings.Contains(desc, "index public.cats_name_idx"))
+
+	path := filepath.Join(t.TempDir(), "schema.golden.sql")
+	missing := &MockT{}
+	pgtestdb.AssertSchemaGolden(missing, dbconf, migrator, path)
+	assert.True(t, missing.Failed())
+
+	assert.Nil(t, os.WriteFile(path, []byte(desc+"\n"), 0o600))
+	matching := &MockT{}
+	pgtestdb.AssertSchemaGolden(matching, dbconf, migrator, path)
+	check.False(t, matching.Failed())
+
+	assert.Nil(t, os.WriteFile(path, []byte(desc+"\ntable public.dogs\n"), 0o600))
+	stale := &MockT{}
+	pgtestdb.AssertSchemaGolden(stale, dbconf, migrator, path)
+	check.True(t, stale.Failed())
+}
+
+func TestCompareMigrators(t *testing.T) {
+	t.Parallel()
+	dbconf := pgtestdb.Config{
+		DriverName: "pgx",
+		User:       "postgres",
+		Password:   "password",
+		Host:       "localhost",
+		Port:       "5433",
+		Options:    "sslmode=disable",
+	}
+	plain := &sqlMigrator{
+		migrations: []string{
+			"CREATE TABLE cats (id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY, name TEXT)",
+		},
+	}
+	// Same schema, but with a bookkeeping table, as if it had been created
+	// by a migration framework.
+	framework := &sqlMigrator{
+		migrations: []string{
+			"CREATE TABLE schema_migrations (version BIGINT PRIMARY KEY, dirty BOOLEAN NOT NULL)",
+			"CREATE TABLE cats (id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY, name TEXT)",
+		},
+	}
+	different := &sqlMigrator{
+		migrations: []string{
+			"CREATE TABLE cats (id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY, name VARCHAR(100))",
+		},
+	}
+
+	pgtestdb.CompareMigrators(t, dbconf, plain, framework)
+
+	tt := &MockT{}
+	pgtestdb.CompareMigrators(tt, dbconf, plain, different)
+	check.True(t, tt.Failed())
+}
+
+func TestCompareMigratorsUsesShards(t *testing.T) {
+	t.Parallel()
+	// The Config itself has no Host, so the templates can only be built if
+	// they are built on the shard.
+	dbconf := pgtestdb.Config{
+		DriverName: "pgx",
+		User:       "postgres",
+		Password:   "password",
+		Port:       "5433",
+		Options:    "sslmode=disable",
+		Shards:     []pgtestdb.Config{{Host: "localhost"}},
+	}
+	migrator := &sqlMigrator{
+		migrations: []string{
+			"CREATE TABLE cats (id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY, name TEXT)",
+		},
+	}
+	pgtestdb.CompareMigrators(t, dbconf, migrator, migrator)
+}
+
+func TestSchemaHelpersRejectIsolateSchemas(t *testing.T) {
+	t.Parallel()
+	dbconf := pgtestdb.Config{
+		DriverName:     "pgx",
+		User:           "postgres",
+		Password:       "password",
+		Host:           "localhost",
+		Port:           "5433",
+		Options:        "sslmode=disable",
+		IsolateSchemas: true,
+	}
+	migrator := &countingMigrator{hash: "schema-helpers-reject-isolate-schemas"}
+
+	golden := &MockT{}
+	pgtestdb.AssertSchemaGolden(golden, dbconf, migrator, filepath.Join(t.TempDir(), "schema.golden.sql"))
+	check.True(t, golden.Failed())
+
+	compare := &MockT{}
+	pgtestdb.CompareMigrators(compare, dbconf, migrator, migrator)
+	check.True(t, compare.Failed())
+
+	check.Equal(t, int32(0), migrator.calls.Load())
+}
+
+func TestSnapshotReportsChanges(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	dbconf := pgtestdb.Config{
+		DriverName: "pgx",
+		User:       "postgres",
+		Password:   "password",
+		Host:       "localhost",
+		Port:       "5433",
+		Options:    "sslmode=disable",
+	}
+	migrator := &sqlMigrator{
+		migrations: []string{
+			"CREATE TABLE users (id BIGINT PRIMARY KEY, email TEXT NOT NULL)",
+			"CREATE TABLE events (name TEXT NOT NULL)",
+			"CREATE TABLE untouched (id BIGINT PRIMARY KEY)",
+			"INSERT INTO users (id, email) VALUES (1, 'alice@example.com'), (2, 'bob@example.com')",
+			"INSERT INTO events (name) VALUES ('signup'), ('signup')",
+		},
+	}
+	db := pgtestdb.New(t, dbconf, migrator)
+	snapshot := pgtestdb.TakeSnapshot(t, db)
+	snapshot.AssertUnchanged(t)
+
+	for _, statement := range []string{
+		"UPDATE users SET email = 'alice@example.org' WHERE id = 1",
+		"DELETE FROM users WHERE id = 2",
+		"INSERT INTO users (id, email) VALUES (3, 'carol@example.com')",
+		"INSERT INTO events (name) VALUES ('signup')",
+	} {
+		_, err := db.ExecContext(ctx, statement)
+		assert.Nil(t, err)
+	}
+	snapshot.AssertChanges(t,
+		`updated public.users (id=1): email: "alice@example.com" -> "alice@example.org"`,
+		`deleted public.users (id=2): {"id": 2, "email": "bob@example.com"}`,
+		`inserted public.users (id=3): {"id": 3, "email": "carol@example.com"}`,
+		`inserted public.events ({"name": "signup"} #3): {"name": "signup"}`,
+	)
+
+	tt := &MockT{}
+	snapshot.AssertUnchanged(tt)
+	check.True(t, tt.Failed())
+
+	// Snapshots of specific tables ignore changes to other tables.
+	users := pgtestdb.TakeSnapshot(t, db, "users")
+	_, err := db.ExecContext(ctx, "INSERT INTO untouched (id) VALUES (1)")
+	assert.Nil(t, err)
+	users.AssertUnchanged(t)
+
+	// Updates don't change the number of rows, but are still noticed.
+	_, err = db.ExecContext(ctx, "UPDATE users SET email = 'carol@example.org' WHERE id = 3")
+	assert.Nil(t, err)
+	users.AssertChanges(t, `updated public.users (id=3): email: "carol@example.com" -> "carol@example.org"`)
+
+	// Updates committed by a transaction that is older than the newest write
+	// don't change the newest transaction ID, but are still noticed.
+	tx, err := db.BeginTx(ctx, nil)
+	assert.Nil(t, err)
+	_, err = tx.ExecContext(ctx, "SELECT txid_current()")
+	assert.Nil(t, err)
+	_, err = db.ExecContext(ctx, "INSERT INTO users (id, email) VALUES (4, 'dave@example.com')")
+	assert.Nil(t, err)
+	latest := pgtestdb.TakeSnapshot(t, db, "users")
+	_, err = tx.ExecContext(ctx, "UPDATE users SET email = 'alice@example.net' WHERE id = 1")
+	assert.Nil(t, err)
+	assert.Nil(t, tx.Commit())
+	latest.AssertChanges(t, `updated public.users (id=1): email: "alice@example.org" -> "alice@example.net"`)
+}
+
+func TestCaptureQueries(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	for _, driverName := range []string{"pgx", "postgres"} {
+		driverName := driverName
+		t.Run(driverName, func(t *testing.T) {
+			t.Parallel()
+			dbconf := pgtestdb.Config{
+				DriverName:     driverName,
+				User:           "postgres",
+				Password:       "password",
+				Host:           "localhost",
+				Port:           "5433",
+				Options:        "sslmode=disable",
+				CaptureQueries: true,
+			}
+			migrator := &sqlMigrator{
+				migrations: []string{
+					"CREATE TABLE cats (id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY, name TEXT)",
+				},
+			}
+			db := pgtestdb.New(t, dbconf, migrator)
+			_, err := db.ExecContext(ctx, "INSERT INTO cats (name) VALUES ($1), ($2)", "daisy", "sunny")
+			assert.Nil(t, err)
+			rows, err := db.QueryContext(ctx, "SELECT name FROM cats ORDER BY name")
+			assert.Nil(t, err)
+			for rows.Next() {
+				var name string
+				assert.Nil(t, rows.Scan(&name))
+			}
+			assert.Nil(t, rows.Close())
+			pgtestdb.AssertQueryCount(t, db, 2)
+
+			queries := pgtestdb.CapturedQueries(t, db).Queries()
+			check.Equal(t, "INSERT INTO cats (name) VALUES ($1), ($2)", queries[0].SQL)
+			check.Equal(t, []any{"daisy", "sunny"}, queries[0].Args)
+			check.Equal(t, int64(2), queries[0].Rows)
+			check.Equal(t, int64(2), queries[1].Rows)
+
+			pgtestdb.CapturedQueries(t, db).Reset()
+			pgtestdb.AssertQueryCount(t, db, 0)
+
+			tt := &MockT{}
+			pgtestdb.AssertQueryCount(tt, db, 1)
+			check.True(t, tt.Failed())
+
+			// Rows that are closed after the log is reset don't change the
+			// number of rows of the queries recorded since.
+			rows, err = db.QueryContext(ctx, "SELECT name FROM cats")
+			assert.Nil(t, err)
+			pgtestdb.CapturedQueries(t, db).Reset()
+			_, err = db.ExecContext(ctx, "INSERT INTO cats (name) VALUES ($1)", "milo")
+			assert.Nil(t, err)
+			for rows.Next() {
+				var name string
+				assert.Nil(t, rows.Scan(&name))
+			}
+			assert.Nil(t, rows.Close())
+			queries = pgtestdb.CapturedQueries(t, db).Queries()
+			assert.Equal(t, 1, len(queries))
+			check.Equal(t, int64(1), queries[0].Rows)
+		})
+	}
+}
+
+func TestAssertQueryCountRequiresCapture(t *testing.T) {
+	t.Parallel()
+	dbconf := pgtestdb.Config{
+		DriverName: "pgx",
+		User:       "postgres",
+		Password:   "password",
+		Host:       "localhost",
+		Port:       "5433",
+		Options:    "sslmode=disable",
+	}
+	db := pgtestdb.New(t, dbconf, pgtestdb.NoopMigrator{})
+	tt := &MockT{}
+	pgtestdb.AssertQueryCount(tt, db, 0)
+	check.True(t, tt.Failed())
+}
+
+func TestSetApplicationName(t *testing.T) {
+	t.Parallel()
+	dbconf := pgtestdb.Config{
+		DriverName:         "pgx",
+		User:               "postgres",
+		Password:           "password",
+		Host:               "localhost",
+		Port:               "5433",
+		Options:            "sslmode=disable",
+		SetApplicationName: true,
+	}
+	db := pgtestdb.New(t, dbconf, pgtestdb.NoopMigrator{})
+	var name string
+	err := db.QueryRow("SELECT current_setting('application_name')").Scan(&name)
+	assert.Nil(t, err)
+	check.Equal(t, t.Name(), name)
+}
+
+func TestDiagnoseFailuresLogsConnectionsAndLocks(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	dbconf := pgtestdb.Config{
+		DriverName:       "pgx",
+		User:             "postgres",
+		Password:         "password",
+		Host:             "localhost",
+		Port:             "5433",
+		Options:          "sslmode=disable",
+		DiagnoseFailures: true,
+	}
+	migrator := &sqlMigrator{
+		migrations: []string{
+			"CREATE TABLE cats (id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY)",
+		},
+	}
+	tt := &MockT{}
+	db := pgtestdb.New(tt, dbconf, migrator)
+	tx, err := db.BeginTx(ctx, nil)
+	assert.Nil(t, err)
+	_, err = tx.ExecContext(ctx, "LOCK TABLE cats IN ACCESS EXCLUSIVE MODE")
+	assert.Nil(t, err)
+
+	tt.Fatalf("the test failed")
+	tt.DoCleanup()
+	logs := strings.Join(tt.logs, "\n")
+	check.True(t, strings.Contains(logs, "idle in transaction"))
+	check.True(t, strings.Contains(logs, "LOCK TABLE cats IN ACCESS EXCLUSIVE MODE"))
+	check.True(t, strings.Contains(logs, "holds AccessExclusiveLock on relation cats"))
+}
+
+func TestObserverReceivesLifecycleEvents(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	var events []pgtestdb.Event
+	dbconf := pgtestdb.Config{
+		DriverName: "pgx",
+		User:       "postgres",
+		Password:   "password",
+		Host:       "localhost",
+		Port:       "5433",
+		Options:    "sslmode=disable",
+		// Guarantees that this test builds the template, rather than reusing
+		// one from a previous run.
+		ForceRebuild: true,
+		Observer: pgtestdb.ObserverFunc(func(event pgtestdb.Event) {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, event)
+		}),
+	}
+	migrator := &sqlMigrator{
+		migrations: []string{
+			"CREATE TABLE observed (id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY)",
+		},
+	}
+	tt := &MockT{}
+	_ = pgtestdb.New(tt, dbconf, migrator)
+	tt.DoCleanup()
+	assert.False(t, tt.Failed())
+
+	mu.Lock()
+	defer mu.Unlock()
+	var types []pgtestdb.EventType
+	for _, event := range events {
+		check.False(t, event.Time.IsZero())
+		if event.Type == pgtestdb.EventRoleEnsured {
+			continue
+		}
+		types = append(types, event.Type)
+		check.Equal(t, "*pgtestdb_test.sqlMigrator", event.MigratorType)
+	}
+	check.Equal(t, []pgtestdb.EventType{
+		pgtestdb.EventTemplateLockWait,
+		pgtestdb.EventTemplateLockAcquired,
+		pgtestdb.EventTemplateBuilt,
+		pgtestdb.EventServerConnected,
+		pgtestdb.EventInstanceCloned,
+		pgtestdb.EventServerConnected,
+		pgtestdb.EventInstanceDropped,
+	}, types)
+	for _, event := range events {
+		if event.Type == pgtestdb.EventInstanceCloned {
+			check.True(t, strings.HasPrefix(event.Database, event.Template))
+			check.True(t, event.Duration > 0)
+		}
+	}
+}
+
+func TestTimingsAreGroupedByTemplate(t *testing.T) {
+	t.Parallel()
+	var hash atomic.Value
+	dbconf := pgtestdb.Config{
+		DriverName: "pgx",
+		User:       "postgres",
+		Password:   "password",
+		Host:       "localhost",
+		Port:       "5433",
+		Options:    "sslmode=disable",
+		Observer: pgtestdb.ObserverFunc(func(event pgtestdb.Event) {
+			if event.Type == pgtestdb.EventInstanceCloned {
+				hash.Store(event.Hash)
+			}
+		}),
+	}
+	migrator := &sqlMigrator{
+		migrations: []string{
+			"CREATE TABLE timed (id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY)",
+		},
+	}
+	for i := 0; i < 3; i++ {
+		tt := &MockT{}
+		_ = pgtestdb.New(tt, dbconf, migrator)
+		tt.DoCleanup()
+		assert.False(t, tt.Failed())
+	}
+
+	report := pgtestdb.Timings()
+	var template pgtestdb.TemplateTimings
+	for _, tt := range report.Templates {
+		if tt.Hash == hash.Load() {
+			template = tt
+		}
+	}
+	check.Equal(t, "*pgtestdb_test.sqlMigrator", template.MigratorType)
+	check.Equal(t, 3, template.Phases[pgtestdb.PhaseClone].Count)
+	check.Equal(t, 3, template.Phases[pgtestdb.PhaseDrop].Count)
+	check.Equal(t, 6, template.Phases[pgtestdb.PhaseConnect].Count)
+	check.True(t, report.Totals[pgtestdb.PhaseClone].Count >= 3)
+	check.True(t, strings.Contains(report.String(), "template "+template.Hash))
+
+	dir := t.TempDir()
+	assert.Nil(t, pgtestdb.WriteTimings(dir))
+	contents, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("pgtestdb-timings-%d.json", os.Getpid())))
+	assert.Nil(t, err)
+	check.True(t, strings.Contains(string(contents), template.Hash))
+}
+
+// TestWriteTimingsFromEnv is not parallel because it sets an environment
+// variable.
+func TestWriteTimingsFromEnv(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(pgtestdb.TimingsEnvVar, dir)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			check.Nil(t, pgtestdb.WriteTimingsFromEnv())
+		}()
+	}
+	wg.Wait()
+	// No temporary files are left behind.
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	base := fmt.Sprintf("pgtestdb-timings-%d", os.Getpid())
+	check.Equal(t, []string{base + ".json", base + ".txt"}, names)
+
+	t.Setenv(pgtestdb.TimingsEnvVar, "")
+	check.Nil(t, pgtestdb.WriteTimingsFromEnv())
+}
+
+func TestSlogObserver(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	observer := pgtestdb.SlogObserver(logger)
+	observer.Observe(pgtestdb.Event{
+		Type:     pgtestdb.EventInstanceCloned,
+		Duration: 15 * time.Millisecond,
+		Test:     "TestSomething",
+		Database: "testdb_tpl_abc_inst_123",
+	})
+	observer.Observe(pgtestdb.Event{
+		Type: pgtestdb.EventCleanupError,
+		Err:  errors.New("connection refused"),
+	})
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+	check.True(t, strings.Contains(lines[0], `level=DEBUG msg="pgtestdb: instance_cloned" test=TestSomething database=testdb_tpl_abc_inst_123 duration=15ms`))
+	check.True(t, strings.Contains(lines[1], `level=ERROR msg="pgtestdb: cleanup_error" error="connection refused"`))
+}
+
+// stepMigrator is a test helper that satisfies the pgtestdb.StepMigrator
+// interface, applying and reverting one statement at a time.
+type stepMigrator struct {
+	up      []string
+	down    []string
+	applied int
+}
+
+func (s *stepMigrator) Hash() (string, error) {
+	hash := common.NewRecursiveHash()
+	for _, migration := range s.up {
+		hash.Add([]byte(migration))
+	}
+	return hash.String(), nil
+}
+
+func (s *stepMigrator) Migrate(ctx context.Context, db *sql.DB, conf pgtestdb.Config) error {
+	for {
+		version, err := s.StepUp(ctx, db, conf)
+		if err != nil || version == "" {
+			return err
+		}
+	}
+}
+
+func (s *stepMigrator) StepUp(ctx context.Context, db *sql.DB, _ pgtestdb.Config) (string, error) {
+	if s.applied == len(s.up) {
+		return "", nil
+	}
+	if _, err := db.ExecContext(ctx, s.up[s.applied]); err != nil {
+		return "", err
+	}
+	s.applied++
+	return fmt.Sprintf("%d", s.applied), nil
+}
+
+func (s *stepMigrator) StepDown(ctx context.Context, db *sql.DB, _ pgtestdb.Config) error {
+	if _, err := db.ExecContext(ctx, s.down[s.applied-1]); err != nil {
+		return err
+	}
+	s.applied--
+	return nil
+}
+
 // This test confirms that due to testdb's locking strategy, even a migrator
 // that uses advisory locks and runs a migration with "CREATE INDEX CONCURRENTLY"
 // will succeed. pgtestdb will take an advisory lock on the primary database
@@ -381,17 +1124,479 @@ func TestForceTerminateConnectionsWorksCorrectly(t *testing.T) {
 	assert.False(t, tt.Failed())
 }
 
+func TestLeakedConnectionsAreDiagnosed(t *testing.T) {
+	t.Parallel()
+	conf := pgtestdb.Config{
+		DriverName:         "pgx",
+		User:               "postgres",
+		Password:           "password",
+		Host:               "localhost",
+		Port:               "5433",
+		Options:            "sslmode=disable",
+		SetApplicationName: true,
+		TrackConnections:   true,
+	}
+	tt := &MockT{}
+	db := pgtestdb.New(tt, conf, pgtestdb.NoopMigrator{})
+	leakConnection(t, db)
+	tt.DoCleanup()
+	assert.True(t, tt.Failed())
+	logs := strings.Join(tt.logs, "\n")
+	check.True(t, strings.Contains(logs, "1 connection(s)"))
+	check.True(t, strings.Contains(logs, "(idle in transaction)"))
+	check.True(t, strings.Contains(logs, "SELECT 'leaked'"))
+	check.True(t, strings.Contains(logs, "pgtestdb_test.leakConnection"))
+}
+
+// leakConnection begins a transaction and never finishes it, so that the
+// connection is never returned to the pool.
+func leakConnection(t *testing.T, db *sql.DB) {
+	t.Helper()
+	tx, err := db.Begin()
+	assert.Nil(t, err)
+	_, err = tx.Exec("SELECT 'leaked'")
+	assert.Nil(t, err)
+}
+
+func TestMaxInstancesMakesTestsWait(t *testing.T) {
+	t.Parallel()
+	conf := pgtestdb.Config{
+		DriverName:          "pgx",
+		User:                "postgres",
+		Password:            "password",
+		Host:                "localhost",
+		Port:                "5433",
+		Options:             "sslmode=disable",
+		MaxInstances:        1,
+		MaxInstancesTimeout: 200 * time.Millisecond,
+		MaxConnsPerInstance: 2,
+	}
+	first := &MockT{}
+	db := pgtestdb.New(first, conf, pgtestdb.NoopMigrator{})
+	assert.False(t, first.Failed())
+	check.Equal(t, 2, db.Stats().MaxOpenConnections)
+
+	// The only slot is taken, so the second test waits and then fails.
+	second := &MockT{}
+	_ = pgtestdb.New(second, conf, pgtestdb.NoopMigrator{})
+	check.True(t, second.Failed())
+	logs := strings.Join(second.logs, "\n")
+	check.True(t, strings.Contains(logs, "waiting for one of the 1 test database slots"))
+	check.True(t, strings.Contains(logs, "slot 0: pid="))
+
+	// Once the first test's database is dropped, the slot is free again.
+	first.DoCleanup()
+	assert.False(t, first.Failed())
+	third := &MockT{}
+	_ = pgtestdb.New(third, conf, pgtestdb.NoopMigrator{})
+	check.False(t, third.Failed())
+	third.DoCleanup()
+}
+
+func TestShardsSpreadInstancesAcrossServers(t *testing.T) {
+	t.Parallel()
+	// Both shards are the same server, reached by different hosts, which is
+	// enough for pgtestdb to treat them as different servers.
+	dbconf := pgtestdb.Config{
+		DriverName: "pgx",
+		User:       "postgres",
+		Password:   "password",
+		Port:       "5433",
+		Options:    "sslmode=disable",
+		Shards: []pgtestdb.Config{
+			{Host: "localhost"},
+			{Host: "127.0.0.1"},
+		},
+		ShardStrategy: pgtestdb.RoundRobin(),
+		ForceRebuild:  true,
+	}
+	migrator := &countingMigrator{hash: "shards-spread-instances-across-servers"}
+	var hosts []string
+	for i := 0; i < 4; i++ {
+		config := pgtestdb.Custom(t, dbconf, migrator)
+		assert.NotEqual(t, nil, config)
+		check.Equal(t, 0, len(config.Shards))
+		hosts = append(hosts, config.Host)
+	}
+	check.Equal(t, []string{"localhost", "127.0.0.1", "localhost", "127.0.0.1"}, hosts)
+	// The template is built once on each shard.
+	check.Equal(t, int32(2), migrator.calls.Load())
+}
+
+func TestHashTestNameIsStable(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	strategy := pgtestdb.HashTestName()
+	shards := make([]pgtestdb.Config, 3)
+	first, err := strategy(ctx, t, shards)
+	assert.Nil(t, err)
+	check.True(t, first >= 0 && first < len(shards))
+	for i := 0; i < 5; i++ {
+		index, err := strategy(ctx, t, shards)
+		assert.Nil(t, err)
+		check.Equal(t, first, index)
+	}
+}
+
+func TestInvalidShardFailsTest(t *testing.T) {
+	t.Parallel()
+	dbconf := pgtestdb.Config{
+		DriverName: "pgx",
+		Shards:     []pgtestdb.Config{{Host: "localhost"}},
+		ShardStrategy: func(context.Context, pgtestdb.TB, []pgtestdb.Config) (int, error) {
+			return 1, nil
+		},
+	}
+	tt := &MockT{}
+	db := pgtestdb.New(tt, dbconf, pgtestdb.NoopMigrator{})
+	check.True(t, tt.Failed())
+	check.Equal(t, nil, db)
+}
+
+func TestCloneStrategies(t *testing.T) {
+	t.Parallel()
+	strategies := map[string]pgtestdb.CloneStrategy{
+		"default":   nil,
+		"wal log":   pgtestdb.TemplateCopy{Strategy: pgtestdb.StrategyWALLog},
+		"file copy": pgtestdb.TemplateCopy{Strategy: pgtestdb.StrategyFileCopy},
+		"dump":      pgtestdb.DumpRestore{},
+		"replay":    pgtestdb.MigrateReplay{},
+	}
+	for name, strategy := range strategies {
+		strategy := strategy
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			if _, ok := strategy.(pgtestdb.DumpRestore); ok {
+				if _, err := exec.LookPath("pg_dump"); err != nil {
+					t.Skip("pg_dump is not installed")
+				}
+			}
+			ctx := context.Background()
+			dbconf := pgtestdb.Config{
+				DriverName:    "pgx",
+				User:          "postgres",
+				Password:      "password",
+				Host:          "localhost",
+				Port:          "5433",
+				Options:       "sslmode=disable",
+				CloneStrategy: strategy,
+			}
+			db := pgtestdb.New(t, dbconf, defaultMigrator())
+			var count int
+			err := db.QueryRowContext(ctx, "SELECT count(*) FROM cats").Scan(&count)
+			assert.Nil(t, err)
+			check.Equal(t, 2, count)
+		})
+	}
+}
+
+func TestDumpRestoreDropsFailedInstance(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	// pg_dump fails after the empty instance database has been created.
+	bin := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(bin, "pg_dump"), []byte("#!/bin/sh\nexit 1\n"), 0o755))                    //nolint:gosec
+	assert.Nil(t, os.WriteFile(filepath.Join(bin, "pg_restore"), []byte("#!/bin/sh\ncat >/dev/null\nexit 1\n"), 0o755)) //nolint:gosec
+	var template atomic.Value
+	dbconf := pgtestdb.Config{
+		DriverName:    "pgx",
+		User:          "postgres",
+		Password:      "password",
+		Host:          "localhost",
+		Port:          "5433",
+		Options:       "sslmode=disable",
+		CloneStrategy: pgtestdb.DumpRestore{BinDir: bin},
+		Observer: pgtestdb.ObserverFunc(func(event pgtestdb.Event) {
+			if event.Template != "" {
+				template.Store(event.Template)
+			}
+		}),
+	}
+	tt := &MockT{}
+	_ = pgtestdb.New(tt, dbconf, &countingMigrator{hash: "dump-restore-drops-failed-instance"})
+	check.True(t, tt.Failed())
+
+	baseDB, err := dbconf.Connect()
+	assert.Nil(t, err)
+	defer baseDB.Close()
+	var instances int
+	query := "SELECT count(*) FROM pg_database WHERE starts_with(datname, $1)"
+	err = baseDB.QueryRowContext(ctx, query, template.Load().(string)+"_inst_").Scan(&instances)
+	assert.Nil(t, err)
+	check.Equal(t, 0, instances)
+}
+
+func TestMigrateReplayMigratesEachInstance(t *testing.T) {
+	t.Parallel()
+	dbconf := pgtestdb.Config{
+		DriverName:    "pgx",
+		User:          "postgres",
+		Password:      "password",
+		Host:          "localhost",
+		Port:          "5433",
+		Options:       "sslmode=disable",
+		CloneStrategy: pgtestdb.MigrateReplay{},
+	}
+	migrator := &countingMigrator{hash: "migrate-replay-migrates-each-instance"}
+	for i := 0; i < 3; i++ {
+		_ = pgtestdb.New(t, dbconf, migrator)
+	}
+	check.Equal(t, int32(3), migrator.calls.Load())
+}
+
+func TestIsolateSchemas(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	dbconf := pgtestdb.Config{
+		DriverName:     "pgx",
+		User:           "postgres",
+		Password:       "password",
+		Host:           "localhost",
+		Port:           "5433",
+		Database:       "postgres",
+		Options:        "sslmode=disable",
+		IsolateSchemas: true,
+	}
+	first := pgtestdb.Custom(t, dbconf, defaultMigrator())
+	second := pgtestdb.Custom(t, dbconf, defaultMigrator())
+	check.Equal(t, "postgres", first.Database)
+	check.NotEqual(t, first.Schema, second.Schema)
+
+	db, err := first.Connect()
+	assert.Nil(t, err)
+	defer db.Close()
+	var schema string
+	assert.Nil(t, db.QueryRowContext(ctx, "SELECT current_schema()").Scan(&schema))
+	check.Equal(t, first.Schema, schema)
+	_, err = db.ExecContext(ctx, "INSERT INTO cats (name) VALUES ('mochi')")
+	assert.Nil(t, err)
+
+	// The other test's schema is unaffected.
+	other, err := second.Connect()
+	assert.Nil(t, err)
+	defer other.Close()
+	var count int
+	assert.Nil(t, other.QueryRowContext(ctx, "SELECT count(*) FROM cats").Scan(&count))
+	check.Equal(t, 2, count)
+}
+
+func TestIsolateSchemasCopiesSequencesAndForeignKeys(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	dbconf := pgtestdb.Config{
+		DriverName:     "pgx",
+		User:           "postgres",
+		Password:       "password",
+		Host:           "localhost",
+		Port:           "5433",
+		Database:       "postgres",
+		Options:        "sslmode=disable",
+		IsolateSchemas: true,
+	}
+	migrator := &sqlMigrator{migrations: []string{`
+		CREATE TABLE owners (id SERIAL PRIMARY KEY, name TEXT NOT NULL);
+		CREATE TABLE pets (
+			id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+			owner_id INT NOT NULL REFERENCES owners (id),
+			name TEXT NOT NULL,
+			shout TEXT GENERATED ALWAYS AS (upper(name)) STORED
+		);
+		INSERT INTO owners (name) VALUES ('alice'), ('bob');
+		INSERT INTO pets (owner_id, name) VALUES (1, 'daisy');
+	`}}
+	db := pgtestdb.New(t, dbconf, migrator)
+
+	var ownerID, petID int
+	var shout string
+	assert.Nil(t, db.QueryRowContext(ctx, "INSERT INTO owners (name) VALUES ('carol') RETURNING id").Scan(&ownerID))
+	check.Equal(t, 3, ownerID)
+	assert.Nil(t, db.QueryRowContext(ctx, "INSERT INTO pets (owner_id, name) VALUES (3, 'sunny') RETURNING id, shout").Scan(&petID, &shout))
+	check.Equal(t, 2, petID)
+	check.Equal(t, "SUNNY", shout)
+	_, err := db.ExecContext(ctx, "INSERT INTO pets (owner_id, name) VALUES (42, 'stray')")
+	check.NotEqual(t, nil, err)
+}
+
+func TestIsolateSchemasMigratesSchemasWithViews(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	dbconf := pgtestdb.Config{
+		DriverName:     "pgx",
+		User:           "postgres",
+		Password:       "password",
+		Host:           "localhost",
+		Port:           "5433",
+		Database:       "postgres",
+		Options:        "sslmode=disable",
+		IsolateSchemas: true,
+	}
+	migrator := &sqlMigrator{migrations: []string{`
+		CREATE TABLE dogs (name TEXT NOT NULL);
+		CREATE VIEW loud_dogs AS SELECT upper(name) AS name FROM dogs;
+		INSERT INTO dogs (name) VALUES ('rex');
+	`}}
+	db := pgtestdb.New(t, dbconf, migrator)
+	var name string
+	assert.Nil(t, db.QueryRowContext(ctx, "SELECT name FROM loud_dogs").Scan(&name))
+	check.Equal(t, "REX", name)
+}
+
+func TestIsolateSchemasMigratesSchemasWithCompositeTypes(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	dbconf := pgtestdb.Config{
+		DriverName:     "pgx",
+		User:           "postgres",
+		Password:       "password",
+		Host:           "localhost",
+		Port:           "5433",
+		Database:       "postgres",
+		Options:        "sslmode=disable",
+		IsolateSchemas: true,
+	}
+	migrator := &sqlMigrator{migrations: []string{`
+		CREATE TYPE meal AS (food TEXT, grams INT);
+		CREATE TABLE cats (name TEXT NOT NULL, dinner meal);
+		INSERT INTO cats (name, dinner) VALUES ('daisy', ROW('tuna', 80));
+	`}}
+	db := pgtestdb.New(t, dbconf, migrator)
+	var owned int
+	assert.Nil(t, db.QueryRowContext(ctx, `
+		SELECT count(*) FROM pg_attribute a
+		JOIN pg_type t ON t.oid = a.atttypid
+		WHERE a.attrelid = 'cats'::regclass
+		AND a.attname = 'dinner'
+		AND t.typnamespace = current_schema()::regnamespace
+	`).Scan(&owned))
+	check.Equal(t, 1, owned)
+	var food string
+	assert.Nil(t, db.QueryRowContext(ctx, "SELECT (dinner).food FROM cats").Scan(&food))
+	check.Equal(t, "tuna", food)
+}
+
+func TestCloneRetriesWhileTemplateIsInUse(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	var template atomic.Value
+	dbconf := pgtestdb.Config{
+		DriverName: "pgx",
+		User:       "postgres",
+		Password:   "password",
+		Host:       "localhost",
+		Port:       "5433",
+		Options:    "sslmode=disable",
+		Observer: pgtestdb.ObserverFunc(func(event pgtestdb.Event) {
+			if event.Type == pgtestdb.EventInstanceCloned {
+				template.Store(event.Template)
+			}
+		}),
+		CloneRetryTimeout: 200 * time.Millisecond,
+	}
+	migrator := &sqlMigrator{
+		migrations: []string{
+			"CREATE TABLE in_use (id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY)",
+		},
+	}
+	_ = pgtestdb.New(t, dbconf, migrator)
+
+	// Hold a connection to the template, like a developer's psql session.
+	holderConf := dbconf
+	holderConf.Database = template.Load().(string)
+	holderDB, err := holderConf.Connect()
+	assert.Nil(t, err)
+	defer holderDB.Close()
+	holder, err := holderDB.Conn(ctx)
+	assert.Nil(t, err)
+	defer holder.Close()
+	assert.Nil(t, holder.PingContext(ctx))
+
+	tt := &MockT{}
+	_ = pgtestdb.New(tt, dbconf, migrator)
+	check.True(t, tt.Failed())
+	logs := strings.Join(tt.logs, "\n")
+	check.True(t, strings.Contains(logs, "waiting for the connections to template"))
+	check.True(t, strings.Contains(logs, "pid="))
+
+	dbconf.TerminateTemplateConnections = true
+	tt = &MockT{}
+	_ = pgtestdb.New(tt, dbconf, migrator)
+	check.False(t, tt.Failed())
+	tt.DoCleanup()
+	check.NotEqual(t, nil, holder.PingContext(ctx))
+}
+
+func TestTransientTemplateErrorsAreRetried(t *testing.T) {
+	t.Parallel()
+	dbconf := pgtestdb.Config{
+		DriverName: "pgx",
+		User:       "postgres",
+		Password:   "password",
+		Host:       "localhost",
+		Port:       "5433",
+		Options:    "sslmode=disable",
+	}
+	migrator := &countingMigrator{
+		hash: "transient-template-errors-are-retried",
+		errs: []error{&pgconn.PgError{Code: "08006", Message: "connection failure"}},
+	}
+	tt := &MockT{}
+	_ = pgtestdb.New(tt, dbconf, migrator)
+	check.True(t, tt.Failed())
+	_ = pgtestdb.New(t, dbconf, migrator)
+	check.Equal(t, int32(2), migrator.calls.Load())
+}
+
+func TestPermanentTemplateErrorsAreCached(t *testing.T) {
+	t.Parallel()
+	dbconf := pgtestdb.Config{
+		DriverName: "pgx",
+		User:       "postgres",
+		Password:   "password",
+		Host:       "localhost",
+		Port:       "5433",
+		Options:    "sslmode=disable",
+	}
+	migrator := &countingMigrator{
+		hash: "permanent-template-errors-are-cached",
+		errs: []error{&pgconn.PgError{Code: "42601", Message: "syntax error"}},
+	}
+	for i := 0; i < 2; i++ {
+		tt := &MockT{}
+		_ = pgtestdb.New(tt, dbconf, migrator)
+		check.True(t, tt.Failed())
+	}
+	check.Equal(t, int32(1), migrator.calls.Load())
+}
+
+func TestIsTransientError(t *testing.T) {
+	t.Parallel()
+	check.True(t, pgtestdb.IsTransientError(fmt.Errorf("failed: %w", &pgconn.PgError{Code: "08006"})))
+	check.True(t, pgtestdb.IsTransientError(&pgconn.PgError{Code: "57P01"}))
+	check.True(t, pgtestdb.IsTransientError(fmt.Errorf("failed: %w", sessionlock.ErrTimeout)))
+	check.True(t, pgtestdb.IsTransientError(context.DeadlineExceeded))
+	check.False(t, pgtestdb.IsTransientError(&pgconn.PgError{Code: "42601"}))
+	check.False(t, pgtestdb.IsTransientError(errors.New("migration failed")))
+}
+
 // sqlMigrator is a test helper that satisfies the pgtestdb.Migrator interface.
 type sqlMigrator struct {
 	migrations []string
 }
 
 func (s *sqlMigrator) Hash() (string, error) {
-	hash := common.NewRecursiveHash()
+	return s.recursiveHash().String(), nil
+}
+
+func (s *sqlMigrator) Manifest() (common.Manifest, error) {
+	return s.recursiveHash().Manifest(), nil
+}
+
+func (s *sqlMigrator) recursiveHash() common.RecursiveHash {
+	hash := common.NewRecursiveHashWithManifest()
 	for _, migration := range s.migrations {
 		hash.Add([]byte(migration))
 	}
-	return hash.String(), nil
+	return hash
 }
 
 func (s *sqlMigrator) Migrate(ctx context.Context, db *sql.DB, _ pgtestdb.Config) error {
@@ -410,14 +1615,15 @@ func (s *sqlMigrator) Migrate(ctx context.Context, db *sql.DB, _ pgtestdb.Config
 type MockT struct {
 	failed   bool
 	cleanups []func()
+	logs     []string
 }
 
 func (t *MockT) Fatalf(string, ...any) {
 	t.failed = true
 }
 
-func (*MockT) Logf(string, ...any) {
-	// no-op
+func (t *MockT) Logf(format string, args ...any) {
+	t.logs = append(t.logs, fmt.Sprintf(format, args...))
 }
 
 func (*MockT) Helper() {
@@ -428,9 +1634,10 @@ func (t *MockT) Cleanup(f func()) {
 	t.cleanups = append(t.cleanups, f)
 }
 
+// DoCleanup runs the cleanups in reverse order, like testing.T.
 func (t *MockT) DoCleanup() {
-	for _, f := range t.cleanups {
-		f()
+	for i := len(t.cleanups) - 1; i >= 0; i-- {
+		t.cleanups[i]()
 	}
 }
 
@@ -0,0 +1,290 @@
+package pgtestdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// TimingsEnvVar is the environment variable that names the directory that
+// [WriteTimingsFromEnv] writes the [TimingReport] of each test process to.
+const TimingsEnvVar = "PGTESTDB_TIMINGS"
+
+// Phase is one of the steps whose time is recorded in a [TimingReport].
+type Phase string
+
+const (
+	PhaseQueue     Phase = "queue"     // waiting for the Coordinator to allow another test database
+	PhaseRole      Phase = "role"      // finding or creating the test role
+	PhaseLockWait  Phase = "lock_wait" // waiting for the template's advisory lock
+	PhaseMigrate   Phase = "migrate"   // running the migrator on a new template
+	PhaseClone     Phase = "clone"     // cloning a test database from its template
+	PhaseConnect   Phase = "connect"   // connecting to the server to create or drop a test database
+	PhaseTerminate Phase = "terminate" // terminating leftover connections to a test database
+	PhaseDrop      Phase = "drop"      // dropping a test database
+)
+
+// phases lists every phase in the order they happen, for the summary.
+var phases = []Phase{ //nolint:gochecknoglobals
+	PhaseQueue, PhaseRole, PhaseLockWait, PhaseMigrate, PhaseClone, PhaseConnect, PhaseTerminate, PhaseDrop,
+}
+
+// phaseOf returns the phase whose time is measured by an event, if any.
+func phaseOf(typ EventType) (Phase, bool) {
+	switch typ {
+	case EventSlotAcquired:
+		return PhaseQueue, true
+	case EventRoleEnsured:
+		return PhaseRole, true
+	case EventTemplateLockAcquired:
+		return PhaseLockWait, true
+	case EventTemplateBuilt:
+		return PhaseMigrate, true
+	case EventInstanceCloned:
+		return PhaseClone, true
+	case EventServerConnected:
+		return PhaseConnect, true
+	case EventConnectionsTerminated:
+		return PhaseTerminate, true
+	case EventInstanceDropped:
+		return PhaseDrop, true
+	default:
+		return "", false
+	}
+}
+
+// PhaseTiming is the time spent in a single phase.
+type PhaseTiming struct {
+	Count int           `json:"count"`
+	Total time.Duration `json:"total_ns"`
+	Max   time.Duration `json:"max_ns"`
+}
+
+func (p *PhaseTiming) add(duration time.Duration) {
+	p.Count++
+	p.Total += duration
+	if duration > p.Max {
+		p.Max = duration
+	}
+}
+
+// TemplateTimings is the time spent in each phase for a single template.
+// Setting up the test role isn't specific to any template, so it is reported
+// in a group with an empty Hash and MigratorType.
+type TemplateTimings struct {
+	Hash         string                `json:"hash"`
+	MigratorType string                `json:"migrator_type"`
+	Phases       map[Phase]PhaseTiming `json:"phases"`
+}
+
+// TimingReport is the time that a single process has spent in each phase of
+// creating and dropping test databases, both in total and broken down by
+// template. Get one with [Timings].
+type TimingReport struct {
+	PID       int                   `json:"pid"`
+	Totals    map[Phase]PhaseTiming `json:"totals"`
+	Templates []TemplateTimings     `json:"templates"`
+}
+
+// timingsKey identifies a group of timings in the collector.
+type timingsKey struct {
+	hash         string
+	migratorType string
+}
+
+// timingCollector aggregates the durations of the events sent by every test
+// in the process.
+type timingCollector struct {
+	mu     sync.Mutex
+	groups map[timingsKey]map[Phase]*PhaseTiming
+}
+
+var timings = &timingCollector{} //nolint:gochecknoglobals
+
+func (c *timingCollector) record(event Event) {
+	phase, ok := phaseOf(event.Type)
+	if !ok {
+		return
+	}
+	key := timingsKey{hash: event.Hash, migratorType: event.MigratorType}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.groups == nil {
+		c.groups = map[timingsKey]map[Phase]*PhaseTiming{}
+	}
+	group, ok := c.groups[key]
+	if !ok {
+		group = map[Phase]*PhaseTiming{}
+		c.groups[key] = group
+	}
+	timing, ok := group[phase]
+	if !ok {
+		timing = &PhaseTiming{}
+		group[phase] = timing
+	}
+	timing.add(event.Duration)
+}
+
+// Timings returns the time this process has spent in each phase of creating
+// and dropping test databases so far. It's meant to be called from TestMain
+// once the tests have finished:
+//
+//	func TestMain(m *testing.M) {
+//		code := m.Run()
+//		fmt.Fprint(os.Stderr, pgtestdb.Timings())
+//		os.Exit(code)
+//	}
+func Timings() TimingReport {
+	timings.mu.Lock()
+	defer timings.mu.Unlock()
+	report := TimingReport{
+		PID:    os.Getpid(),
+		Totals: map[Phase]PhaseTiming{},
+	}
+	for key, group := range timings.groups {
+		tt := TemplateTimings{
+			Hash:         key.hash,
+			MigratorType: key.migratorType,
+			Phases:       map[Phase]PhaseTiming{},
+		}
+		for phase, timing := range group {
+			tt.Phases[phase] = *timing
+			total := report.Totals[phase]
+			total.Count += timing.Count
+			total.Total += timing.Total
+			if timing.Max > total.Max {
+				total.Max = timing.Max
+			}
+			report.Totals[phase] = total
+		}
+		report.Templates = append(report.Templates, tt)
+	}
+	sort.Slice(report.Templates, func(i, j int) bool {
+		a, b := report.Templates[i], report.Templates[j]
+		if a.MigratorType != b.MigratorType {
+			return a.MigratorType < b.MigratorType
+		}
+		return a.Hash < b.Hash
+	})
+	return report
+}
+
+// WriteJSON writes the report to w as indented JSON. Durations are in
+// nanoseconds.
+func (r TimingReport) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// String returns a human-readable summary of the report, as a table of the
+// total time spent in each phase followed by a table for each template.
+func (r TimingReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "pgtestdb timings for process %d:\n", r.PID)
+	writePhaseTable(&b, r.Totals)
+	for _, tt := range r.Templates {
+		if tt.Hash == "" {
+			continue // the role, which is already in the totals
+		}
+		fmt.Fprintf(&b, "\ntemplate %s (%s):\n", tt.Hash, tt.MigratorType)
+		writePhaseTable(&b, tt.Phases)
+	}
+	return b.String()
+}
+
+func writePhaseTable(w io.Writer, timings map[Phase]PhaseTiming) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "phase\tcount\ttotal\tmax\t")
+	for _, phase := range phases {
+		timing, ok := timings[phase]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t\n",
+			phase, timing.Count, timing.Total.Round(time.Millisecond), timing.Max.Round(time.Millisecond))
+	}
+	tw.Flush()
+}
+
+// writingTimings is held while the timing report is written, so that two
+// calls to WriteTimings can't interleave their files.
+var writingTimings sync.Mutex //nolint:gochecknoglobals
+
+// WriteTimings writes the current [TimingReport] for this process to the
+// directory, as "pgtestdb-timings-<pid>.json" and
+// "pgtestdb-timings-<pid>.txt", creating the directory if necessary.
+func WriteTimings(dir string) error {
+	writingTimings.Lock()
+	defer writingTimings.Unlock()
+	report := Timings()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create timings directory %s: %w", dir, err)
+	}
+	base := filepath.Join(dir, fmt.Sprintf("pgtestdb-timings-%d", report.PID))
+	var jsonReport strings.Builder
+	if err := report.WriteJSON(&jsonReport); err != nil {
+		return fmt.Errorf("failed to encode timings: %w", err)
+	}
+	if err := writeFileAtomic(base+".json", jsonReport.String()); err != nil {
+		return err
+	}
+	return writeFileAtomic(base+".txt", report.String())
+}
+
+// writeFileAtomic replaces the contents of a file without ever leaving it
+// partially written, by writing a temporary file in the same directory and
+// renaming it over the file.
+func writeFileAtomic(path, contents string) (final error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	defer func() {
+		if final != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+	if _, err := tmp.WriteString(contents); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// WriteTimingsFromEnv calls [WriteTimings] with the directory named by
+// [TimingsEnvVar], if it is set, and otherwise does nothing. It's meant to be
+// called from TestMain once the tests have finished, so that the report can
+// be turned on without changing any code:
+//
+//	func TestMain(m *testing.M) {
+//		code := m.Run()
+//		if err := pgtestdb.WriteTimingsFromEnv(); err != nil {
+//			fmt.Fprintln(os.Stderr, err)
+//		}
+//		os.Exit(code)
+//	}
+func WriteTimingsFromEnv() error {
+	dir := os.Getenv(TimingsEnvVar)
+	if dir == "" {
+		return nil
+	}
+	return WriteTimings(dir)
+}
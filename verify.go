@@ -0,0 +1,188 @@
+package pgtestdb
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/peterldowns/pgtestdb/internal/catalog"
+)
+
+const (
+	// RebuildEnvVar is the name of an environment variable that, if set to
+	// "1" or "true", has the same effect as setting [Config.ForceRebuild].
+	RebuildEnvVar = "PGTESTDB_REBUILD"
+	// VerifyEnvVar is the name of an environment variable that, if set to "1"
+	// or "true", has the same effect as setting [Config.VerifyTemplates].
+	VerifyEnvVar = "PGTESTDB_VERIFY"
+	// RunIDEnvVar is the name of an environment variable that identifies a
+	// test run, so that programs with the same run ID share the templates
+	// that [Config.ForceRebuild] rebuilds, instead of each program rebuilding
+	// them. If it is not set, each program is its own run.
+	RunIDEnvVar = "PGTESTDB_RUN_ID"
+)
+
+// processRunID identifies this program when [RunIDEnvVar] is not set. It is
+// random, rather than derived from the process, since process IDs are reused
+// and would let a template built by an earlier run pass for one built by this
+// run.
+var processRunID = newProcessRunID() //nolint:gochecknoglobals
+
+func newProcessRunID() string {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(bytes)
+}
+
+// runID identifies the current test run: the value of [RunIDEnvVar] if it is
+// set, or else this program.
+func runID() string {
+	if id := os.Getenv(RunIDEnvVar); id != "" {
+		return id
+	}
+	return processRunID
+}
+
+// rebuild returns true if templates that were built before this run should be
+// dropped and rebuilt.
+func (c Config) rebuild() bool {
+	return c.ForceRebuild || envEnabled(RebuildEnvVar)
+}
+
+// envEnabled returns true if the environment variable is set to "1" or
+// "true".
+func envEnabled(name string) bool {
+	value := strings.ToLower(strings.TrimSpace(os.Getenv(name)))
+	return value == "1" || value == "true"
+}
+
+// execQueryer is implemented by both *sql.DB and *sql.Conn.
+type execQueryer interface {
+	queryer
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// dropTemplate removes an existing template database so that it can be
+// rebuilt. Postgres refuses to drop a database that is marked as a template,
+// so it is unmarked first.
+func dropTemplate(ctx context.Context, conn execQueryer, name string) error {
+	query := "UPDATE pg_database SET datistemplate = false WHERE datname = $1"
+	if _, err := conn.ExecContext(ctx, query, name); err != nil {
+		return fmt.Errorf("failed to unmark template %s: %w", name, err)
+	}
+	query = fmt.Sprintf(`DROP DATABASE IF EXISTS "%s"`, name)
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to drop template %s: %w", name, err)
+	}
+	return nil
+}
+
+// builtThisRun returns true if the template was built during this run, so that
+// it must not be rebuilt. Other programs in the run may be cloning it without
+// holding its lock.
+func builtThisRun(ctx context.Context, conn queryer, name string) bool {
+	metadata, err := readTemplateMetadata(ctx, conn, name)
+	return err == nil && metadata.RunID == runID()
+}
+
+// verifyTemplate runs the migrator against a new, empty, scratch database and
+// compares the resulting schema to the schema of the existing template. If the
+// schemas are different, the scratch database is left on the server so that
+// the developer can investigate, and an error describing the difference is
+// returned.
+func verifyTemplate(
+	ctx context.Context,
+	conn execQueryer,
+	migrator Migrator,
+	state templateState,
+) error {
+	want, err := describeTemplate(ctx, conn, state, catalog.Options{})
+	if err != nil {
+		return err
+	}
+
+	scratch := state.conf
+	scratch.Database = fmt.Sprintf("%s_verify_%s", state.conf.Database, randomID())
+	query := fmt.Sprintf(`CREATE DATABASE "%s" OWNER "%s"`, scratch.Database, scratch.User)
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to create verification database %s: %w", scratch.Database, err)
+	}
+	got, err := func() (string, error) {
+		db, err := scratch.Connect()
+		if err != nil {
+			return "", fmt.Errorf("failed to connect to verification database %s: %w", scratch.Database, err)
+		}
+		defer db.Close()
+		if err := migrator.Migrate(ctx, db, scratch); err != nil {
+			return "", fmt.Errorf("failed to migrator.Migrate verification database %s: %w", scratch.Database, err)
+		}
+		return catalog.Describe(ctx, db, catalog.Options{})
+	}()
+	if err != nil {
+		return err
+	}
+	if diff := schemaDiff(want, got); diff != "" {
+		return fmt.Errorf(
+			"template %s does not match a freshly migrated database %s (-template +fresh):\n%s",
+			state.conf.Database, scratch.Database, diff,
+		)
+	}
+	query = fmt.Sprintf(`DROP DATABASE IF EXISTS "%s"`, scratch.Database)
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to drop verification database %s: %w", scratch.Database, err)
+	}
+	return nil
+}
+
+// describeTemplate returns the schema of a template. Connecting to a template
+// would prevent other programs from cloning it, so instead this clones the
+// template and describes the clone.
+func describeTemplate(
+	ctx context.Context,
+	conn execQueryer,
+	state templateState,
+	opts catalog.Options,
+) (desc string, final error) {
+	clone := state.conf
+	clone.Database = fmt.Sprintf("%s_desc_%s", state.conf.Database, randomID())
+	query := fmt.Sprintf(
+		`CREATE DATABASE "%s" WITH TEMPLATE "%s" OWNER "%s"`,
+		clone.Database, state.conf.Database, clone.User,
+	)
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		return "", fmt.Errorf("failed to clone template %s: %w", state.conf.Database, err)
+	}
+	defer func() {
+		query := fmt.Sprintf(`DROP DATABASE IF EXISTS "%s"`, clone.Database)
+		if _, err := conn.ExecContext(ctx, query); err != nil && final == nil {
+			final = fmt.Errorf("failed to drop clone %s: %w", clone.Database, err)
+		}
+	}()
+	db, err := clone.Connect()
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to clone %s: %w", clone.Database, err)
+	}
+	defer db.Close()
+	desc, err = catalog.Describe(ctx, db, opts)
+	if err != nil {
+		return "", fmt.Errorf("failed to describe template %s: %w", state.conf.Database, err)
+	}
+	return desc, nil
+}
+
+// schemaDiff returns a line-by-line diff of two schema descriptions, or an
+// empty string if they are the same.
+func schemaDiff(want, got string) string {
+	if want == got {
+		return ""
+	}
+	return cmp.Diff(strings.Split(want, "\n"), strings.Split(got, "\n"))
+}